@@ -0,0 +1,375 @@
+// Alerts that are sent when an analysis finding crosses a threshold.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert is a finding that crossed a threshold, e.g., a batch of relays that
+// appeared while churn was unusually high.  In addition to the record's
+// fields, its JSON representation has a human-readable summary.
+type Alert struct {
+	*Record
+	Summary string `json:"summary"`
+
+	// Key identifies what the alert is about, e.g., "churn/Running/new".
+	// Together with the fingerprints, it determines if an alert is a
+	// duplicate.
+	Key string `json:"-"`
+}
+
+// NewAlert allocates and returns a new alert for the given record.
+func NewAlert(record *Record, key, summary string) *Alert {
+
+	return &Alert{Record: record, Summary: summary, Key: key}
+}
+
+// Notifier delivers alerts, e.g., by running a command, or by sending a
+// request to a webhook.
+type Notifier interface {
+	Notify(context.Context, *Alert) error
+}
+
+// commandNotifier runs a shell command for every alert.  The alert is written
+// to the command's stdin as JSON.
+type commandNotifier struct {
+	command string
+}
+
+// Notify implements the Notifier interface.
+func (n *commandNotifier) Notify(ctx context.Context, alert *Alert) error {
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", n.command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "SYBILHUNTER_ALERT_SUMMARY="+alert.Summary)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("command \"%s\" failed: %s: %s", n.command, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// webhookNotifier sends every alert as JSON in a POST request to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// Notify implements the Notifier interface.
+func (n *webhookNotifier) Notify(ctx context.Context, alert *Alert) error {
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", toolName, version))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook \"%s\" returned %s", n.url, resp.Status)
+	}
+
+	return nil
+}
+
+// formatMessage turns the given alert into an RFC 5322 email message.
+func formatMessage(alert *Alert, now time.Time) ([]byte, error) {
+
+	payload, err := json.MarshalIndent(alert, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s <%s@localhost>\n", toolName, toolName)
+	fmt.Fprintf(&msg, "To: %s@localhost\n", toolName)
+	fmt.Fprintf(&msg, "Subject: [%s] %s\n", toolName, alert.Summary)
+	fmt.Fprintf(&msg, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\n\n")
+	fmt.Fprintf(&msg, "%s\n\n%s\n", alert.Summary, payload)
+
+	return msg.Bytes(), nil
+}
+
+// mboxNotifier appends every alert as email message to an mbox file.  The
+// mutex keeps concurrent alerts from interleaving.
+type mboxNotifier struct {
+	sync.Mutex
+	path string
+}
+
+// Notify implements the Notifier interface.
+func (n *mboxNotifier) Notify(ctx context.Context, alert *Alert) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	msg, err := formatMessage(alert, now)
+	if err != nil {
+		return err
+	}
+
+	// Lines starting with "From " separate messages in mbox files, so they
+	// must be quoted in the message body.
+	var mbox bytes.Buffer
+	fmt.Fprintf(&mbox, "From %s@localhost %s\n", toolName, now.UTC().Format(time.ANSIC))
+	for _, line := range strings.SplitAfter(string(msg), "\n") {
+		if strings.HasPrefix(line, "From ") {
+			mbox.WriteString(">")
+		}
+		mbox.WriteString(line)
+	}
+	mbox.WriteString("\n")
+
+	n.Lock()
+	defer n.Unlock()
+
+	fd, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(mbox.Bytes()); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+// maildirNotifier delivers every alert as email message to a maildir.  The
+// mutex protects the counter that makes message names unique.
+type maildirNotifier struct {
+	sync.Mutex
+	dir     string
+	counter int
+}
+
+// Notify implements the Notifier interface.  Messages are written to the
+// maildir's "tmp" directory first, and then moved to "new", so mail readers
+// never see partial messages.
+func (n *maildirNotifier) Notify(ctx context.Context, alert *Alert) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	msg, err := formatMessage(alert, now)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(n.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	n.Lock()
+	n.counter++
+	name := fmt.Sprintf("%d.%d_%d.%s", now.Unix(), os.Getpid(), n.counter, hostname)
+	n.Unlock()
+
+	tmpPath := filepath.Join(n.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, msg, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(n.dir, "new", name))
+}
+
+// dedupNotifier is a notifier together with the relays that it was notified
+// about.  Every notifier remembers its own alerts, so that a notifier that
+// failed is retried without sending duplicates to the others.
+type dedupNotifier struct {
+	Notifier
+	// sent maps the deduplication keys of alerts that were delivered to
+	// the time of the most recent alert.
+	sent map[string]time.Time
+}
+
+// isDuplicate returns true if all given keys were delivered within the given
+// window before the given time.
+func (n *dedupNotifier) isDuplicate(keys []string, now time.Time, window time.Duration) bool {
+
+	for _, key := range keys {
+		last, ok := n.sent[key]
+		if !ok || now.Sub(last) >= window {
+			return false
+		}
+	}
+
+	return true
+}
+
+// evict forgets the keys that were delivered at least the given window before
+// the given time.  They can't make an alert a duplicate anymore, so the
+// notifier doesn't grow without bound in long watch runs.
+func (n *dedupNotifier) evict(now time.Time, window time.Duration) {
+
+	for key, last := range n.sent {
+		if now.Sub(last) >= window {
+			delete(n.sent, key)
+		}
+	}
+}
+
+// Alerter passes alerts on to all configured notifiers, unless the alert is a
+// duplicate.  An alert is a duplicate for a notifier if all of its relays were
+// part of an alert with the same key that the notifier delivered within the
+// deduplication window.  That way, a batch of relays that keeps crossing a
+// threshold doesn't alert every hour.  A nil Alerter drops all alerts.
+// Alerter is safe for concurrent use.
+type Alerter struct {
+	sync.Mutex
+	notifiers []*dedupNotifier
+	window    time.Duration
+}
+
+// newAlerter returns an Alerter that passes alerts on to the given notifiers,
+// and that uses the given deduplication window.
+func newAlerter(notifiers []Notifier, window time.Duration) *Alerter {
+
+	alerter := &Alerter{window: window}
+	for _, notifier := range notifiers {
+		alerter.notifiers = append(alerter.notifiers, &dedupNotifier{
+			Notifier: notifier,
+			sent:     make(map[string]time.Time),
+		})
+	}
+
+	return alerter
+}
+
+// NewAlerter returns an Alerter for the alert destinations in the given
+// parameters.  If no destination is configured, nil is returned.
+func NewAlerter(params *CmdLineParams) *Alerter {
+
+	var notifiers []Notifier
+	if params.AlertCommand != "" {
+		notifiers = append(notifiers, &commandNotifier{command: params.AlertCommand})
+	}
+	if params.AlertWebhook != "" {
+		notifiers = append(notifiers, &webhookNotifier{url: params.AlertWebhook, client: &http.Client{Timeout: 30 * time.Second}})
+	}
+	if params.AlertMbox != "" {
+		notifiers = append(notifiers, &mboxNotifier{path: params.AlertMbox})
+	}
+	if params.AlertMaildir != "" {
+		notifiers = append(notifiers, &maildirNotifier{dir: params.AlertMaildir})
+	}
+
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	return newAlerter(notifiers, params.AlertDedup)
+}
+
+// dedupKeys returns the keys under which the given alert is remembered for
+// deduplication: one for every relay, or only the alert's key if it's not
+// about relays.
+func dedupKeys(alert *Alert) []string {
+
+	if len(alert.Fingerprints) == 0 {
+		return []string{alert.Key}
+	}
+
+	keys := make([]string, len(alert.Fingerprints))
+	for i, fingerprint := range alert.Fingerprints {
+		keys[i] = fmt.Sprintf("%s/%s", alert.Key, fingerprint)
+	}
+
+	return keys
+}
+
+// Alert sends the given alert to all notifiers for which it's not a
+// duplicate.  The deduplication window is measured in the alert's time, so
+// that archived data is deduplicated just like live data.  Alerts without time
+// use the current time.  Failed notifications are logged, and the notifier
+// doesn't remember the alert, so that it's sent to the notifier again the next
+// time.  The Alerter isn't locked while notifiers run, so a slow notifier
+// doesn't hold up the analyses that raise other alerts.
+func (a *Alerter) Alert(ctx context.Context, alert *Alert) {
+
+	if a == nil {
+		return
+	}
+
+	now := time.Now()
+	if alert.Time != nil {
+		now = *alert.Time
+	}
+
+	keys := dedupKeys(alert)
+	var pending []*dedupNotifier
+	a.Lock()
+	for _, notifier := range a.notifiers {
+		notifier.evict(now, a.window)
+		if !notifier.isDuplicate(keys, now, a.window) {
+			pending = append(pending, notifier)
+		}
+	}
+	a.Unlock()
+
+	if len(pending) == 0 {
+		log.Printf("Suppressing duplicate alert: %s\n", alert.Summary)
+		return
+	}
+
+	log.Printf("Sending alert: %s\n", alert.Summary)
+	var delivered []*dedupNotifier
+	for _, notifier := range pending {
+		if err := notifier.Notify(ctx, alert); err != nil {
+			log.Printf("Couldn't send alert: %s\n", err)
+			continue
+		}
+		delivered = append(delivered, notifier)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	for _, notifier := range delivered {
+		for _, key := range keys {
+			notifier.sent[key] = now
+		}
+	}
+}
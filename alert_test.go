@@ -0,0 +1,210 @@
+// Test sending and deduplicating alerts.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// fakeNotifier counts the alerts it's notified about.  It fails as long as
+// failures is larger than zero.
+type fakeNotifier struct {
+	alerts   int
+	failures int
+}
+
+// Notify implements the Notifier interface.
+func (n *fakeNotifier) Notify(ctx context.Context, alert *Alert) error {
+
+	if n.failures > 0 {
+		n.failures--
+		return errors.New("notifier is down")
+	}
+	n.alerts++
+
+	return nil
+}
+
+// newTestAlert returns a churn alert about the given relays at the given
+// number of hours after August 1, 2015.
+func newTestAlert(hours int, fingerprints ...tor.Fingerprint) *Alert {
+
+	date := time.Date(2015, 8, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(hours) * time.Hour)
+	record := NewRecord("churn", "churn_alert", date, fingerprints...)
+
+	return NewAlert(record, "churn/Running/new", "Churn of Running relays is high.")
+}
+
+func TestWebhookNotifier(t *testing.T) {
+
+	var received Alert
+	var contentType string
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Webhook got %s request, but expected POST.", r.Method)
+		}
+		contentType = r.Header.Get("Content-Type")
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Couldn't read request: %s", err)
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("Couldn't parse alert %q: %s", body, err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier := &webhookNotifier{url: server.URL, client: server.Client()}
+	alert := newTestAlert(0, "AAAA", "BBBB")
+
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notifying webhook failed: %s", err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content type is %q, but expected application/json.", contentType)
+	}
+	if received.Summary != alert.Summary || received.Analysis != "churn" || len(received.Fingerprints) != 2 {
+		t.Errorf("Webhook got alert %+v, but expected %+v.", received, alert)
+	}
+
+	status = http.StatusInternalServerError
+	if err := notifier.Notify(context.Background(), alert); err == nil {
+		t.Errorf("Notifying webhook succeeded even though it returned %d.", status)
+	}
+}
+
+func TestAlerterDedup(t *testing.T) {
+
+	working := &fakeNotifier{}
+	// The second notifier fails the first time it's notified.
+	failing := &fakeNotifier{failures: 1}
+	alerter := newAlerter([]Notifier{working, failing}, 24*time.Hour)
+
+	tests := []struct {
+		name    string
+		alert   *Alert
+		working int
+		failing int
+	}{
+		{"first alert", newTestAlert(0, "A", "B"), 1, 0},
+		// Only the notifier that failed gets the alert again.
+		{"retry", newTestAlert(1, "A", "B"), 1, 1},
+		{"duplicate", newTestAlert(2, "A", "B"), 1, 1},
+		{"subset", newTestAlert(3, "A"), 1, 1},
+		{"new relay", newTestAlert(4, "A", "C"), 2, 2},
+		// The window of B ends 24 hours after the retry.
+		{"within window", newTestAlert(24, "B"), 3, 2},
+		{"after window", newTestAlert(25, "B"), 3, 3},
+	}
+
+	for _, test := range tests {
+		alerter.Alert(context.Background(), test.alert)
+		if working.alerts != test.working || failing.alerts != test.failing {
+			t.Errorf("%s: notifiers got %d and %d alerts, but expected %d and %d.",
+				test.name, working.alerts, failing.alerts, test.working, test.failing)
+		}
+	}
+
+	// Once the window passed, the relays are forgotten.
+	alerter.Alert(context.Background(), newTestAlert(100, "D"))
+	for i, notifier := range alerter.notifiers {
+		if len(notifier.sent) != 1 {
+			t.Errorf("Notifier #%d remembers %d relays, but expected 1.", i, len(notifier.sent))
+		}
+	}
+}
+
+func TestNilAlerter(t *testing.T) {
+
+	var alerter *Alerter
+	// A nil Alerter drops alerts instead of crashing.
+	alerter.Alert(context.Background(), newTestAlert(0, "A"))
+}
+
+// blockingNotifier counts the alerts it's notified about.  It blocks the first
+// alert until release is closed.
+type blockingNotifier struct {
+	sync.Mutex
+	alerts  int
+	blocked chan struct{}
+	release chan struct{}
+}
+
+// Notify implements the Notifier interface.
+func (n *blockingNotifier) Notify(ctx context.Context, alert *Alert) error {
+
+	n.Lock()
+	blocked := n.blocked
+	n.blocked = nil
+	n.alerts++
+	n.Unlock()
+
+	if blocked != nil {
+		close(blocked)
+		<-n.release
+	}
+
+	return nil
+}
+
+func TestAlerterNotifiesWithoutLock(t *testing.T) {
+
+	slow := &blockingNotifier{blocked: make(chan struct{}), release: make(chan struct{})}
+	alerter := newAlerter([]Notifier{slow}, time.Hour)
+	blocked := slow.blocked
+
+	done := make(chan struct{})
+	go func() {
+		alerter.Alert(context.Background(), newTestAlert(0, "A"))
+		close(done)
+	}()
+	<-blocked
+
+	// Another alert gets through while the first notification is pending.
+	finished := make(chan struct{})
+	go func() {
+		alerter.Alert(context.Background(), newTestAlert(1, "B"))
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Second alert waited for the first notification.")
+	}
+
+	close(slow.release)
+	<-done
+	slow.Lock()
+	defer slow.Unlock()
+	if slow.alerts != 2 {
+		t.Errorf("Notifier got %d alerts, but expected 2.", slow.alerts)
+	}
+}
+
+func TestMboxNotifierCancelled(t *testing.T) {
+
+	path := writeFixture(t, "alerts.mbox", nil)
+	notifier := &mboxNotifier{path: path}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := notifier.Notify(ctx, newTestAlert(0, "A")); err != context.Canceled {
+		t.Errorf("Notifying returned %v, but expected %v.", err, context.Canceled)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || len(content) != 0 {
+		t.Errorf("Cancelled notifier wrote %q (%v).", content, err)
+	}
+}
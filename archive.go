@@ -0,0 +1,426 @@
+// Walk over archived data in a variety of compression and container formats.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	zstd "github.com/klauspost/compress/zstd"
+	xz "github.com/ulikunitz/xz"
+)
+
+// WalkFunc is called for every file that is found while walking over archive
+// data.  The io.Reader is nil for directories.
+type WalkFunc func(string, os.FileInfo, io.Reader) error
+
+// ErrorFunc is called for files that cannot be walked.  If it returns an
+// error, the walk stops; otherwise it continues with the next file.
+type ErrorFunc func(string, error) error
+
+// ArchiveFormat describes a compression or container format.  Formats are
+// recognised by their magic bytes at the given offset rather than by their
+// file name suffix.
+type ArchiveFormat struct {
+	Name   string
+	Magic  []byte
+	Offset int
+
+	// Suffix is stripped from a file name once the file is decompressed, so
+	// that "foo.tar.xz" becomes "foo.tar".
+	Suffix string
+
+	// Decompress is set for compression formats, and wraps the given reader
+	// in a decompressing reader.
+	Decompress func(io.Reader) (io.ReadCloser, error)
+
+	// Walk is set for container formats, and passes all entries in the given
+	// container to the WalkFunc.
+	Walk func(string, io.Reader, WalkFunc) error
+}
+
+// archiveFormats holds all registered archive formats.
+var archiveFormats []*ArchiveFormat
+
+// maxMagicLength is the number of bytes that we need to inspect to recognise
+// all registered archive formats.
+var maxMagicLength int
+
+// RegisterArchiveFormat makes the given archive format known to
+// walkArchiveData.
+func RegisterArchiveFormat(format *ArchiveFormat) {
+
+	archiveFormats = append(archiveFormats, format)
+
+	if length := format.Offset + len(format.Magic); length > maxMagicLength {
+		maxMagicLength = length
+	}
+}
+
+func init() {
+
+	RegisterArchiveFormat(&ArchiveFormat{
+		Name:       "xz",
+		Magic:      []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		Suffix:     ".xz",
+		Decompress: xzReader,
+	})
+	RegisterArchiveFormat(&ArchiveFormat{
+		Name:       "gzip",
+		Magic:      []byte{0x1f, 0x8b},
+		Suffix:     ".gz",
+		Decompress: gzipReader,
+	})
+	RegisterArchiveFormat(&ArchiveFormat{
+		Name:       "bzip2",
+		Magic:      []byte{'B', 'Z', 'h'},
+		Suffix:     ".bz2",
+		Decompress: bzip2Reader,
+	})
+	RegisterArchiveFormat(&ArchiveFormat{
+		Name:       "zstd",
+		Magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		Suffix:     ".zst",
+		Decompress: zstdReader,
+	})
+	// Both POSIX and GNU tar files have "ustar" at offset 257.
+	RegisterArchiveFormat(&ArchiveFormat{
+		Name:   "tar",
+		Magic:  []byte{'u', 's', 't', 'a', 'r'},
+		Offset: 257,
+		Walk:   walkTar,
+	})
+	RegisterArchiveFormat(&ArchiveFormat{
+		Name:  "zip",
+		Magic: []byte{'P', 'K', 0x03, 0x04},
+		Walk:  walkZip,
+	})
+}
+
+// matchArchiveFormat returns the archive format whose magic bytes match the
+// given file header, or nil if no format matches.
+func matchArchiveFormat(header []byte) *ArchiveFormat {
+
+	for _, format := range archiveFormats {
+		end := format.Offset + len(format.Magic)
+		if len(header) < end {
+			continue
+		}
+		if bytes.Equal(header[format.Offset:end], format.Magic) {
+			return format
+		}
+	}
+
+	return nil
+}
+
+// Decompress the given io.Reader and return a new io.ReadCloser containing the
+// decompressed output.
+//
+// Decompression happens in-process, so the xz command does not have to be
+// installed.  Corrupt or truncated input surfaces as an error when reading
+// from the returned io.ReadCloser.
+func xzReader(r io.Reader) (io.ReadCloser, error) {
+
+	xzr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(xzr), nil
+}
+
+// Decompress the given gzip-compressed io.Reader.
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
+
+	return gzip.NewReader(r)
+}
+
+// Decompress the given bzip2-compressed io.Reader.
+func bzip2Reader(r io.Reader) (io.ReadCloser, error) {
+
+	return ioutil.NopCloser(bzip2.NewReader(r)), nil
+}
+
+// Decompress the given zstd-compressed io.Reader.  The returned io.ReadCloser
+// must be closed to release the decoder's resources.
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
+
+// stickyReader wraps an io.Reader and remembers the first error other than
+// io.EOF that the reader returned.  Callbacks that read archive entries may
+// swallow errors, so we use it to find out if decompression failed anyway.
+type stickyReader struct {
+	r   io.Reader
+	err error
+}
+
+// Read implements the io.Reader interface.
+func (s *stickyReader) Read(p []byte) (int, error) {
+
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+
+	return n, err
+}
+
+// walkReader passes the given reader to callback.  If the given archive format
+// is not nil, the reader is first decompressed or, for container formats,
+// walked entry by entry.
+func walkReader(name string, info os.FileInfo, r io.Reader, format *ArchiveFormat, callback WalkFunc) error {
+
+	if format == nil {
+		return callback(name, info, r)
+	}
+
+	if format.Walk != nil {
+		return format.Walk(name, r, callback)
+	}
+
+	decompressed, err := format.Decompress(r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	defer decompressed.Close()
+
+	sticky := &stickyReader{r: decompressed}
+	err = walkStream(strings.TrimSuffix(name, format.Suffix), info, sticky, callback)
+	if err != nil {
+		return err
+	}
+
+	// Consumers such as tar.Reader stop reading before the end of the stream,
+	// so we drain what's left to verify the stream's trailer and checksums.
+	io.Copy(ioutil.Discard, sticky)
+
+	// The callback may have swallowed a decompression error.
+	if sticky.err != nil {
+		return fmt.Errorf("%s: %s", name, sticky.err)
+	}
+
+	return nil
+}
+
+// walkStream determines the archive format of the given stream by peeking at
+// its first bytes, and then passes it on to walkReader.
+func walkStream(name string, info os.FileInfo, r io.Reader, callback WalkFunc) error {
+
+	br := bufio.NewReader(r)
+	// Peek returns an error if the stream is shorter than maxMagicLength,
+	// which is fine: we then match against fewer bytes.
+	header, _ := br.Peek(maxMagicLength)
+
+	return walkReader(name, info, br, matchArchiveFormat(header), callback)
+}
+
+// walkFile opens the named file, determines its archive format, and passes it
+// on to walkReader.
+func walkFile(path string, info os.FileInfo, callback WalkFunc) error {
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	header := make([]byte, maxMagicLength)
+	n, err := fd.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return walkReader(path, info, fd, matchArchiveFormat(header[:n]), callback)
+}
+
+// tarBlockSize is the size of the blocks that tar archives consist of.
+const tarBlockSize = 512
+
+// tailReader wraps an io.Reader, and remembers the last tar block that was
+// read from it.  tar.Reader doesn't complain about archives that end after an
+// entry, or in an entry's padding, so we use it to find out if the archive
+// ends with its end-of-archive marker, i.e., zero blocks.  tailReader has no
+// Seek method, so tar.Reader can't skip over a truncated file's end.
+type tailReader struct {
+	r      io.Reader
+	n      int64
+	tail   [tarBlockSize]byte
+	filled int
+}
+
+// Read implements the io.Reader interface.
+func (t *tailReader) Read(p []byte) (int, error) {
+
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+
+	if n >= tarBlockSize {
+		copy(t.tail[:], p[n-tarBlockSize:n])
+		t.filled = tarBlockSize
+	} else if n > 0 {
+		copy(t.tail[:], t.tail[n:])
+		copy(t.tail[tarBlockSize-n:], p[:n])
+		t.filled += n
+		if t.filled > tarBlockSize {
+			t.filled = tarBlockSize
+		}
+	}
+
+	return n, err
+}
+
+// terminated returns true if what was read so far consists of complete tar
+// blocks, the last of which is a zero block.
+func (t *tailReader) terminated() bool {
+
+	if t.n%tarBlockSize != 0 || t.filled < tarBlockSize {
+		return false
+	}
+	for _, b := range t.tail {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Walk over the entries of the given tar stream and pass them to callback.
+//
+// Unlike filepath.Walk, this function does not visit directory entries in
+// lexicographic order, rather the order they appear in the tar file.
+func walkTar(name string, r io.Reader, callback WalkFunc) error {
+
+	tail := &tailReader{r: r}
+	t := tar.NewReader(tail)
+
+	for {
+		header, err := t.Next()
+		if err == io.EOF {
+			if !tail.terminated() {
+				return fmt.Errorf("%s: %s", name, io.ErrUnexpectedEOF)
+			}
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+
+		info := header.FileInfo()
+		if info.IsDir() {
+			err = callback(header.Name, info, nil)
+		} else {
+			err = walkStream(header.Name, info, t, callback)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Walk over the entries of the given zip archive and pass them to callback.
+// Zip archives require random access, so unless the given reader is a file,
+// the archive is read into memory first.
+func walkZip(name string, r io.Reader, callback WalkFunc) error {
+
+	var readerAt io.ReaderAt
+	var size int64
+
+	if fd, ok := r.(*os.File); ok {
+		info, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		readerAt, size = fd, info.Size()
+	} else {
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		readerAt, size = bytes.NewReader(content), int64(len(content))
+	}
+
+	z, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	for _, file := range z.File {
+		info := file.FileInfo()
+		if info.IsDir() {
+			if err := callback(file.Name, info, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fd, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", name, file.Name, err)
+		}
+		err = walkStream(file.Name, info, fd, callback)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Walk over the entries of path, open each one, and pass it to callback.
+// Files in a supported archive format are decompressed or unpacked first.
+// Files that cannot be walked are passed to onError.
+func walkPath(path string, callback WalkFunc, onError ErrorFunc) error {
+
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return onError(path, err)
+		}
+
+		if info.IsDir() {
+			return callback(path, info, nil)
+		}
+
+		if err := walkFile(path, info, callback); err != nil {
+			return onError(path, err)
+		}
+
+		return nil
+	}
+
+	return filepath.Walk(path, walkFn)
+}
+
+// Walk over the entries of the given path.  The given path can be a directory,
+// a plain file, or any archive format that was registered using
+// RegisterArchiveFormat, e.g., .tar.xz, .tar.gz, .tar.bz2, .tar.zst, .tar, or
+// .zip.  Archive formats are recognised by their magic bytes.  Files that
+// cannot be walked are passed to onError, which decides if the walk goes on.
+func walkArchiveData(path string, callback WalkFunc, onError ErrorFunc) error {
+
+	return walkPath(path, callback, onError)
+}
@@ -0,0 +1,346 @@
+// Test walking over archived data.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	zstd "github.com/klauspost/compress/zstd"
+	xz "github.com/ulikunitz/xz"
+)
+
+// fixtureEntries holds the files of our fixture archives.
+var fixtureEntries = map[string]string{
+	"consensuses-2015-08/01/2015-08-01-00-00-00-consensus": "network-status-version 3\n",
+	"consensuses-2015-08/01/2015-08-01-01-00-00-consensus": "network-status-version 3\nvalid-after 2015-08-01 01:00:00\n",
+	"consensuses-2015-08/02/2015-08-02-00-00-00-consensus": "",
+}
+
+// sortedNames returns the names of the given entries in lexicographic order.
+func sortedNames(entries map[string]string) []string {
+
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// makeTar returns a tar archive containing the given entries.
+func makeTar(t *testing.T, entries map[string]string) []byte {
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range sortedNames(entries) {
+		content := entries[name]
+		header := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// makeXZ returns the given data, compressed with xz.
+func makeXZ(t *testing.T, data []byte) []byte {
+
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// makeGzip returns the given data, compressed with gzip.
+func makeGzip(t *testing.T, data []byte) []byte {
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// makeZstd returns the given data, compressed with zstd.
+func makeZstd(t *testing.T, data []byte) []byte {
+
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// makeZip returns a zip archive containing the given entries.
+func makeZip(t *testing.T, entries map[string]string) []byte {
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range sortedNames(entries) {
+		fd, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(fd, entries[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// writeFixture writes the given data to a file with the given name in a new
+// temporary directory, and returns the file's path.
+func writeFixture(t *testing.T, name string, data []byte) string {
+
+	dir, err := ioutil.TempDir("", "sybilhunter_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// walkFixture walks over the given path and returns the content of every file
+// that it found, and the walk's error.  Errors are passed on by onError, so
+// the walk stops at the first one.
+func walkFixture(path string) (map[string]string, error) {
+
+	found := make(map[string]string)
+	callback := func(name string, info os.FileInfo, r io.Reader) error {
+		if r == nil {
+			return nil
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		found[name] = string(content)
+		return nil
+	}
+	onError := func(name string, err error) error {
+		return err
+	}
+
+	return found, walkArchiveData(path, callback, onError)
+}
+
+func TestWalkTarXZ(t *testing.T) {
+
+	path := writeFixture(t, "consensuses-2015-08.tar.xz", makeXZ(t, makeTar(t, fixtureEntries)))
+
+	found, err := walkFixture(path)
+	if err != nil {
+		t.Fatalf("Walking valid archive failed: %s", err)
+	}
+	if !reflect.DeepEqual(found, fixtureEntries) {
+		t.Errorf("Walk found %v, but expected %v.", found, fixtureEntries)
+	}
+}
+
+func TestWalkBrokenTarXZ(t *testing.T) {
+
+	archive := makeXZ(t, makeTar(t, fixtureEntries))
+
+	// Flip a byte in the middle of the compressed block, so that the block's
+	// check fails.
+	corrupt := append([]byte(nil), archive...)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated in the block", archive[:len(archive)/2]},
+		{"truncated in the trailer", archive[:len(archive)-4]},
+		{"corrupt block", corrupt},
+	}
+
+	for _, test := range tests {
+		path := writeFixture(t, "consensuses-2015-08.tar.xz", test.data)
+		if _, err := walkFixture(path); err == nil {
+			t.Errorf("%s: walk of broken archive succeeded.", test.name)
+		}
+	}
+}
+
+func TestMatchArchiveFormat(t *testing.T) {
+
+	tarHeader := makeTar(t, fixtureEntries)[:maxMagicLength]
+
+	tests := []struct {
+		header []byte
+		format string
+	}{
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, "xz"},
+		{[]byte{0x1f, 0x8b, 0x08}, "gzip"},
+		{[]byte("BZh91AY&SY"), "bzip2"},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, "zstd"},
+		{tarHeader, "tar"},
+		{[]byte{'P', 'K', 0x03, 0x04, 0x14}, "zip"},
+		{[]byte("network-status-version 3"), ""},
+		{[]byte{0xfd, '7'}, ""},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		format := matchArchiveFormat(test.header)
+		name := ""
+		if format != nil {
+			name = format.Name
+		}
+		if name != test.format {
+			t.Errorf("Header %q was recognised as %q, but expected %q.", test.header, name, test.format)
+		}
+	}
+}
+
+func TestWalkArchiveFormats(t *testing.T) {
+
+	tarball := makeTar(t, fixtureEntries)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"consensuses-2015-08.tar", tarball},
+		{"consensuses-2015-08.tar.gz", makeGzip(t, tarball)},
+		{"consensuses-2015-08.tar.zst", makeZstd(t, tarball)},
+		{"consensuses-2015-08.tar.xz", makeXZ(t, tarball)},
+		{"consensuses-2015-08.zip", makeZip(t, fixtureEntries)},
+		// The file name suffix doesn't matter.
+		{"consensuses-2015-08.archive", makeGzip(t, tarball)},
+	}
+
+	for _, test := range tests {
+		path := writeFixture(t, test.name, test.data)
+		found, err := walkFixture(path)
+		if err != nil {
+			t.Errorf("%s: walk failed: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(found, fixtureEntries) {
+			t.Errorf("%s: walk found %v, but expected %v.", test.name, found, fixtureEntries)
+		}
+	}
+}
+
+func TestWalkCompressedFiles(t *testing.T) {
+
+	const content = "router test 127.0.0.1 9001 0 0\n"
+	data := []byte(content)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"descriptor.xz", makeXZ(t, data)},
+		{"descriptor.gz", makeGzip(t, data)},
+		{"descriptor.zst", makeZstd(t, data)},
+		{"descriptor", data},
+	}
+
+	for _, test := range tests {
+		path := writeFixture(t, test.name, test.data)
+
+		// Walk over the directory tree that contains the file.
+		found, err := walkFixture(filepath.Dir(path))
+		if err != nil {
+			t.Errorf("%s: walk failed: %s", test.name, err)
+			continue
+		}
+
+		expected := map[string]string{
+			filepath.Join(filepath.Dir(path), "descriptor"): content,
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("%s: walk found %v, but expected %v.", test.name, found, expected)
+		}
+	}
+}
+
+func TestWalkBrokenArchives(t *testing.T) {
+
+	tarball := makeTar(t, fixtureEntries)
+	truncate := func(data []byte) []byte {
+		return data[:len(data)/2+1]
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"consensuses-2015-08.tar", truncate(tarball)},
+		// Without its end-of-archive marker, the archive ends right after an
+		// entry.
+		{"consensuses-2015-08.tar", tarball[:len(tarball)-2*tarBlockSize]},
+		{"consensuses-2015-08.tar", tarball[:2*tarBlockSize]},
+		{"consensuses-2015-08.tar.gz", truncate(makeGzip(t, tarball))},
+		{"consensuses-2015-08.tar.zst", truncate(makeZstd(t, tarball))},
+		{"consensuses-2015-08.zip", truncate(makeZip(t, fixtureEntries))},
+		{"descriptor.gz", truncate(makeGzip(t, []byte(strings.Repeat("router ", 100))))},
+	}
+
+	for _, test := range tests {
+		path := writeFixture(t, test.name, test.data)
+		if _, err := walkFixture(path); err == nil {
+			t.Errorf("%s: walk of truncated archive succeeded.", test.name)
+		}
+	}
+}
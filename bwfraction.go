@@ -3,87 +3,69 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"sort"
-	"sync"
 
+	"github.com/NullHypothesis/sybilhunter/bwfraction"
+	"github.com/NullHypothesis/sybilhunter/microdesc"
 	tor "github.com/NullHypothesis/zoossh"
 )
 
-// SortRelays stores relay fingerprints and their respective bandwidth values.
-// The struct is used to sort by bandwidth.
-type SortRelays struct {
-	Fingerprints []tor.Fingerprint
-	Bandwidths   []uint64
-}
-
-// Implement the sort interface (1/3).
-func (sr SortRelays) Len() int {
-	return len(sr.Fingerprints)
-}
-
-// Implement the sort interface (2/3).
-func (sr SortRelays) Swap(i int, j int) {
-	sr.Fingerprints[i], sr.Fingerprints[j] = sr.Fingerprints[j], sr.Fingerprints[i]
-	sr.Bandwidths[i], sr.Bandwidths[j] = sr.Bandwidths[j], sr.Bandwidths[i]
-}
+// DetermineRelays determines and prints which relays provide the given
+// fraction of bandwidth in the given consensus to the given sink.  The output
+// is either CSV or, if the given format is JSON, one record per relay.
+func DetermineRelays(consensus *tor.Consensus, fraction float64, format string, sink Sink) error {
 
-// Implement the sort interface (3/3).
-func (sr SortRelays) Less(i int, j int) bool {
-	return sr.Bandwidths[i] < sr.Bandwidths[j]
-}
-
-// Determine and print which relays provide the given fraction of bandwidth in
-// the given consensus.
-func DetermineRelays(consensus *tor.Consensus, fraction float64) {
-
-	// Populate our struct that's used for sorting relays by bandwidth.
-	totalBw := uint64(0)
-	sr := SortRelays{make([]tor.Fingerprint, 0), make([]uint64, 0)}
-	for fingerprint, getStatus := range consensus.RouterStatuses {
-		status := getStatus()
-		totalBw += status.Bandwidth
-		sr.Fingerprints = append(sr.Fingerprints, fingerprint)
-		sr.Bandwidths = append(sr.Bandwidths, status.Bandwidth)
-	}
+	totalBw := bwfraction.TotalBandwidth(consensus)
 	log.Printf("Total consensus bandwidth: %d\n", totalBw)
-	sort.Sort(sr)
+	log.Printf("Bandwidth threshold %.2f (%.2f%%)\n", fraction*float64(totalBw), fraction*100)
 
-	threshold := fraction * float64(totalBw)
-	log.Printf("Bandwidth threshold %.2f (%.2f%%)\n", threshold, fraction*100)
+	relays, err := bwfraction.DetermineRelays(consensus, fraction)
+	if err != nil {
+		return err
+	}
 
-	relayCount := 0
-	bwCount := uint64(0)
-	fmt.Println("fingerprint,ip_addr,bandwidth")
-	// Iterate over relays, high-bandwidth to low-bandwidth.
-	for i := len(sr.Fingerprints) - 1; i >= 0; i-- {
-		bwCount += sr.Bandwidths[i]
-		if float64(bwCount) <= threshold {
-			status, exists := consensus.Get(sr.Fingerprints[i])
-			if !exists {
-				log.Fatalf("Couldn't find relay %s anymore?\n", sr.Fingerprints[i])
-			}
-			fmt.Printf("%s,%s,%d\n", sr.Fingerprints[i], status.Address, sr.Bandwidths[i])
-			relayCount++
+	if format != jsonFormat {
+		fmt.Fprintln(sink, "fingerprint,ip_addr,bandwidth")
+	}
+	for _, status := range relays {
+		if format == jsonFormat {
+			record := NewRecord("bwfraction", "fast_relay", consensus.ValidAfter, status.Fingerprint)
+			record.Data["address"] = status.Address.IPv4Address.String()
+			record.Data["bandwidth"] = status.Bandwidth
+			record.Data["fraction"] = fraction
+			sink.Emit(record)
 		} else {
-			break
+			fmt.Fprintf(sink, "%s,%s,%d\n", status.Fingerprint, status.Address, status.Bandwidth)
 		}
 	}
 
-	relayFraction := float32(relayCount) / float32(consensus.Length()) * 100
+	relayFraction := float32(len(relays)) / float32(consensus.Length()) * 100
 	log.Printf("%d out of %d relays (%.2f%%) provide %.2f%% of the overall bandwidth.\n",
-		relayCount, consensus.Length(), relayFraction, fraction*100)
+		len(relays), consensus.Length(), relayFraction, fraction*100)
+
+	return nil
 }
 
 // FindFastRelays determines which relays are responsible for n% of the total
 // network bandwidth.
-func FindFastRelays(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
-
-	defer group.Done()
+func FindFastRelays(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
 	// Iterate over all consensus files.
 	for objects := range channel {
-		DetermineRelays(objects.(*tor.Consensus), params.BwFraction)
+		if _, ok := objects.(*microdesc.Microdescriptors); ok {
+			continue
+		}
+		consensus, ok := microdesc.ConsensusOf(objects)
+		if !ok {
+			return errors.New("Only router status files are supported for bandwidth analysis.")
+		}
+		if err := DetermineRelays(consensus, params.BwFraction, params.Format, sink); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
@@ -0,0 +1,82 @@
+// Package bwfraction determines the relays that contribute a given fraction
+// of the overall bandwidth.
+package bwfraction
+
+import (
+	"fmt"
+	"sort"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// SortRelays stores relay fingerprints and their respective bandwidth values.
+// The struct is used to sort by bandwidth.
+type SortRelays struct {
+	Fingerprints []tor.Fingerprint
+	Bandwidths   []uint64
+}
+
+// Implement the sort interface (1/3).
+func (sr SortRelays) Len() int {
+	return len(sr.Fingerprints)
+}
+
+// Implement the sort interface (2/3).
+func (sr SortRelays) Swap(i int, j int) {
+	sr.Fingerprints[i], sr.Fingerprints[j] = sr.Fingerprints[j], sr.Fingerprints[i]
+	sr.Bandwidths[i], sr.Bandwidths[j] = sr.Bandwidths[j], sr.Bandwidths[i]
+}
+
+// Implement the sort interface (3/3).
+func (sr SortRelays) Less(i int, j int) bool {
+	return sr.Bandwidths[i] < sr.Bandwidths[j]
+}
+
+// TotalBandwidth returns the sum of the bandwidth of all relays in the given
+// consensus.
+func TotalBandwidth(consensus *tor.Consensus) uint64 {
+
+	totalBw := uint64(0)
+	for _, getStatus := range consensus.RouterStatuses {
+		totalBw += getStatus().Bandwidth
+	}
+
+	return totalBw
+}
+
+// DetermineRelays determines and returns the relays that provide the given
+// fraction of bandwidth in the given consensus.  The relays are ordered by
+// bandwidth, fastest first.
+func DetermineRelays(consensus *tor.Consensus, fraction float64) ([]*tor.RouterStatus, error) {
+
+	// Populate our struct that's used for sorting relays by bandwidth.
+	totalBw := uint64(0)
+	sr := SortRelays{make([]tor.Fingerprint, 0), make([]uint64, 0)}
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		status := getStatus()
+		totalBw += status.Bandwidth
+		sr.Fingerprints = append(sr.Fingerprints, fingerprint)
+		sr.Bandwidths = append(sr.Bandwidths, status.Bandwidth)
+	}
+	sort.Sort(sr)
+
+	threshold := fraction * float64(totalBw)
+
+	var relays []*tor.RouterStatus
+	bwCount := uint64(0)
+	// Iterate over relays, high-bandwidth to low-bandwidth.
+	for i := len(sr.Fingerprints) - 1; i >= 0; i-- {
+		bwCount += sr.Bandwidths[i]
+		if float64(bwCount) > threshold {
+			break
+		}
+
+		status, exists := consensus.Get(sr.Fingerprints[i])
+		if !exists {
+			return nil, fmt.Errorf("Couldn't find relay %s anymore?", sr.Fingerprints[i])
+		}
+		relays = append(relays, status)
+	}
+
+	return relays, nil
+}
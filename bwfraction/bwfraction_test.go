@@ -0,0 +1,48 @@
+// Test determining the relays that provide a fraction of bandwidth.
+
+package bwfraction
+
+import (
+	"reflect"
+	"testing"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+func TestDetermineRelays(t *testing.T) {
+
+	consensus := tor.NewConsensus()
+	for fingerprint, bandwidth := range map[tor.Fingerprint]uint64{"A": 50, "B": 30, "C": 20} {
+		consensus.Set(fingerprint, &tor.RouterStatus{Fingerprint: fingerprint, Bandwidth: bandwidth})
+	}
+
+	if total := TotalBandwidth(consensus); total != 100 {
+		t.Errorf("Total bandwidth is %d, but expected 100.", total)
+	}
+
+	tests := []struct {
+		fraction float64
+		expected []tor.Fingerprint
+	}{
+		{0.4, nil},
+		{0.5, []tor.Fingerprint{"A"}},
+		{0.85, []tor.Fingerprint{"A", "B"}},
+		{1, []tor.Fingerprint{"A", "B", "C"}},
+	}
+
+	for _, test := range tests {
+		relays, err := DetermineRelays(consensus, test.fraction)
+		if err != nil {
+			t.Errorf("Fraction %f: %s", test.fraction, err)
+			continue
+		}
+
+		var fingerprints []tor.Fingerprint
+		for _, relay := range relays {
+			fingerprints = append(fingerprints, relay.Fingerprint)
+		}
+		if !reflect.DeepEqual(fingerprints, test.expected) {
+			t.Errorf("Fraction %f: relays are %v, but expected %v.", test.fraction, fingerprints, test.expected)
+		}
+	}
+}
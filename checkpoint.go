@@ -0,0 +1,159 @@
+// Save and restore the state of analyses, so they can be resumed later.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointFile is the content of a checkpoint file.  ValidAfter is the
+// valid-after time of the most recent consensus that the analysis processed.
+// State is the analysis-specific state.
+type checkpointFile struct {
+	Analysis   string          `json:"analysis"`
+	ValidAfter time.Time       `json:"valid_after"`
+	State      json.RawMessage `json:"state"`
+}
+
+// checkpointPath returns the path of the checkpoint file of the given analysis
+// in the output directory.
+func checkpointPath(analysis string) (string, error) {
+
+	directory, err := getOutputDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, analysis+".checkpoint"), nil
+}
+
+// readCheckpoint reads the checkpoint file of the given analysis.  If there is
+// no checkpoint file, nil is returned.
+func readCheckpoint(analysis string) (*checkpointFile, error) {
+
+	path, err := checkpointPath(analysis)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &checkpointFile{}
+	if err := json.Unmarshal(content, checkpoint); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if checkpoint.Analysis != analysis {
+		return nil, fmt.Errorf("%s: checkpoint belongs to analysis \"%s\"", path, checkpoint.Analysis)
+	}
+
+	return checkpoint, nil
+}
+
+// loadCheckpoint decodes the checkpointed state of the given analysis into the
+// given state, and returns the valid-after time of the most recent consensus
+// the analysis processed.  If there is no checkpoint, the zero time is
+// returned and the state remains untouched.
+func loadCheckpoint(analysis string, state interface{}) (time.Time, error) {
+
+	checkpoint, err := readCheckpoint(analysis)
+	if err != nil || checkpoint == nil {
+		return time.Time{}, err
+	}
+
+	if err := json.Unmarshal(checkpoint.State, state); err != nil {
+		return time.Time{}, fmt.Errorf("Couldn't decode checkpoint of %s: %s", analysis, err)
+	}
+	log.Printf("Resuming %s analysis after %s.\n", analysis, checkpoint.ValidAfter.Format(time.RFC3339))
+
+	return checkpoint.ValidAfter, nil
+}
+
+// saveCheckpoint writes the given state of the given analysis to its
+// checkpoint file.  validAfter is the valid-after time of the most recent
+// consensus the analysis processed.  The file is replaced atomically, so an
+// interrupted write doesn't destroy the previous checkpoint.
+func saveCheckpoint(analysis string, validAfter time.Time, state interface{}) error {
+
+	path, err := checkpointPath(analysis)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&checkpointFile{analysis, validAfter, encoded})
+	if err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"_")
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(content); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	if err := os.Rename(fd.Name(), path); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	log.Printf("Wrote checkpoint of %s analysis to \"%s\".\n", analysis, path)
+
+	return nil
+}
+
+// resumeStartDate moves the start date past the checkpoints of all analyses,
+// so we don't parse data that was already analysed.  That's only possible if
+// all analyses can be resumed and have a checkpoint.  Otherwise, the analyses
+// skip the data they already processed themselves.
+func resumeStartDate(params *CmdLineParams) error {
+
+	var earliest time.Time
+
+	for _, analysis := range params.Callbacks {
+		if !analysis.Resumable {
+			log.Printf("Analysis \"%s\" cannot be resumed, so we have to parse all data.\n", analysis.Name)
+			return nil
+		}
+
+		checkpoint, err := readCheckpoint(analysis.Name)
+		if err != nil {
+			return err
+		}
+		if checkpoint == nil {
+			log.Printf("No checkpoint for analysis \"%s\", so we have to parse all data.\n", analysis.Name)
+			return nil
+		}
+
+		if earliest.IsZero() || checkpoint.ValidAfter.Before(earliest) {
+			earliest = checkpoint.ValidAfter
+		}
+	}
+
+	startDate := earliest.Add(time.Nanosecond)
+	if startDate.After(params.StartDate) {
+		log.Printf("Skipping data up to %s, which was already analysed.\n", earliest.Format(time.RFC3339))
+		params.StartDate = startDate
+	}
+
+	return nil
+}
@@ -2,13 +2,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"math"
-	"reflect"
-	"sync"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/NullHypothesis/sybilhunter/churn"
+	"github.com/NullHypothesis/sybilhunter/microdesc"
 	tor "github.com/NullHypothesis/zoossh"
 )
 
@@ -17,78 +20,108 @@ const (
 	Disappeared = false
 )
 
-// RelayFlags holds the relay flags that will be analysed.
-var RelayFlags = []string{
-	"Authority",
-	"BadExit",
-	"Exit",
-	"Fast",
-	"Guard",
-	"HSDir",
-	"Named",
-	"Running",
-	"Stable",
-	"Unnamed",
-	"V2Dir",
-	"Valid"}
-
-// Churn holds two churn values, for relays that went online and relays that
-// went offline.
-type Churn struct {
-	Online  float64
-	Offline float64
-}
+// Gap policies determine what the churn analysis does if consensuses are
+// missing.
+const (
+	// gapNormalise compares the consensuses on both sides of the gap, and
+	// divides the churn by the number of consensus intervals in between.
+	gapNormalise = "normalise"
+	// gapReset empties the moving average windows, so they don't mix values
+	// from before and after the gap.
+	gapReset = "reset"
+	// gapSkip doesn't compare across the gap, and keeps the moving average
+	// windows.
+	gapSkip = "skip"
+)
 
-// PerFlagMovAvg maps a relay flag, e.g., "Guard", to a moving average struct.
-type PerFlagMovAvg map[string]*MovingAverage
+// Detectors determine which churn is suspicious, so that the relays that
+// caused it are dumped, and alerts are sent.
+const (
+	// thresholdDetector considers churn suspicious once it reaches the
+	// threshold.
+	thresholdDetector = "threshold"
+	// robustDetector considers churn suspicious if its robust z-score,
+	// compared to the recent churn of the same flag, is too high.
+	robustDetector = "robust"
+)
 
-// MovingAverage represents a simple moving average.
-type MovingAverage struct {
-	WindowIndex int
-	WindowSize  int
-	WindowFill  int
-	Window      []Churn
-}
+// consensusInterval returns the time between the given consensus and the
+// next one.  Unless the interval is given on the command line, it's the time
+// for which the consensus is fresh, e.g., an hour on the public network.
+func consensusInterval(consensus *tor.Consensus, params *CmdLineParams) time.Duration {
+
+	if params.ChurnInterval > 0 {
+		return params.ChurnInterval
+	}
 
-// NewMovingAverage allocates and returns a new moving average struct.
-func NewMovingAverage(windowSize int) *MovingAverage {
+	if interval := consensus.FreshUntil.Sub(consensus.ValidAfter); interval > 0 {
+		return interval
+	}
 
-	return &MovingAverage{WindowIndex: 0, WindowSize: windowSize, Window: make([]Churn, windowSize)}
+	return time.Hour
 }
 
-// CalcAvg determines and returns the mean of the moving average window.
-func (ma *MovingAverage) CalcAvg() Churn {
-
-	var total Churn
-	for i := 0; i < ma.WindowSize; i++ {
-		total.Online += ma.Window[i].Online
-		total.Offline += ma.Window[i].Offline
+// printChurnGap writes rows of NA values for the given number of missing
+// consensuses after the given time to the given sink, so the CSV output has a
+// row for every consensus interval.  The given relay flags are analysed.  In
+// JSON format, a single record describes the gap.
+func printChurnGap(prevValidAfter time.Time, interval time.Duration, missing int, flags []string, params *CmdLineParams, sink Sink) {
+
+	if params.Format == jsonFormat {
+		record := NewRecord("churn", "churn_gap", prevValidAfter.Add(interval))
+		record.Data["missing"] = missing
+		record.Data["interval"] = interval.String()
+		record.Data["policy"] = params.GapPolicy
+		sink.Emit(record)
+		return
 	}
-	total.Online /= float64(ma.WindowSize)
-	total.Offline /= float64(ma.WindowSize)
 
-	return total
-}
+	values := len(churnColumns(flags, params))
+	for i := 1; i <= missing; i++ {
+		date := prevValidAfter.Add(time.Duration(i) * interval).Format("2006-01-02T15:04:05Z")
 
-// AddValue adds a churn value to the moving average window.
-func (ma *MovingAverage) AddValue(val Churn) {
+		if params.CSVFormat == longCSVFormat {
+			for _, flag := range flags {
+				fmt.Fprint(sink, date)
+				for _, noFlag := range flags {
+					if noFlag != flag {
+						fmt.Fprint(sink, ",NA")
+					} else {
+						fmt.Fprint(sink, ",T")
+					}
+				}
+				fmt.Fprint(sink, strings.Repeat(",NA", values-len(flags)))
+				fmt.Fprintln(sink)
+			}
+			continue
+		}
 
-	if ma.WindowFill < ma.WindowSize {
-		ma.WindowFill++
+		fmt.Fprint(sink, date)
+		fmt.Fprint(sink, strings.Repeat(",NA", values))
+		fmt.Fprintln(sink)
 	}
-	ma.Window[ma.WindowIndex].Online = val.Online
-	ma.Window[ma.WindowIndex].Offline = val.Offline
-	ma.WindowIndex = (ma.WindowIndex + 1) % ma.WindowSize
 }
 
-// IsWindowFull returns true if the moving average's window is full.
-func (ma *MovingAverage) IsWindowFull() bool {
+// printChurnHeader prints the CSV header for the given relay flags, either in
+// long or wide format.
+func printChurnHeader(flags []string, params *CmdLineParams, sink Sink) {
 
-	return ma.WindowFill == ma.WindowSize
+	fmt.Fprint(sink, "Date")
+	for _, column := range churnColumns(flags, params) {
+		fmt.Fprintf(sink, ",%s", column)
+	}
+	fmt.Fprintln(sink)
 }
 
-// dumpChurnRelays dumps the given relays to stderr for manual analysis.
-func dumpChurnRelays(relays *tor.Consensus, prefix string, date time.Time) {
+// dumpChurnRelays dumps the given relays to stderr for manual analysis.  The
+// relays have the given flag, and either appeared or disappeared.  In JSON
+// format, every relay is also emitted as a record.
+func dumpChurnRelays(relays *tor.Consensus, flag string, appeared bool, date time.Time, params *CmdLineParams, sink Sink) {
+
+	prefix, change := "-"+flag, "gone"
+	if appeared == Appeared {
+		prefix, change = "+"+flag, "new"
+	}
 
 	// Sort relays by nickname.
 	nickname := func(relay1, relay2 tor.GetStatus) bool {
@@ -102,158 +135,462 @@ func dumpChurnRelays(relays *tor.Consensus, prefix string, date time.Time) {
 		status := getStatus()
 		log.Printf("%s <https://atlas.torproject.org/#details/%s> %s\n",
 			prefix, status.Fingerprint, status.Nickname)
+
+		if params.Format == jsonFormat {
+			record := NewRecord("churn", "churn_relay", date, status.Fingerprint)
+			record.Data["flag"] = flag
+			record.Data["change"] = change
+			record.Data["nickname"] = status.Nickname
+			sink.Emit(record)
+		}
 	}
 }
 
-// determineChurn determines and returns the churn rate of the two given
-// subsequent consensuses.  For the churn rate, we adapt the formula shown in
-// Section 2.1 of: <http://www.cs.berkeley.edu/~istoica/papers/2006/churn.pdf>.
-func determineChurn(prevConsensus, newConsensus *tor.Consensus) Churn {
+// alertChurnRelays sends an alert about the given relays, which have the given
+// flag's churn, and either appeared or disappeared.  The alert explains why the
+// churn is suspicious: it either reached the threshold, or it's anomalous.
+func alertChurnRelays(ctx context.Context, relays *tor.Consensus, flagChurn churn.FlagChurn, appeared bool, date time.Time, params *CmdLineParams) {
+
+	if params.Alerter == nil || relays.Length() == 0 {
+		return
+	}
+
+	flag := flagChurn.Flag
+	change, verb := "gone", "disappeared"
+	rate := flagChurn.Churn.Offline
+	if appeared == Appeared {
+		change, verb = "new", "appeared"
+		rate = flagChurn.Churn.Online
+	}
+
+	var fingerprints []tor.Fingerprint
+	for fingerprint, _ := range relays.RouterStatuses {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return fingerprints[i] < fingerprints[j]
+	})
+
+	record := NewRecord("churn", "churn_alert", date, fingerprints...)
+	record.Data["flag"] = flag
+	record.Data["change"] = change
+	record.Data["churn"] = rate
+
+	reason := fmt.Sprintf("churn %.5f >= %.5f", rate, flagChurn.Threshold)
+	if anomaly := flagChurn.Anomaly; anomaly != nil {
+		score, confidence := anomaly.OfflineScore, anomaly.OfflineConfidence
+		if appeared == Appeared {
+			score, confidence = anomaly.OnlineScore, anomaly.OnlineConfidence
+		}
+		record.Data["score"] = score
+		record.Data["confidence"] = confidence
+		reason = fmt.Sprintf("churn %.5f, anomaly score %.2f, confidence %.5f", rate, score, confidence)
+	} else {
+		record.Data["threshold"] = flagChurn.Threshold
+	}
+
+	summary := fmt.Sprintf("%d relays with the %s flag %s at %s (%s).",
+		len(fingerprints), flag, verb, date.Format(time.RFC3339), reason)
+	key := fmt.Sprintf("churn/%s/%s", flag, change)
+	params.Alerter.Alert(ctx, NewAlert(record, key, summary))
+}
 
-	goneRelays := prevConsensus.Subtract(newConsensus)
-	newRelays := newConsensus.Subtract(prevConsensus)
+// weightedChurnColumns returns the names of the CSV columns that hold
+// weighted churn.  In wide format, there are columns for every given relay
+// flag.
+func weightedChurnColumns(flags []string, csvFormat string) []string {
 
-	max := math.Max(float64(prevConsensus.Length()), float64(newConsensus.Length()))
-	newChurn := (float64(newRelays.Length()) / max)
-	goneChurn := (float64(goneRelays.Length()) / max)
+	var columns []string
+	for _, weight := range []string{"Bw", "GuardPos", "ExitPos"} {
+		if csvFormat == longCSVFormat {
+			columns = append(columns, "New"+weight+"Churn", "Gone"+weight+"Churn")
+			continue
+		}
+		for _, flag := range flags {
+			columns = append(columns, "New"+weight+flag, "Gone"+weight+flag)
+		}
+	}
 
-	return Churn{newChurn, goneChurn}
+	return columns
 }
 
-// FilterConsensusByFlag filters the given consensus so that only relays with
-// the given flag remain.  The resulting consensus is returned.
-func FilterConsensusByFlag(consensus *tor.Consensus, flag string) *tor.Consensus {
+// anomalyColumns returns the names of the CSV columns that hold anomaly
+// scores and their confidence.  In wide format, there are columns for every
+// given relay flag.
+func anomalyColumns(flags []string, csvFormat string) []string {
 
-	filteredConsensus := tor.NewConsensus()
+	var columns []string
+	for _, value := range []string{"Score", "Confidence"} {
+		if csvFormat == longCSVFormat {
+			columns = append(columns, "New"+value, "Gone"+value)
+			continue
+		}
+		for _, flag := range flags {
+			columns = append(columns, "New"+value+flag, "Gone"+value+flag)
+		}
+	}
 
-	for fingerprint, getStatus := range consensus.RouterStatuses {
-		status := getStatus()
+	return columns
+}
+
+// churnColumns returns the names of all CSV columns that follow the date, for
+// the given relay flags.  Anomaly scores are only part of the output if the
+// robust detector is used.
+func churnColumns(flags []string, params *CmdLineParams) []string {
 
-		s := reflect.ValueOf(&status.Flags).Elem()
-		flagSet := s.FieldByName(flag).Interface()
-		// Check if relay has the flag we are looking for.
-		if flagSet == true {
-			filteredConsensus.Set(fingerprint, status)
+	var columns []string
+	for _, flag := range flags {
+		if params.CSVFormat == longCSVFormat {
+			columns = append(columns, flag)
+		} else {
+			columns = append(columns, "New"+flag, "Gone"+flag)
 		}
 	}
+	if params.CSVFormat == longCSVFormat {
+		columns = append(columns, "NewChurn", "GoneChurn")
+	}
+	columns = append(columns, weightedChurnColumns(flags, params.CSVFormat)...)
+	columns = append(columns, "GapValues")
+	if params.Detector == robustDetector {
+		columns = append(columns, anomalyColumns(flags, params.CSVFormat)...)
+	}
 
-	return filteredConsensus
+	return columns
 }
 
-// DeterminePerFlagChurn determines the churn rate between two subsequent
-// consensuses for all relays with a given flag.  For example, for all relays
-// with the "Guard" flag, we get a churn value for relays that went online and a
-// churn value for relays that went offline.  A set of relays is dumped to
-// stderr once a churn value exceeds the given threshold.
-func DeterminePerFlagChurn(prevConsensus, newConsensus *tor.Consensus, movAvg PerFlagMovAvg, params *CmdLineParams) {
+// anomalyValues formats the given anomaly scores and their confidence as CSV
+// values.  Without anomaly scores, the values are NA.
+func anomalyValues(anomaly *churn.Anomaly) (scores, confidences string) {
+
+	if anomaly == nil {
+		return ",NA,NA", ",NA,NA"
+	}
+
+	return fmt.Sprintf(",%.3f,%.3f", anomaly.OnlineScore, anomaly.OfflineScore),
+		fmt.Sprintf(",%.5f,%.5f", anomaly.OnlineConfidence, anomaly.OfflineConfidence)
+}
 
-	var line string
+// printChurn writes the given per-flag churn rates of the given consensus to
+// the given sink.  The given relay flags are analysed.  A set of relays is
+// dumped to stderr, and an alert is sent, once a churn value is suspicious.
+func printChurn(ctx context.Context, newConsensus *tor.Consensus, flags []string, flagChurns []churn.FlagChurn, params *CmdLineParams, sink Sink) {
 
-	for _, flag := range RelayFlags {
+	robust := params.Detector == robustDetector
+	byFlag := make(map[string]churn.FlagChurn)
 
-		prevFiltered := FilterConsensusByFlag(prevConsensus, flag)
-		newFiltered := FilterConsensusByFlag(newConsensus, flag)
-		churn := determineChurn(prevFiltered, newFiltered)
+	for _, flagChurn := range flagChurns {
 
-		// Determine moving average for captured churn values.
-		movAvg[flag].AddValue(churn)
-		churn = movAvg[flag].CalcAvg()
-		if !movAvg[flag].IsWindowFull() {
-			continue
-		}
+		flag, rate := flagChurn.Flag, flagChurn.Churn
 
-		if churn.Online >= params.Threshold {
-			dumpChurnRelays(newFiltered.Subtract(prevFiltered), "+"+flag, newConsensus.ValidAfter)
+		if flagChurn.Appeared != nil {
+			dumpChurnRelays(flagChurn.Appeared, flag, Appeared, newConsensus.ValidAfter, params, sink)
+			alertChurnRelays(ctx, flagChurn.Appeared, flagChurn, Appeared, newConsensus.ValidAfter, params)
 		}
-		if churn.Offline >= params.Threshold {
-			dumpChurnRelays(prevFiltered.Subtract(newFiltered), "-"+flag, newConsensus.ValidAfter)
+		if flagChurn.Disappeared != nil {
+			dumpChurnRelays(flagChurn.Disappeared, flag, Disappeared, newConsensus.ValidAfter, params, sink)
+			alertChurnRelays(ctx, flagChurn.Disappeared, flagChurn, Disappeared, newConsensus.ValidAfter, params)
 		}
 
-		if params.CSVFormat == longCSVFormat {
-			fmt.Printf("%s", newConsensus.ValidAfter.Format("2006-01-02T15:04:05Z"))
-			for _, noFlag := range RelayFlags {
+		if params.Format == jsonFormat {
+			record := NewRecord("churn", "churn_rate", newConsensus.ValidAfter)
+			record.Data["flag"] = flag
+			record.Data["new_churn"] = rate.Online
+			record.Data["gone_churn"] = rate.Offline
+			record.Data["new_bw_churn"] = rate.BwOnline
+			record.Data["gone_bw_churn"] = rate.BwOffline
+			record.Data["new_guard_pos_churn"] = rate.GuardPosOnline
+			record.Data["gone_guard_pos_churn"] = rate.GuardPosOffline
+			record.Data["new_exit_pos_churn"] = rate.ExitPosOnline
+			record.Data["gone_exit_pos_churn"] = rate.ExitPosOffline
+			record.Data["gap_values"] = flagChurn.GapValues
+			if anomaly := flagChurn.Anomaly; anomaly != nil {
+				record.Data["new_score"] = anomaly.OnlineScore
+				record.Data["gone_score"] = anomaly.OfflineScore
+				record.Data["new_confidence"] = anomaly.OnlineConfidence
+				record.Data["gone_confidence"] = anomaly.OfflineConfidence
+			}
+			sink.Emit(record)
+		} else if params.CSVFormat == longCSVFormat {
+			fmt.Fprintf(sink, "%s", newConsensus.ValidAfter.Format("2006-01-02T15:04:05Z"))
+			for _, noFlag := range flags {
 				if noFlag != flag {
-					fmt.Printf(",NA")
+					fmt.Fprintf(sink, ",NA")
 				} else {
-					fmt.Printf(",T")
+					fmt.Fprintf(sink, ",T")
 				}
 			}
-			fmt.Printf(",%.5f,%.5f\n", churn.Online, churn.Offline)
-		} else {
-			if line == "" {
-				line += fmt.Sprintf("%s", newConsensus.ValidAfter.Format("2006-01-02T15:04:05Z"))
+			fmt.Fprintf(sink, ",%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%.5f,%d",
+				rate.Online, rate.Offline,
+				rate.BwOnline, rate.BwOffline,
+				rate.GuardPosOnline, rate.GuardPosOffline,
+				rate.ExitPosOnline, rate.ExitPosOffline,
+				flagChurn.GapValues)
+			if robust {
+				scores, confidences := anomalyValues(flagChurn.Anomaly)
+				fmt.Fprint(sink, scores+confidences)
 			}
-			line += fmt.Sprintf(",%.5f,%.5f", churn.Online, churn.Offline)
+			fmt.Fprintln(sink)
+		} else {
+			byFlag[flag] = flagChurn
+		}
+	}
+
+	if len(byFlag) == 0 {
+		return
+	}
+
+	// In wide format, weighted churn follows the churn of relay counts, so
+	// the columns of older versions keep their position.  Flags whose moving
+	// average window isn't full yet have NA values.
+	line := newConsensus.ValidAfter.Format("2006-01-02T15:04:05Z")
+	var bwLine, guardPosLine, exitPosLine string
+	var scoreLine, confidenceLine string
+	gapValues := 0
+	for _, flag := range flags {
+		flagChurn, ok := byFlag[flag]
+		if !ok {
+			line += ",NA,NA"
+			bwLine += ",NA,NA"
+			guardPosLine += ",NA,NA"
+			exitPosLine += ",NA,NA"
+			scoreLine += ",NA,NA"
+			confidenceLine += ",NA,NA"
+			continue
+		}
+
+		rate := flagChurn.Churn
+		line += fmt.Sprintf(",%.5f,%.5f", rate.Online, rate.Offline)
+		bwLine += fmt.Sprintf(",%.5f,%.5f", rate.BwOnline, rate.BwOffline)
+		guardPosLine += fmt.Sprintf(",%.5f,%.5f", rate.GuardPosOnline, rate.GuardPosOffline)
+		exitPosLine += fmt.Sprintf(",%.5f,%.5f", rate.ExitPosOnline, rate.ExitPosOffline)
+		scores, confidences := anomalyValues(flagChurn.Anomaly)
+		scoreLine += scores
+		confidenceLine += confidences
+		// Flags can have windows of different sizes, so we report the
+		// most gap values of any window.
+		if flagChurn.GapValues > gapValues {
+			gapValues = flagChurn.GapValues
 		}
 	}
 
-	if line != "" {
-		fmt.Println(line)
+	fmt.Fprintf(sink, "%s%s%s%s,%d", line, bwLine, guardPosLine, exitPosLine, gapValues)
+	if robust {
+		fmt.Fprint(sink, scoreLine+confidenceLine)
 	}
+	fmt.Fprintln(sink)
 }
 
-// AnalyseChurn determines the churn rates of a set of consecutive consensuses.
-// If the churn rate exceeds the given threshold, all new and disappeared
-// relays are dumped to stderr.
-func AnalyseChurn(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
+// discoverFlags returns the given analysed relay flags, followed by the flags
+// in the given "known-flags" line that aren't analysed yet.  Once the CSV
+// header is printed, the columns are fixed, so new flags are only logged, once
+// each, and the given flags are returned unchanged.
+func discoverFlags(flags, known []string, reported map[string]bool, validAfter time.Time, fixed bool) []string {
+
+	analysed := make(map[string]bool)
+	for _, flag := range flags {
+		analysed[flag] = true
+	}
+
+	for _, flag := range known {
+		if analysed[flag] || reported[flag] {
+			continue
+		}
+
+		if !fixed {
+			log.Printf("Consensus valid after %s knows the flag %s, which is now analysed.\n",
+				validAfter.Format(time.RFC3339), flag)
+			flags = append(flags, flag)
+			continue
+		}
+
+		log.Printf("Consensus valid after %s knows the flag %s, which isn't analysed.  Add it to the \"flags\" section of -churnconfig to analyse it.\n",
+			validAfter.Format(time.RFC3339), flag)
+		reported[flag] = true
+	}
+
+	return flags
+}
 
-	defer group.Done()
+// AnalyseChurn determines the churn rates of a set of consecutive consensuses.
+// If the churn rate is suspicious, all new and disappeared relays are dumped
+// to stderr.  Churn is suspicious if it reaches the relay flag's threshold or,
+// with the robust detector, if it's anomalous.  The thresholds and window
+// sizes of relay flags default to the given ones, and the configuration file
+// can set them per flag.
+func AnalyseChurn(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
 	var newConsensus, prevConsensus *tor.Consensus
+	var newWeights, prevWeights microdesc.BandwidthWeights
+	var newFlags, prevFlags *microdesc.Flags
+	var newIndex, prevIndex *churn.Index
 
 	if params.WindowSize <= 0 {
 		log.Printf("Window size set to %d, but cannot be smaller than 1.  Setting it to 1.", params.WindowSize)
 		params.WindowSize = 1
 	}
 
-	log.Printf("Threshold for churn analysis is %.5f.\n", params.Threshold)
-
-	// Print CSV header, either in long or wide format.
-	fmt.Print("Date")
-	for _, flag := range RelayFlags {
-		if params.CSVFormat == longCSVFormat {
-			fmt.Printf(",%s", flag)
-		} else {
-			fmt.Printf(",New%s,Gone%s", flag, flag)
+	defaults := churn.FlagConfig{Threshold: params.Threshold, WindowSize: params.WindowSize}
+	config := churn.NewConfig()
+	config.Default = defaults
+	if params.ChurnConfig != "" {
+		var err error
+		if config, err = churn.LoadConfig(params.ChurnConfig, defaults); err != nil {
+			return err
 		}
 	}
-	if params.CSVFormat == longCSVFormat {
-		fmt.Print(",NewChurn,GoneChurn")
+	flags := config.Flags()
+
+	var detector *churn.Detector
+	if params.Detector == robustDetector {
+		detector = churn.NewDetector(config)
+		log.Println("Churn analysis detects anomalies per relay flag.")
+	} else {
+		log.Printf("Threshold for churn analysis is %.5f.\n", params.Threshold)
+	}
+
+	// The CSV header is printed once the first consensus tells us which
+	// flags it knows, so its columns cover them.  JSON output has no header,
+	// so its flags are never fixed.
+	var headerPrinted bool
+	printHeader := func() {
+		if !headerPrinted && params.Format != jsonFormat {
+			printChurnHeader(flags, params, sink)
+			headerPrinted = true
+		}
 	}
-	fmt.Println()
 
-	movAvg := make(PerFlagMovAvg)
-	for _, flag := range RelayFlags {
-		movAvg[flag] = NewMovingAverage(params.WindowSize)
+	movAvg := churn.NewConfiguredMovAvg(flags, config)
+
+	// Every consensus is indexed once, and compared to both its predecessor
+	// and its successor.
+	indexer := churn.NewIndexer()
+
+	// Continue where the last run stopped.
+	var resumeAfter time.Time
+	if params.Resume {
+		checkpoint := &churn.Checkpoint{}
+		var err error
+		if resumeAfter, err = loadCheckpoint("churn", checkpoint); err != nil {
+			return err
+		}
+		if !resumeAfter.IsZero() {
+			for flag, avg := range checkpoint.MovAvg {
+				if windowSize := config.Flag(flag).WindowSize; avg.WindowSize != windowSize {
+					return fmt.Errorf("Checkpoint was made with a window size of %d for %s, but window size is %d.", avg.WindowSize, flag, windowSize)
+				}
+				movAvg[flag] = avg
+			}
+			prevConsensus = checkpoint.Consensus()
+			prevWeights = checkpoint.Weights
+			prevFlags = checkpoint.Flags()
+			prevIndex = indexer.Index(prevConsensus, prevWeights, prevFlags)
+			if detector != nil && checkpoint.AnomalyHistory != nil {
+				detector.History = checkpoint.AnomalyHistory
+			}
+		}
 	}
 
 	// Every loop iteration processes one consensus.  We compare consensus t
 	// to consensus t - 1.
+	reported := make(map[string]bool)
 	for objects := range channel {
 
-		switch obj := objects.(type) {
-		case *tor.Consensus:
-			newConsensus = obj
-		default:
-			log.Fatalln("Only router status files are supported for churn analysis.")
+		if _, ok := objects.(*microdesc.Microdescriptors); ok {
+			continue
+		}
+		consensus, ok := microdesc.ConsensusOf(objects)
+		if !ok {
+			return errors.New("Only router status files are supported for churn analysis.")
+		}
+		newConsensus, newWeights = consensus, microdesc.WeightsOf(objects)
+		newFlags = microdesc.FlagsOf(objects)
+
+		// Skip consensuses that we already processed in a previous run.
+		if !newConsensus.ValidAfter.After(resumeAfter) {
+			continue
+		}
+
+		if newFlags != nil && len(config.FlagSet) == 0 {
+			flags = discoverFlags(flags, newFlags.Known, reported, newConsensus.ValidAfter, headerPrinted)
+		}
+		printHeader()
+
+		// Duplicate and out-of-order consensuses would yield bogus churn,
+		// so we ignore them and keep comparing to the previous consensus.
+		if prevConsensus != nil && !newConsensus.ValidAfter.After(prevConsensus.ValidAfter) {
+			log.Printf("Ignoring consensus valid after %s because it doesn't follow the consensus valid after %s.\n",
+				newConsensus.ValidAfter.Format(time.RFC3339),
+				prevConsensus.ValidAfter.Format(time.RFC3339))
+			continue
 		}
 
+		newIndex = indexer.Index(newConsensus, newWeights, newFlags)
+
 		if prevConsensus == nil {
-			prevConsensus = newConsensus
+			prevConsensus, prevWeights, prevFlags = newConsensus, newWeights, newFlags
+			prevIndex = newIndex
 			continue
 		}
 
-		// Are we missing consensuses?
-		if prevConsensus.ValidAfter.Add(time.Hour) != newConsensus.ValidAfter {
-			log.Printf("Missing consensuses between %s and %s.\n",
+		// Are we missing consensuses?  Consensuses that don't align
+		// with the interval are rounded to the nearest interval, but
+		// a consensus that follows its predecessor is at least one
+		// interval later.
+		interval := consensusInterval(newConsensus, params)
+		elapsed := newConsensus.ValidAfter.Sub(prevConsensus.ValidAfter)
+		intervals := int((elapsed + interval/2) / interval)
+		if intervals < 1 {
+			intervals = 1
+		}
+		if intervals > 1 {
+			log.Printf("Missing %d consensuses between %s and %s.\n", intervals-1,
 				prevConsensus.ValidAfter.Format(time.RFC3339),
 				newConsensus.ValidAfter.Format(time.RFC3339))
-			prevConsensus = newConsensus
-			continue
+			printChurnGap(prevConsensus.ValidAfter, interval, intervals-1, flags, params, sink)
+
+			switch params.GapPolicy {
+			case gapReset:
+				movAvg.Reset()
+				fallthrough
+			case gapSkip:
+				prevConsensus, prevWeights, prevFlags = newConsensus, newWeights, newFlags
+				prevIndex = newIndex
+				continue
+			}
 		}
 
-		DeterminePerFlagChurn(prevConsensus, newConsensus, movAvg, params)
+		comparison := &churn.Comparison{
+			Prev:        prevConsensus,
+			New:         newConsensus,
+			PrevWeights: prevWeights,
+			NewWeights:  newWeights,
+			PrevFlags:   prevFlags,
+			NewFlags:    newFlags,
+			PrevIndex:   prevIndex,
+			NewIndex:    newIndex,
+			Intervals:   intervals,
+			Flags:       flags,
+			Config:      config,
+			Detector:    detector,
+		}
+		flagChurns := comparison.PerFlag(movAvg, params.Threshold)
+		printChurn(ctx, newConsensus, flags, flagChurns, params, sink)
 
-		prevConsensus = newConsensus
+		prevConsensus, prevWeights, prevFlags = newConsensus, newWeights, newFlags
+		prevIndex = newIndex
 	}
+	// Without new consensuses, the header only covers the configured flags.
+	printHeader()
+
+	if prevConsensus != nil && params.OutputDir != "" {
+		checkpoint := churn.NewCheckpoint(prevConsensus, prevWeights, prevFlags, movAvg)
+		if detector != nil {
+			checkpoint.AnomalyHistory = detector.History
+		}
+		if err := saveCheckpoint("churn", prevConsensus.ValidAfter, checkpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
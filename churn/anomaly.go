@@ -0,0 +1,206 @@
+// Detect anomalous churn by comparing churn values to their recent history.
+
+package churn
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Observation is a churn value that was observed at a given time.
+type Observation struct {
+	Time  time.Time
+	Churn Churn
+}
+
+// Anomaly holds the anomaly scores of the churn of relays that went online and
+// relays that went offline.  A score is a robust z-score, i.e., the number of
+// (scaled) median absolute deviations by which churn exceeds its median.  The
+// confidence is the probability of a standard normal distribution to stay
+// below the score.  Online and Offline are true if the respective score
+// reaches the detector's threshold.
+type Anomaly struct {
+	OnlineScore       float64
+	OfflineScore      float64
+	OnlineConfidence  float64
+	OfflineConfidence float64
+	Online            bool
+	Offline           bool
+}
+
+// Detector detects anomalous churn for every relay flag.  Unlike a fixed
+// threshold, it adapts to the churn that is normal for a flag, so it's neither
+// too noisy for flags with a lot of churn, e.g., Running, nor too insensitive
+// for flags with little churn, e.g., Guard.  History holds the recent churn
+// values of every flag, and can be serialised to resume detection later.
+type Detector struct {
+	History map[string][]Observation
+	config  *Config
+}
+
+// NewDetector returns a detector that is configured by the given
+// configuration.  If the configuration is nil, the default configuration is
+// used.
+func NewDetector(config *Config) *Detector {
+
+	if config == nil {
+		config = NewConfig()
+	}
+
+	return &Detector{History: make(map[string][]Observation), config: config}
+}
+
+// median returns the median of the given values, which are sorted in place.
+func median(values []float64) float64 {
+
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// spread returns the median and the scaled median absolute deviation of the
+// given values.  The scaled deviation estimates the standard deviation of
+// normally distributed values.  If more than half of the values are
+// identical, the median absolute deviation is zero, so we fall back to the
+// scaled mean absolute deviation.
+func spread(values []float64) (float64, float64) {
+
+	med := median(values)
+
+	deviations := make([]float64, len(values))
+	var total float64
+	for i, value := range values {
+		deviations[i] = math.Abs(value - med)
+		total += deviations[i]
+	}
+
+	if mad := median(deviations); mad > 0 {
+		return med, 1.4826 * mad
+	}
+
+	return med, 1.2533 * total / float64(len(values))
+}
+
+// phase returns the position of the given time within a season of the given
+// length, e.g., the hour of the day for a season of 24 hours.
+func phase(t time.Time, season time.Duration) time.Duration {
+
+	return time.Duration(t.UnixNano()) % season
+}
+
+// seasonalBaseline returns, for the given time and every observation in the
+// given history, the median churn of the observations with the same phase
+// within the season.  The given function selects the churn value.
+func seasonalBaseline(t time.Time, history []Observation, season time.Duration, value func(Churn) float64) (float64, []float64) {
+
+	byPhase := make(map[time.Duration][]float64)
+	for _, observation := range history {
+		p := phase(observation.Time, season)
+		byPhase[p] = append(byPhase[p], value(observation.Churn))
+	}
+
+	medians := make(map[time.Duration]float64)
+	for p, values := range byPhase {
+		medians[p] = median(values)
+	}
+
+	baselines := make([]float64, len(history))
+	for i, observation := range history {
+		baselines[i] = medians[phase(observation.Time, season)]
+	}
+
+	// Without past observations in the same phase, there is no seasonal
+	// baseline for the given time.
+	if current, ok := medians[phase(t, season)]; ok {
+		return current, baselines
+	}
+
+	return 0, nil
+}
+
+// score determines the anomaly score of the given churn value, observed at
+// the given time, compared to the given history.  The given function selects
+// the churn value of past observations.
+func score(t time.Time, current float64, history []Observation, config AnomalyConfig, value func(Churn) float64) float64 {
+
+	// If the churn is seasonal, we compare the residuals, i.e., the churn
+	// minus the median churn at the same time of the season.
+	residuals := make([]float64, len(history))
+	if config.SeasonHours > 0 {
+		season := time.Duration(config.SeasonHours) * time.Hour
+		baseline, baselines := seasonalBaseline(t, history, season, value)
+		if baselines != nil {
+			current -= baseline
+			for i, observation := range history {
+				residuals[i] = value(observation.Churn) - baselines[i]
+			}
+			return robustScore(current, residuals, config)
+		}
+	}
+
+	for i, observation := range history {
+		residuals[i] = value(observation.Churn)
+	}
+
+	return robustScore(current, residuals, config)
+}
+
+// robustScore returns the robust z-score of the given value compared to the
+// given past values.  Deviations are at least the configured minimal spread,
+// so tiny fluctuations of otherwise constant churn aren't anomalous.
+func robustScore(current float64, past []float64, config AnomalyConfig) float64 {
+
+	med, deviation := spread(past)
+	if deviation < config.MinSpread {
+		deviation = config.MinSpread
+	}
+	if deviation == 0 {
+		return 0
+	}
+
+	return (current - med) / deviation
+}
+
+// confidence returns the probability of a standard normal distribution to
+// stay below the given score.
+func confidence(score float64) float64 {
+
+	return 0.5 * (1 + math.Erf(score/math.Sqrt2))
+}
+
+// Observe adds the given churn value of the given relay flag, which was
+// observed at the given time, to the flag's history.  It returns the churn
+// value's anomaly scores, or nil if the history is too short to tell.
+func (d *Detector) Observe(flag string, t time.Time, churn Churn) *Anomaly {
+
+	config := d.config.Anomaly(flag)
+	history := d.History[flag]
+
+	var anomaly *Anomaly
+	if len(history) >= config.MinHistory && len(history) > 0 {
+		online := func(c Churn) float64 { return c.Online }
+		offline := func(c Churn) float64 { return c.Offline }
+
+		anomaly = &Anomaly{
+			OnlineScore:  score(t, churn.Online, history, config, online),
+			OfflineScore: score(t, churn.Offline, history, config, offline),
+		}
+		anomaly.OnlineConfidence = confidence(anomaly.OnlineScore)
+		anomaly.OfflineConfidence = confidence(anomaly.OfflineScore)
+		anomaly.Online = anomaly.OnlineScore >= config.Threshold
+		anomaly.Offline = anomaly.OfflineScore >= config.Threshold
+	}
+
+	history = append(history, Observation{t, churn})
+	if len(history) > config.History {
+		history = history[len(history)-config.History:]
+	}
+	d.History[flag] = history
+
+	return anomaly
+}
@@ -0,0 +1,112 @@
+// Serialise the state of a churn analysis, so it can be resumed later.
+
+package churn
+
+import (
+	"time"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// Relay holds the parts of a router status that the churn analysis needs.
+type Relay struct {
+	Fingerprint tor.Fingerprint
+	Nickname    string
+	Flags       []string
+	Bandwidth   uint64
+}
+
+// Checkpoint holds the state of a churn analysis: the most recent consensus,
+// its bandwidth weights and known flags, the moving averages, and, if
+// anomalies are detected, the detector's history.  A checkpoint can be
+// serialised, e.g., as JSON, and the analysis can later continue with the next
+// consensus.
+type Checkpoint struct {
+	ValidAfter     time.Time
+	Relays         []Relay
+	Weights        microdesc.BandwidthWeights
+	KnownFlags     []string `json:",omitempty"`
+	MovAvg         PerFlagMovAvg
+	AnomalyHistory map[string][]Observation `json:",omitempty"`
+}
+
+// NewCheckpoint returns a checkpoint for the given consensus, which is the
+// most recent one that was analysed, its given bandwidth weights and relay
+// flags by name, and the given moving averages.  If the relay flags are nil,
+// the relays' flags in RelayFlags are saved.
+func NewCheckpoint(consensus *tor.Consensus, weights microdesc.BandwidthWeights, flags *microdesc.Flags, movAvg PerFlagMovAvg) *Checkpoint {
+
+	checkpoint := &Checkpoint{
+		ValidAfter: consensus.ValidAfter,
+		Weights:    weights,
+		MovAvg:     movAvg,
+	}
+	if flags != nil {
+		checkpoint.KnownFlags = flags.Known
+	}
+
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		status := getStatus()
+		relay := Relay{
+			Fingerprint: fingerprint,
+			Nickname:    status.Nickname,
+			Bandwidth:   status.Bandwidth,
+		}
+
+		if flags != nil {
+			relay.Flags = flags.Relays[fingerprint]
+			checkpoint.Relays = append(checkpoint.Relays, relay)
+			continue
+		}
+
+		relay.Flags = statusFlags(&status.Flags)
+		checkpoint.Relays = append(checkpoint.Relays, relay)
+	}
+
+	return checkpoint
+}
+
+// Consensus turns the checkpoint's relays back into a consensus that the next
+// consensus can be compared to.
+func (cp *Checkpoint) Consensus() *tor.Consensus {
+
+	consensus := tor.NewConsensus()
+	consensus.ValidAfter = cp.ValidAfter
+
+	for _, relay := range cp.Relays {
+		status := &tor.RouterStatus{
+			Fingerprint: relay.Fingerprint,
+			Nickname:    relay.Nickname,
+			Bandwidth:   relay.Bandwidth,
+		}
+
+		for _, flag := range relay.Flags {
+			if field, ok := routerFlags[flag]; ok {
+				*field(&status.Flags) = true
+			}
+		}
+		consensus.Set(relay.Fingerprint, status)
+	}
+
+	return consensus
+}
+
+// Flags returns the relay flags of the checkpoint's relays by name.
+// Checkpoints of older versions only hold the flags in RelayFlags, so nil is
+// returned for them, and the flags of the consensus that Consensus returns
+// apply.
+func (cp *Checkpoint) Flags() *microdesc.Flags {
+
+	if cp.KnownFlags == nil {
+		return nil
+	}
+
+	flags := microdesc.NewFlags()
+	flags.Known = cp.KnownFlags
+	for _, relay := range cp.Relays {
+		flags.Relays[relay.Fingerprint] = relay.Flags
+	}
+
+	return flags
+}
@@ -0,0 +1,449 @@
+// Package churn determines the churn rate of consecutive network consensuses.
+// For the churn rate, we adapt the formula shown in Section 2.1 of:
+// <http://www.cs.berkeley.edu/~istoica/papers/2006/churn.pdf>.
+package churn
+
+import (
+	"math"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// RelayFlags holds the relay flags that will be analysed.  zoossh doesn't know
+// MiddleOnly, NoEdConsensus, and StaleDesc, so relays only have them if their
+// flags were parsed by name.
+var RelayFlags = []string{
+	"Authority",
+	"BadExit",
+	"Exit",
+	"Fast",
+	"Guard",
+	"HSDir",
+	"MiddleOnly",
+	"Named",
+	"NoEdConsensus",
+	"Running",
+	"Stable",
+	"StaleDesc",
+	"Unnamed",
+	"V2Dir",
+	"Valid"}
+
+// Churn holds two churn values, for relays that went online and relays that
+// went offline.  Besides the churn of relay counts, it holds the churn of
+// consensus bandwidth, and of the bandwidth that clients use in guard and in
+// exit position, as determined by the consensus' bandwidth weights.  A single
+// relay carrying a large fraction of guard bandwidth matters more to clients
+// than many tiny relays.
+type Churn struct {
+	Online  float64
+	Offline float64
+
+	BwOnline        float64
+	BwOffline       float64
+	GuardPosOnline  float64
+	GuardPosOffline float64
+	ExitPosOnline   float64
+	ExitPosOffline  float64
+}
+
+// add adds the given churn values to ours.
+func (c *Churn) add(other Churn) {
+
+	c.Online += other.Online
+	c.Offline += other.Offline
+	c.BwOnline += other.BwOnline
+	c.BwOffline += other.BwOffline
+	c.GuardPosOnline += other.GuardPosOnline
+	c.GuardPosOffline += other.GuardPosOffline
+	c.ExitPosOnline += other.ExitPosOnline
+	c.ExitPosOffline += other.ExitPosOffline
+}
+
+// scale multiplies our churn values by the given factor.
+func (c *Churn) scale(factor float64) {
+
+	c.Online *= factor
+	c.Offline *= factor
+	c.BwOnline *= factor
+	c.BwOffline *= factor
+	c.GuardPosOnline *= factor
+	c.GuardPosOffline *= factor
+	c.ExitPosOnline *= factor
+	c.ExitPosOffline *= factor
+}
+
+// FlagChurn holds the churn rate of all relays with a given flag.  If the
+// churn rate of relays that went online reaches the flag's threshold,
+// Threshold, Appeared holds these relays.  Likewise, if the churn rate of
+// relays that went offline reaches the threshold, Disappeared holds them.
+// GapValues is the number of values in the moving average window that were
+// determined across missing consensuses.  If churn is analysed by a detector,
+// Anomaly holds the churn's anomaly scores, and Appeared and Disappeared are
+// set for anomalous churn instead of churn that reaches the threshold.
+// Anomaly is nil as long as the detector lacks history.
+type FlagChurn struct {
+	Flag        string
+	Churn       Churn
+	Appeared    *tor.Consensus
+	Disappeared *tor.Consensus
+	GapValues   int
+	Threshold   float64
+	Anomaly     *Anomaly
+}
+
+// PerFlagMovAvg maps a relay flag, e.g., "Guard", to a moving average struct.
+type PerFlagMovAvg map[string]*MovingAverage
+
+// NewPerFlagMovAvg allocates and returns a moving average with the given
+// window size for all relay flags in RelayFlags.
+func NewPerFlagMovAvg(windowSize int) PerFlagMovAvg {
+
+	movAvg := make(PerFlagMovAvg)
+	for _, flag := range RelayFlags {
+		movAvg[flag] = NewMovingAverage(windowSize)
+	}
+
+	return movAvg
+}
+
+// NewConfiguredMovAvg allocates and returns a moving average for the given
+// relay flags, whose window sizes are given by the given configuration.
+func NewConfiguredMovAvg(flags []string, config *Config) PerFlagMovAvg {
+
+	movAvg := make(PerFlagMovAvg)
+	for _, flag := range flags {
+		movAvg[flag] = NewMovingAverage(config.Flag(flag).WindowSize)
+	}
+
+	return movAvg
+}
+
+// Reset empties the moving average windows of all relay flags.
+func (movAvg PerFlagMovAvg) Reset() {
+
+	for _, avg := range movAvg {
+		avg.Reset()
+	}
+}
+
+// MovingAverage represents a simple moving average.  AcrossGap marks the
+// values in the window that were determined across missing consensuses.
+type MovingAverage struct {
+	WindowIndex int
+	WindowSize  int
+	WindowFill  int
+	Window      []Churn
+	AcrossGap   []bool
+}
+
+// NewMovingAverage allocates and returns a new moving average struct.
+func NewMovingAverage(windowSize int) *MovingAverage {
+
+	return &MovingAverage{
+		WindowIndex: 0,
+		WindowSize:  windowSize,
+		Window:      make([]Churn, windowSize),
+		AcrossGap:   make([]bool, windowSize),
+	}
+}
+
+// Reset empties the moving average's window.
+func (ma *MovingAverage) Reset() {
+
+	*ma = *NewMovingAverage(ma.WindowSize)
+}
+
+// CalcAvg determines and returns the mean of the moving average window.
+func (ma *MovingAverage) CalcAvg() Churn {
+
+	var total Churn
+	for i := 0; i < ma.WindowSize; i++ {
+		total.add(ma.Window[i])
+	}
+	total.scale(1 / float64(ma.WindowSize))
+
+	return total
+}
+
+// AddValue adds a churn value to the moving average window.
+func (ma *MovingAverage) AddValue(val Churn) {
+
+	ma.addValue(val, false)
+}
+
+// AddGapValue adds a churn value that was determined across missing
+// consensuses to the moving average window.
+func (ma *MovingAverage) AddGapValue(val Churn) {
+
+	ma.addValue(val, true)
+}
+
+// addValue adds the given churn value to the moving average window, and
+// remembers if it was determined across missing consensuses.
+func (ma *MovingAverage) addValue(val Churn, acrossGap bool) {
+
+	// Checkpoints of older versions lack the gap markers.
+	if len(ma.AcrossGap) != ma.WindowSize {
+		ma.AcrossGap = make([]bool, ma.WindowSize)
+	}
+
+	if ma.WindowFill < ma.WindowSize {
+		ma.WindowFill++
+	}
+	ma.Window[ma.WindowIndex] = val
+	ma.AcrossGap[ma.WindowIndex] = acrossGap
+	ma.WindowIndex = (ma.WindowIndex + 1) % ma.WindowSize
+}
+
+// GapValues returns the number of values in the moving average window that
+// were determined across missing consensuses.
+func (ma *MovingAverage) GapValues() int {
+
+	count := 0
+	for _, acrossGap := range ma.AcrossGap {
+		if acrossGap {
+			count++
+		}
+	}
+
+	return count
+}
+
+// IsWindowFull returns true if the moving average's window is full.
+func (ma *MovingAverage) IsWindowFull() bool {
+
+	return ma.WindowFill == ma.WindowSize
+}
+
+// Determine determines and returns the churn rate of the two given subsequent
+// consensuses.  Without bandwidth weights, the churn in guard and exit
+// position equals the bandwidth churn.
+func Determine(prevConsensus, newConsensus *tor.Consensus) Churn {
+
+	return DetermineWeighted(prevConsensus, newConsensus, nil, nil)
+}
+
+// weights holds the total consensus bandwidth of a set of relays, and the part
+// of it that clients use in guard and in exit position.
+type weights struct {
+	bandwidth float64
+	guardPos  float64
+	exitPos   float64
+}
+
+// add adds the given weights to ours.
+func (w *weights) add(other weights) {
+
+	w.bandwidth += other.bandwidth
+	w.guardPos += other.guardPos
+	w.exitPos += other.exitPos
+}
+
+// sumWeights returns the total weights of the relays in the given consensus,
+// whose bandwidth weights are given.
+func sumWeights(consensus *tor.Consensus, bwWeights microdesc.BandwidthWeights) weights {
+
+	var total weights
+	for _, getStatus := range consensus.RouterStatuses {
+		status := getStatus()
+		bandwidth := float64(status.Bandwidth)
+		guard, exit := bwWeights.Position(&status.Flags)
+
+		total.add(weights{bandwidth, bandwidth * guard, bandwidth * exit})
+	}
+
+	return total
+}
+
+// fraction returns numerator / denominator, or 0 if the denominator is 0.
+func fraction(numerator, denominator float64) float64 {
+
+	if denominator == 0 {
+		return 0
+	}
+
+	return numerator / denominator
+}
+
+// DetermineWeighted determines and returns the churn rate of the two given
+// subsequent consensuses, whose bandwidth weights are given.  The bandwidth of
+// relays that went offline is weighted by the previous consensus' bandwidth
+// weights, and the bandwidth of relays that went online by the new consensus'
+// bandwidth weights.  Like relay counts, weighted churn is divided by the
+// larger of the two consensuses' totals.
+func DetermineWeighted(prevConsensus, newConsensus *tor.Consensus, prevWeights, newWeights microdesc.BandwidthWeights) Churn {
+
+	goneRelays := prevConsensus.Subtract(newConsensus)
+	newRelays := newConsensus.Subtract(prevConsensus)
+
+	max := math.Max(float64(prevConsensus.Length()), float64(newConsensus.Length()))
+
+	prevTotal := sumWeights(prevConsensus, prevWeights)
+	newTotal := sumWeights(newConsensus, newWeights)
+	gone := sumWeights(goneRelays, prevWeights)
+	appeared := sumWeights(newRelays, newWeights)
+
+	maxBandwidth := math.Max(prevTotal.bandwidth, newTotal.bandwidth)
+	maxGuardPos := math.Max(prevTotal.guardPos, newTotal.guardPos)
+	maxExitPos := math.Max(prevTotal.exitPos, newTotal.exitPos)
+
+	return Churn{
+		Online:  fraction(float64(newRelays.Length()), max),
+		Offline: fraction(float64(goneRelays.Length()), max),
+
+		BwOnline:        fraction(appeared.bandwidth, maxBandwidth),
+		BwOffline:       fraction(gone.bandwidth, maxBandwidth),
+		GuardPosOnline:  fraction(appeared.guardPos, maxGuardPos),
+		GuardPosOffline: fraction(gone.guardPos, maxGuardPos),
+		ExitPosOnline:   fraction(appeared.exitPos, maxExitPos),
+		ExitPosOffline:  fraction(gone.exitPos, maxExitPos),
+	}
+}
+
+// FilterConsensusByFlag filters the given consensus so that only relays with
+// the given flag remain.  The resulting consensus is returned.
+func FilterConsensusByFlag(consensus *tor.Consensus, flag string) *tor.Consensus {
+
+	filteredConsensus := tor.NewConsensus()
+
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		status := getStatus()
+
+		// Check if relay has the flag we are looking for.
+		if hasFlag(&status.Flags, flag) {
+			filteredConsensus.Set(fingerprint, status)
+		}
+	}
+
+	return filteredConsensus
+}
+
+// PerFlag determines the churn rate between two subsequent consensuses for
+// all relays with a given flag.  For example, for all relays with the "Guard"
+// flag, we get a churn value for relays that went online and a churn value for
+// relays that went offline.  The churn values are smoothed by the given moving
+// average.  Flags whose moving average window isn't full yet are left out of
+// the result.  Once a churn value reaches the given threshold, the result also
+// holds the relays that caused it.  The threshold applies to the churn of
+// relay counts.
+func PerFlag(prevConsensus, newConsensus *tor.Consensus, movAvg PerFlagMovAvg, threshold float64) []FlagChurn {
+
+	return PerFlagWeighted(prevConsensus, newConsensus, nil, nil, movAvg, threshold)
+}
+
+// PerFlagWeighted is like PerFlag, but it takes into account the given
+// bandwidth weights of the two consensuses to determine the churn in guard
+// and exit position.
+func PerFlagWeighted(prevConsensus, newConsensus *tor.Consensus, prevWeights, newWeights microdesc.BandwidthWeights, movAvg PerFlagMovAvg, threshold float64) []FlagChurn {
+
+	comparison := &Comparison{
+		Prev:        prevConsensus,
+		New:         newConsensus,
+		PrevWeights: prevWeights,
+		NewWeights:  newWeights,
+		Intervals:   1,
+	}
+
+	return comparison.PerFlag(movAvg, threshold)
+}
+
+// Comparison holds two consensuses whose churn is determined, together with
+// their bandwidth weights, and their relay flags by name, which may be nil.
+// PrevIndex and NewIndex are the consensuses' indexes.  If either is nil,
+// both consensuses are indexed, so an analysis of consecutive consensuses
+// should index every consensus once, with the same indexer, and set them.
+// Intervals is the number of consensus intervals between the two consensuses.
+// It's larger than one if consensuses are missing in between.  Flags holds the
+// relay flags that are analysed, which default to RelayFlags.  If Config isn't
+// nil, it determines the thresholds of relay flags.  If Detector isn't nil, it
+// decides which churn is anomalous, instead of a fixed threshold.
+type Comparison struct {
+	Prev        *tor.Consensus
+	New         *tor.Consensus
+	PrevWeights microdesc.BandwidthWeights
+	NewWeights  microdesc.BandwidthWeights
+	PrevFlags   *microdesc.Flags
+	NewFlags    *microdesc.Flags
+	PrevIndex   *Index
+	NewIndex    *Index
+	Intervals   int
+	Flags       []string
+	Config      *Config
+	Detector    *Detector
+}
+
+// PerFlag works like the function PerFlag.  If the comparison spans more than
+// one consensus interval, the churn values are divided by the number of
+// intervals, so they remain comparable to the churn of consecutive
+// consensuses, and they are marked in the moving average windows.  If the
+// configuration is given, the given threshold is ignored.  Relay flags that
+// have no moving average yet get one, whose window size is taken from the
+// configuration, or 1 without one.
+func (c *Comparison) PerFlag(movAvg PerFlagMovAvg, threshold float64) []FlagChurn {
+
+	var result []FlagChurn
+
+	flags := c.Flags
+	if flags == nil {
+		flags = RelayFlags
+	}
+
+	prevIndex, newIndex := c.PrevIndex, c.NewIndex
+	if prevIndex == nil || newIndex == nil {
+		indexer := NewIndexer()
+		prevIndex = indexer.Index(c.Prev, c.PrevWeights, c.PrevFlags)
+		newIndex = indexer.Index(c.New, c.NewWeights, c.NewFlags)
+	}
+
+	for _, flag := range flags {
+
+		windowSize := 1
+		if c.Config != nil {
+			threshold = c.Config.Flag(flag).Threshold
+			windowSize = c.Config.Flag(flag).WindowSize
+		}
+		if movAvg[flag] == nil {
+			movAvg[flag] = NewMovingAverage(windowSize)
+		}
+
+		churn, appeared, gone := indexChurn(prevIndex, newIndex, flag)
+
+		// Determine moving average for captured churn values.
+		if c.Intervals > 1 {
+			churn.scale(1 / float64(c.Intervals))
+			movAvg[flag].AddGapValue(churn)
+		} else {
+			movAvg[flag].AddValue(churn)
+		}
+		churn = movAvg[flag].CalcAvg()
+		if !movAvg[flag].IsWindowFull() {
+			continue
+		}
+
+		flagChurn := FlagChurn{
+			Flag:      flag,
+			Churn:     churn,
+			GapValues: movAvg[flag].GapValues(),
+			Threshold: threshold,
+		}
+		online, offline := churn.Online >= threshold, churn.Offline >= threshold
+		if c.Detector != nil {
+			flagChurn.Anomaly = c.Detector.Observe(flag, c.New.ValidAfter, churn)
+			online, offline = false, false
+			if flagChurn.Anomaly != nil {
+				online, offline = flagChurn.Anomaly.Online, flagChurn.Anomaly.Offline
+			}
+		}
+		if online {
+			flagChurn.Appeared = newIndex.consensus(appeared)
+		}
+		if offline {
+			flagChurn.Disappeared = prevIndex.consensus(gone)
+		}
+		result = append(result, flagChurn)
+	}
+
+	return result
+}
@@ -0,0 +1,320 @@
+// Test the churn of consecutive consensuses.
+
+package churn
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// newStatus returns a router status with the given fingerprint, consensus
+// bandwidth, and relay flags.
+func newStatus(fingerprint string, bandwidth uint64, flags ...string) *tor.RouterStatus {
+
+	status := &tor.RouterStatus{
+		Fingerprint: tor.Fingerprint(fingerprint),
+		Bandwidth:   bandwidth,
+	}
+	for _, flag := range flags {
+		*routerFlags[flag](&status.Flags) = true
+	}
+
+	return status
+}
+
+// newConsensus returns a consensus holding the given router statuses.
+func newConsensus(statuses ...*tor.RouterStatus) *tor.Consensus {
+
+	consensus := tor.NewConsensus()
+	for _, status := range statuses {
+		consensus.Set(status.Fingerprint, status)
+	}
+
+	return consensus
+}
+
+// fingerprints returns the sorted fingerprints of the relays in the given
+// consensus, or nil if the consensus is nil.
+func fingerprints(consensus *tor.Consensus) []string {
+
+	if consensus == nil {
+		return nil
+	}
+
+	var result []string
+	for fingerprint := range consensus.RouterStatuses {
+		result = append(result, string(fingerprint))
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// churnEqual returns true if the given churn values are equal, save for
+// rounding errors.
+func churnEqual(a, b Churn) bool {
+
+	values := func(c Churn) []float64 {
+		return []float64{c.Online, c.Offline, c.BwOnline, c.BwOffline,
+			c.GuardPosOnline, c.GuardPosOffline, c.ExitPosOnline, c.ExitPosOffline}
+	}
+
+	aValues, bValues := values(a), values(b)
+	for i := range aValues {
+		if math.Abs(aValues[i]-bValues[i]) > 1e-9 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// countChurn returns churn whose bandwidth-weighted values equal the given
+// relay count values.
+func countChurn(online, offline float64) Churn {
+
+	return Churn{
+		Online: online, Offline: offline,
+		BwOnline: online, BwOffline: offline,
+		GuardPosOnline: online, GuardPosOffline: offline,
+		ExitPosOnline: online, ExitPosOffline: offline,
+	}
+}
+
+// intPointer returns a pointer to the given integer.
+func intPointer(i int) *int {
+
+	return &i
+}
+
+func TestDetermine(t *testing.T) {
+
+	a := newStatus("A", 100, "Running")
+	b := newStatus("B", 100, "Running")
+	c := newStatus("C", 300, "Running")
+
+	tests := []struct {
+		name     string
+		prev     *tor.Consensus
+		next     *tor.Consensus
+		expected Churn
+	}{
+		{"empty", newConsensus(), newConsensus(), Churn{}},
+		{"identical", newConsensus(a, b), newConsensus(a, b), Churn{}},
+		{"replaced", newConsensus(a), newConsensus(b), countChurn(1, 1)},
+		{"appeared", newConsensus(a), newConsensus(a, b), countChurn(0.5, 0)},
+		{"disappeared", newConsensus(a, b), newConsensus(a), countChurn(0, 0.5)},
+		{"weighted by bandwidth", newConsensus(a, b), newConsensus(b, c), Churn{
+			Online: 0.5, Offline: 0.5,
+			BwOnline: 0.75, BwOffline: 0.25,
+			GuardPosOnline: 0.75, GuardPosOffline: 0.25,
+			ExitPosOnline: 0.75, ExitPosOffline: 0.25,
+		}},
+	}
+
+	for _, test := range tests {
+		if churn := Determine(test.prev, test.next); !churnEqual(churn, test.expected) {
+			t.Errorf("%s: churn is %+v, but expected %+v.", test.name, churn, test.expected)
+		}
+	}
+}
+
+func TestDetermineWeighted(t *testing.T) {
+
+	guard := newStatus("A", 100, "Guard")
+	exit := newStatus("B", 100, "Exit")
+	bwWeights := microdesc.BandwidthWeights{"Wgg": 0.5, "Weg": 0, "Wge": 0, "Wee": 1}
+
+	// In guard position, clients use half of the guard's bandwidth, and none
+	// of the exit's.
+	churn := DetermineWeighted(newConsensus(guard, exit), newConsensus(exit), bwWeights, bwWeights)
+	expected := Churn{
+		Offline:         0.5,
+		BwOffline:       0.5,
+		GuardPosOffline: 1,
+		ExitPosOffline:  0,
+	}
+	if !churnEqual(churn, expected) {
+		t.Errorf("Churn is %+v, but expected %+v.", churn, expected)
+	}
+}
+
+func TestPerFlag(t *testing.T) {
+
+	prev := newConsensus(
+		newStatus("A", 100, "Guard", "Running"),
+		newStatus("B", 100, "Running"))
+	next := newConsensus(
+		newStatus("B", 100, "Guard", "Running"),
+		newStatus("C", 100, "Running"))
+
+	tests := []struct {
+		flag        string
+		churn       Churn
+		appeared    []string
+		disappeared []string
+	}{
+		{"Guard", countChurn(1, 1), []string{"B"}, []string{"A"}},
+		{"Running", countChurn(0.5, 0.5), []string{"C"}, []string{"A"}},
+		{"Exit", Churn{}, nil, nil},
+	}
+
+	result := PerFlag(prev, next, NewPerFlagMovAvg(1), 0.5)
+	if len(result) != len(RelayFlags) {
+		t.Fatalf("Got churn of %d flags, but expected %d.", len(result), len(RelayFlags))
+	}
+	byFlag := make(map[string]FlagChurn)
+	for _, flagChurn := range result {
+		byFlag[flagChurn.Flag] = flagChurn
+	}
+
+	for _, test := range tests {
+		flagChurn := byFlag[test.flag]
+		if !churnEqual(flagChurn.Churn, test.churn) {
+			t.Errorf("%s: churn is %+v, but expected %+v.", test.flag, flagChurn.Churn, test.churn)
+		}
+		if appeared := fingerprints(flagChurn.Appeared); !reflect.DeepEqual(appeared, test.appeared) {
+			t.Errorf("%s: appeared relays are %v, but expected %v.", test.flag, appeared, test.appeared)
+		}
+		if disappeared := fingerprints(flagChurn.Disappeared); !reflect.DeepEqual(disappeared, test.disappeared) {
+			t.Errorf("%s: disappeared relays are %v, but expected %v.", test.flag, disappeared, test.disappeared)
+		}
+	}
+}
+
+func TestComparisonPerFlag(t *testing.T) {
+
+	prev := newConsensus(newStatus("A", 100, "Guard"))
+	next := newConsensus(newStatus("B", 100, "Guard"))
+
+	config := NewConfig()
+	config.Default = FlagConfig{Threshold: 0.5, WindowSize: 2}
+	config.flags["Guard"] = flagOverride{WindowSize: intPointer(1)}
+
+	tests := []struct {
+		name      string
+		intervals int
+		churn     Churn
+		gapValues int
+		appeared  bool
+	}{
+		// Churn across two missing consensuses is divided by three.
+		{"across gap", 3, countChurn(1.0/3, 1.0/3), 1, false},
+		{"consecutive", 1, countChurn(1, 1), 0, true},
+	}
+
+	for _, test := range tests {
+		comparison := &Comparison{
+			Prev:      prev,
+			New:       next,
+			Intervals: test.intervals,
+			Flags:     []string{"Guard", "Exit"},
+			Config:    config,
+		}
+		result := comparison.PerFlag(make(PerFlagMovAvg), 0)
+
+		// Exit's window holds two values, so it's never full.
+		if len(result) != 1 || result[0].Flag != "Guard" {
+			t.Fatalf("%s: got churn %+v, but expected churn of Guard only.", test.name, result)
+		}
+		flagChurn := result[0]
+		if !churnEqual(flagChurn.Churn, test.churn) {
+			t.Errorf("%s: churn is %+v, but expected %+v.", test.name, flagChurn.Churn, test.churn)
+		}
+		if flagChurn.GapValues != test.gapValues {
+			t.Errorf("%s: %d gap values, but expected %d.", test.name, flagChurn.GapValues, test.gapValues)
+		}
+		if flagChurn.Threshold != 0.5 {
+			t.Errorf("%s: threshold is %f, but expected 0.5.", test.name, flagChurn.Threshold)
+		}
+		if appeared := flagChurn.Appeared != nil; appeared != test.appeared {
+			t.Errorf("%s: appeared relays were returned: %t, but expected %t.", test.name, appeared, test.appeared)
+		}
+	}
+}
+
+func TestComparisonPerFlagWithoutConfig(t *testing.T) {
+
+	comparison := &Comparison{
+		Prev:  newConsensus(newStatus("A", 100, "Guard")),
+		New:   newConsensus(newStatus("B", 100, "Guard")),
+		Flags: []string{"Guard", "Exit"},
+	}
+	// Without configuration, flags that have no moving average yet get a
+	// window of one value.
+	result := comparison.PerFlag(make(PerFlagMovAvg), 0.5)
+
+	if len(result) != 2 {
+		t.Fatalf("Got churn of %d flags, but expected 2.", len(result))
+	}
+	for _, flagChurn := range result {
+		if flagChurn.Threshold != 0.5 {
+			t.Errorf("%s: threshold is %f, but expected 0.5.", flagChurn.Flag, flagChurn.Threshold)
+		}
+	}
+	if !churnEqual(result[0].Churn, countChurn(1, 1)) {
+		t.Errorf("Guard: churn is %+v, but expected %+v.", result[0].Churn, countChurn(1, 1))
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+
+	movAvg := NewMovingAverage(3)
+
+	tests := []struct {
+		value     float64
+		acrossGap bool
+		full      bool
+		average   float64
+		gapValues int
+	}{
+		{0.3, false, false, 0.1, 0},
+		{0.6, false, false, 0.3, 0},
+		{0.9, true, true, 0.6, 1},
+		// The oldest value, 0.3, drops out of the window.
+		{0, false, true, 0.5, 1},
+		{0, false, true, 0.3, 1},
+		// The gap value drops out of the window.
+		{0, false, true, 0, 0},
+	}
+
+	for i, test := range tests {
+		if test.acrossGap {
+			movAvg.AddGapValue(countChurn(test.value, test.value))
+		} else {
+			movAvg.AddValue(countChurn(test.value, test.value))
+		}
+
+		if full := movAvg.IsWindowFull(); full != test.full {
+			t.Errorf("Value #%d: window is full: %t, but expected %t.", i, full, test.full)
+		}
+		if average := movAvg.CalcAvg(); !churnEqual(average, countChurn(test.average, test.average)) {
+			t.Errorf("Value #%d: average is %+v, but expected %f.", i, average, test.average)
+		}
+		if gapValues := movAvg.GapValues(); gapValues != test.gapValues {
+			t.Errorf("Value #%d: %d gap values, but expected %d.", i, gapValues, test.gapValues)
+		}
+	}
+
+	movAvg.Reset()
+	if movAvg.IsWindowFull() || movAvg.GapValues() != 0 || movAvg.CalcAvg() != (Churn{}) {
+		t.Errorf("Moving average %+v wasn't reset.", movAvg)
+	}
+}
+
+func TestMovingAverageWithoutGapMarkers(t *testing.T) {
+
+	// Checkpoints of older versions lack the gap markers.
+	movAvg := &MovingAverage{WindowSize: 2, Window: make([]Churn, 2)}
+	movAvg.AddGapValue(countChurn(1, 1))
+	movAvg.AddValue(countChurn(1, 1))
+
+	if gapValues := movAvg.GapValues(); gapValues != 1 {
+		t.Errorf("%d gap values, but expected 1.", gapValues)
+	}
+}
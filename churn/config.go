@@ -0,0 +1,242 @@
+// Configure the churn analysis per relay flag.
+
+package churn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// defaultFlag is the key in a configuration's sections that holds the
+// defaults for all relay flags.
+const defaultFlag = "default"
+
+// AnomalyConfig tunes the anomaly detection of a relay flag.  History is the
+// number of past churn values that are the baseline for new values, and no
+// value is scored before MinHistory values are known.  Threshold is the
+// anomaly score at which churn is anomalous.  MinSpread is the smallest
+// deviation from the baseline that's taken into account, so tiny fluctuations
+// of otherwise constant churn don't result in huge scores.  If SeasonHours is
+// larger than zero, churn is compared to past churn at the same time of a
+// season of the given length, e.g., 24 for the time of day, or 168 for the
+// time of week.
+type AnomalyConfig struct {
+	History     int     `json:"history"`
+	MinHistory  int     `json:"min_history"`
+	Threshold   float64 `json:"threshold"`
+	MinSpread   float64 `json:"min_spread"`
+	SeasonHours int     `json:"season_hours"`
+}
+
+// DefaultAnomalyConfig holds the anomaly detection settings of relay flags
+// that aren't configured otherwise.  A week of hourly values is the baseline,
+// and scores of 3.5 and above are anomalous, as recommended by Iglewicz and
+// Hoaglin for robust z-scores.
+var DefaultAnomalyConfig = AnomalyConfig{
+	History:     168,
+	MinHistory:  24,
+	Threshold:   3.5,
+	MinSpread:   0.001,
+	SeasonHours: 0,
+}
+
+// validate returns an error if the given settings make no sense.
+func (c AnomalyConfig) validate() error {
+
+	if c.History < 1 {
+		return fmt.Errorf("history must be at least 1, but is %d", c.History)
+	}
+	if c.MinHistory > c.History {
+		return fmt.Errorf("min_history (%d) must not exceed history (%d)", c.MinHistory, c.History)
+	}
+	if c.MinSpread < 0 {
+		return fmt.Errorf("min_spread must not be negative, but is %f", c.MinSpread)
+	}
+	if c.SeasonHours < 0 {
+		return fmt.Errorf("season_hours must not be negative, but is %d", c.SeasonHours)
+	}
+
+	return nil
+}
+
+// FlagConfig holds the threshold and the moving average window size of a
+// relay flag.
+type FlagConfig struct {
+	Threshold  float64
+	WindowSize int
+}
+
+// flagOverride holds the settings of a relay flag that override the defaults.
+// Settings that aren't given are nil.
+type flagOverride struct {
+	Threshold  *float64 `json:"threshold"`
+	WindowSize *int     `json:"window_size"`
+}
+
+// Config configures the churn analysis.  FlagSet holds the relay flags that
+// are analysed, in the order of the output's columns.  If it's empty,
+// RelayFlags and the relay flags with their own settings are analysed.
+// Default holds the threshold and window size of relay flags without their
+// own settings.  Anomalies maps relay flags to their anomaly detection
+// settings.  Flags that aren't in the map use the default settings.
+type Config struct {
+	FlagSet   []string
+	Default   FlagConfig
+	Anomalies map[string]AnomalyConfig
+	// flags maps relay flags to the settings that override Default.
+	flags map[string]flagOverride
+	// defaultAnomaly holds the settings of flags that aren't in Anomalies.
+	defaultAnomaly AnomalyConfig
+}
+
+// NewConfig returns a configuration that uses the default settings for all
+// relay flags.  Churn reaches the default threshold of one only if all
+// relays change, and the default window size is one.
+func NewConfig() *Config {
+
+	return &Config{
+		Default:        FlagConfig{Threshold: 1, WindowSize: 1},
+		Anomalies:      make(map[string]AnomalyConfig),
+		flags:          make(map[string]flagOverride),
+		defaultAnomaly: DefaultAnomalyConfig,
+	}
+}
+
+// Flag returns the threshold and window size of the given relay flag.
+func (c *Config) Flag(flag string) FlagConfig {
+
+	config := c.Default
+	if override, ok := c.flags[flag]; ok {
+		if override.Threshold != nil {
+			config.Threshold = *override.Threshold
+		}
+		if override.WindowSize != nil {
+			config.WindowSize = *override.WindowSize
+		}
+	}
+
+	return config
+}
+
+// Flags returns the relay flags that are analysed.  Unless the configuration
+// has a flag set, these are the flags in RelayFlags, followed by the flags
+// with their own settings in alphabetical order.
+func (c *Config) Flags() []string {
+
+	if len(c.FlagSet) > 0 {
+		return append([]string(nil), c.FlagSet...)
+	}
+
+	flags := append([]string(nil), RelayFlags...)
+	var configured []string
+	for flag := range c.flags {
+		if !contains(flags, flag) {
+			configured = append(configured, flag)
+		}
+	}
+	sort.Strings(configured)
+
+	return append(flags, configured...)
+}
+
+// contains returns true if the given flags contain the given flag.
+func contains(flags []string, flag string) bool {
+
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Anomaly returns the anomaly detection settings of the given relay flag.
+func (c *Config) Anomaly(flag string) AnomalyConfig {
+
+	if config, ok := c.Anomalies[flag]; ok {
+		return config
+	}
+
+	return c.defaultAnomaly
+}
+
+// ParseConfig parses a JSON configuration from the given reader.  The
+// configuration's default threshold and window size are the given ones.  Its
+// "flags" section maps relay flags to their threshold and window size, and
+// relay flags that aren't in RelayFlags are analysed once they are in the
+// section.  Its optional "flag_set" lists the relay flags that are analysed
+// instead.  Its "anomaly" section maps relay flags to their
+// anomaly detection settings.  The settings of the flag "default" apply to all
+// flags, and a flag's own settings only need to hold what differs from the
+// defaults, e.g.:
+//
+//	{"flags": {"Guard": {"threshold": 0.02, "window_size": 6},
+//	           "StaleDesc": {"threshold": 0.1}},
+//	 "anomaly": {"default": {"history": 336},
+//	             "Running": {"threshold": 5, "season_hours": 24}}}
+func ParseConfig(r io.Reader, defaults FlagConfig) (*Config, error) {
+
+	var document struct {
+		FlagSet []string                   `json:"flag_set"`
+		Flags   map[string]flagOverride    `json:"flags"`
+		Anomaly map[string]json.RawMessage `json:"anomaly"`
+	}
+	if err := json.NewDecoder(r).Decode(&document); err != nil {
+		return nil, fmt.Errorf("Couldn't parse churn configuration: %s", err)
+	}
+
+	config := NewConfig()
+	config.Default = defaults
+	config.FlagSet = document.FlagSet
+	for flag, override := range document.Flags {
+		if override.Threshold != nil && *override.Threshold < 0 {
+			return nil, fmt.Errorf("Threshold of %q must not be negative, but is %f.", flag, *override.Threshold)
+		}
+		if override.WindowSize != nil && *override.WindowSize < 1 {
+			return nil, fmt.Errorf("Window size of %q must be at least 1, but is %d.", flag, *override.WindowSize)
+		}
+		config.flags[flag] = override
+	}
+
+	if raw, ok := document.Anomaly[defaultFlag]; ok {
+		if err := json.Unmarshal(raw, &config.defaultAnomaly); err != nil {
+			return nil, fmt.Errorf("Couldn't parse anomaly settings of %q: %s", defaultFlag, err)
+		}
+	}
+	if err := config.defaultAnomaly.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid anomaly settings of %q: %s", defaultFlag, err)
+	}
+
+	for flag, raw := range document.Anomaly {
+		if flag == defaultFlag {
+			continue
+		}
+		flagConfig := config.defaultAnomaly
+		if err := json.Unmarshal(raw, &flagConfig); err != nil {
+			return nil, fmt.Errorf("Couldn't parse anomaly settings of %q: %s", flag, err)
+		}
+		if err := flagConfig.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid anomaly settings of %q: %s", flag, err)
+		}
+		config.Anomalies[flag] = flagConfig
+	}
+
+	return config, nil
+}
+
+// LoadConfig reads a JSON configuration from the given file.  The
+// configuration's default threshold and window size are the given ones.
+func LoadConfig(fileName string, defaults FlagConfig) (*Config, error) {
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return ParseConfig(fd, defaults)
+}
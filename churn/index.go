@@ -0,0 +1,274 @@
+// Index consensuses once, so churn is determined by operations on bitsets.
+
+package churn
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// routerFlags maps the names of the flags that zoossh's RouterFlags has to
+// the respective field.
+var routerFlags = map[string]func(*tor.RouterFlags) *bool{
+	"Authority": func(f *tor.RouterFlags) *bool { return &f.Authority },
+	"BadExit":   func(f *tor.RouterFlags) *bool { return &f.BadExit },
+	"Exit":      func(f *tor.RouterFlags) *bool { return &f.Exit },
+	"Fast":      func(f *tor.RouterFlags) *bool { return &f.Fast },
+	"Guard":     func(f *tor.RouterFlags) *bool { return &f.Guard },
+	"HSDir":     func(f *tor.RouterFlags) *bool { return &f.HSDir },
+	"Named":     func(f *tor.RouterFlags) *bool { return &f.Named },
+	"Running":   func(f *tor.RouterFlags) *bool { return &f.Running },
+	"Stable":    func(f *tor.RouterFlags) *bool { return &f.Stable },
+	"Unnamed":   func(f *tor.RouterFlags) *bool { return &f.Unnamed },
+	"V2Dir":     func(f *tor.RouterFlags) *bool { return &f.V2Dir },
+	"Valid":     func(f *tor.RouterFlags) *bool { return &f.Valid },
+}
+
+// hasFlag returns true if the given router flags contain the flag with the
+// given name.  zoossh doesn't know flags that were introduced later, so no
+// relay has them.
+func hasFlag(flags *tor.RouterFlags, flag string) bool {
+
+	field, ok := routerFlags[flag]
+	return ok && *field(flags)
+}
+
+// statusFlags returns the names of the given router flags, in the order of
+// RelayFlags.
+func statusFlags(flags *tor.RouterFlags) []string {
+
+	var names []string
+	for _, flag := range RelayFlags {
+		if hasFlag(flags, flag) {
+			names = append(names, flag)
+		}
+	}
+
+	return names
+}
+
+// bitset is a set of relay IDs.
+type bitset []uint64
+
+// set adds the given ID to the set, which must be large enough.
+func (b bitset) set(id int) {
+
+	b[id/64] |= 1 << uint(id%64)
+}
+
+// has returns true if the given ID is in the set.
+func (b bitset) has(id int) bool {
+
+	return id/64 < len(b) && b[id/64]&(1<<uint(id%64)) != 0
+}
+
+// andNot returns the IDs that are in our set, but not in the given one.
+func (b bitset) andNot(other bitset) bitset {
+
+	result := make(bitset, len(b))
+	for i, word := range b {
+		if i < len(other) {
+			word &^= other[i]
+		}
+		result[i] = word
+	}
+
+	return result
+}
+
+// count returns the number of IDs in the set.
+func (b bitset) count() int {
+
+	total := 0
+	for _, word := range b {
+		total += bits.OnesCount64(word)
+	}
+
+	return total
+}
+
+// each calls the given function for every ID in the set, in ascending order.
+func (b bitset) each(fn func(int)) {
+
+	for i, word := range b {
+		for word != 0 {
+			fn(i*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
+
+// Indexer assigns every relay fingerprint a numeric ID, and indexes
+// consensuses.  Relays keep their IDs from one index to the next, so an index
+// can be compared to the index that the same indexer made right before it.
+// The IDs of relays that are gone are reused for new relays, so an indexer
+// only remembers the fingerprints of the last consensus, and indexes don't
+// grow with every relay that an analysis ever saw.
+type Indexer struct {
+	ids  map[tor.Fingerprint]int
+	size int
+}
+
+// NewIndexer allocates and returns a new indexer.
+func NewIndexer() *Indexer {
+
+	return &Indexer{ids: make(map[tor.Fingerprint]int)}
+}
+
+// assign returns the IDs of the relays in the given consensus.  Relays of the
+// last consensus keep their IDs, and new relays get IDs that no relay of the
+// last consensus has.
+func (ix *Indexer) assign(consensus *tor.Consensus) map[tor.Fingerprint]int {
+
+	used := make(bitset, (ix.size+63)/64)
+	for _, id := range ix.ids {
+		used.set(id)
+	}
+
+	ids := make(map[tor.Fingerprint]int, len(consensus.RouterStatuses))
+	next := 0
+	for fingerprint := range consensus.RouterStatuses {
+		id, ok := ix.ids[fingerprint]
+		if !ok {
+			for used.has(next) {
+				next++
+			}
+			id = next
+			next++
+			if id >= ix.size {
+				ix.size = id + 1
+			}
+		}
+		ids[fingerprint] = id
+	}
+	ix.ids = ids
+
+	return ids
+}
+
+// Index is a consensus whose relays are indexed by flag.  It holds a bitset of
+// relay IDs for every flag that a relay has, and the weights of every relay,
+// so the churn of two indexes is determined by set differences, without
+// looking at router statuses again.
+type Index struct {
+	Consensus    *tor.Consensus
+	flags        map[string]bitset
+	totals       map[string]weights
+	relays       []weights
+	fingerprints []tor.Fingerprint
+}
+
+// Index indexes the given consensus, whose bandwidth weights and relay flags
+// by name are given.  If the relay flags are nil, the consensus' router flags
+// are used.
+func (ix *Indexer) Index(consensus *tor.Consensus, bwWeights microdesc.BandwidthWeights, flags *microdesc.Flags) *Index {
+
+	// Assign IDs first, so that we know how large the bitsets have to be.
+	ids := ix.assign(consensus)
+	size := ix.size
+
+	index := &Index{
+		Consensus:    consensus,
+		flags:        make(map[string]bitset),
+		totals:       make(map[string]weights),
+		relays:       make([]weights, size),
+		fingerprints: make([]tor.Fingerprint, size),
+	}
+
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		status := getStatus()
+		id := ids[fingerprint]
+
+		bandwidth := float64(status.Bandwidth)
+		guard, exit := bwWeights.Position(&status.Flags)
+		relay := weights{bandwidth, bandwidth * guard, bandwidth * exit}
+		index.relays[id] = relay
+		index.fingerprints[id] = fingerprint
+
+		var names []string
+		if flags != nil {
+			names = flags.Relays[fingerprint]
+		} else {
+			names = statusFlags(&status.Flags)
+		}
+		for _, flag := range names {
+			set, ok := index.flags[flag]
+			if !ok {
+				set = make(bitset, (size+63)/64)
+				index.flags[flag] = set
+			}
+			// Don't count relays twice whose flags are repeated.
+			if set.has(id) {
+				continue
+			}
+			set.set(id)
+
+			total := index.totals[flag]
+			total.add(relay)
+			index.totals[flag] = total
+		}
+	}
+
+	return index
+}
+
+// sum returns the total weights of the relays in the given set.
+func (index *Index) sum(set bitset) weights {
+
+	var total weights
+	set.each(func(id int) {
+		total.add(index.relays[id])
+	})
+
+	return total
+}
+
+// consensus returns the relays in the given set as a consensus.
+func (index *Index) consensus(set bitset) *tor.Consensus {
+
+	consensus := tor.NewConsensus()
+	set.each(func(id int) {
+		fingerprint := index.fingerprints[id]
+		consensus.RouterStatuses[fingerprint] = index.Consensus.RouterStatuses[fingerprint]
+	})
+
+	return consensus
+}
+
+// indexChurn determines the churn of the relays with the given flag between
+// the given previous and new index.  The new index must be the one that the
+// previous index's indexer made right after it.
+// Like DetermineWeighted, it divides churn by the larger of the two indexes'
+// totals.  It also returns the sets of relays that appeared and disappeared.
+func indexChurn(prevIndex, newIndex *Index, flag string) (Churn, bitset, bitset) {
+
+	prevSet, newSet := prevIndex.flags[flag], newIndex.flags[flag]
+	appeared := newSet.andNot(prevSet)
+	gone := prevSet.andNot(newSet)
+
+	max := math.Max(float64(prevSet.count()), float64(newSet.count()))
+
+	prevTotal, newTotal := prevIndex.totals[flag], newIndex.totals[flag]
+	appearedTotal, goneTotal := newIndex.sum(appeared), prevIndex.sum(gone)
+
+	maxBandwidth := math.Max(prevTotal.bandwidth, newTotal.bandwidth)
+	maxGuardPos := math.Max(prevTotal.guardPos, newTotal.guardPos)
+	maxExitPos := math.Max(prevTotal.exitPos, newTotal.exitPos)
+
+	churn := Churn{
+		Online:  fraction(float64(appeared.count()), max),
+		Offline: fraction(float64(gone.count()), max),
+
+		BwOnline:        fraction(appearedTotal.bandwidth, maxBandwidth),
+		BwOffline:       fraction(goneTotal.bandwidth, maxBandwidth),
+		GuardPosOnline:  fraction(appearedTotal.guardPos, maxGuardPos),
+		GuardPosOffline: fraction(goneTotal.guardPos, maxGuardPos),
+		ExitPosOnline:   fraction(appearedTotal.exitPos, maxExitPos),
+		ExitPosOffline:  fraction(goneTotal.exitPos, maxExitPos),
+	}
+
+	return churn, appeared, gone
+}
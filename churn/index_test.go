@@ -0,0 +1,202 @@
+// Test and benchmark the churn of indexed consensuses.
+
+package churn
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// syntheticWeights are bandwidth weights in which every position weight
+// differs, so mixing up positions changes the weighted churn.
+var syntheticWeights = microdesc.BandwidthWeights{
+	"Wgd": 0.1, "Wed": 0.2,
+	"Wgg": 0.3, "Weg": 0.4,
+	"Wge": 0.05, "Wee": 0.6,
+	"Wgm": 0.7, "Wem": 0.8,
+}
+
+// randomStatus returns a router status with the given fingerprint, a random
+// consensus bandwidth, and random flags that zoossh knows.
+func randomStatus(rng *rand.Rand, fingerprint tor.Fingerprint) *tor.RouterStatus {
+
+	status := &tor.RouterStatus{
+		Fingerprint: fingerprint,
+		Bandwidth:   uint64(rng.Intn(100000)),
+	}
+	for _, flag := range RelayFlags {
+		if field, ok := routerFlags[flag]; ok && rng.Intn(2) == 0 {
+			*field(&status.Flags) = true
+		}
+	}
+
+	return status
+}
+
+// syntheticConsensuses returns two consecutive consensuses with the given
+// number of relays.  The given fraction of relays is replaced in the second
+// consensus, and as many relays change their flags and bandwidth.
+func syntheticConsensuses(relays int, turnover float64, seed int64) (*tor.Consensus, *tor.Consensus) {
+
+	rng := rand.New(rand.NewSource(seed))
+	prev, next := tor.NewConsensus(), tor.NewConsensus()
+
+	for i := 0; i < relays; i++ {
+		fingerprint := tor.Fingerprint(fmt.Sprintf("%040X", i))
+		status := randomStatus(rng, fingerprint)
+		prev.Set(fingerprint, status)
+
+		switch {
+		case rng.Float64() < turnover:
+			replacement := tor.Fingerprint(fmt.Sprintf("%040X", relays+i))
+			next.Set(replacement, randomStatus(rng, replacement))
+		case rng.Float64() < turnover:
+			next.Set(fingerprint, randomStatus(rng, fingerprint))
+		default:
+			next.Set(fingerprint, status)
+		}
+	}
+
+	return prev, next
+}
+
+// filteredChurn determines the churn of the given flag like the analysis did
+// before consensuses were indexed, by filtering both consensuses by flag and
+// comparing the results.  It also returns the sorted fingerprints of the
+// relays that appeared and disappeared.
+func filteredChurn(prev, next *tor.Consensus, prevWeights, newWeights microdesc.BandwidthWeights, flag string) (Churn, []string, []string) {
+
+	prevFiltered := FilterConsensusByFlag(prev, flag)
+	newFiltered := FilterConsensusByFlag(next, flag)
+	churn := DetermineWeighted(prevFiltered, newFiltered, prevWeights, newWeights)
+
+	return churn, fingerprints(newFiltered.Subtract(prevFiltered)), fingerprints(prevFiltered.Subtract(newFiltered))
+}
+
+func TestIndexChurn(t *testing.T) {
+
+	prev, next := syntheticConsensuses(500, 0.1, 1)
+	emptyPrev, emptyNext := syntheticConsensuses(0, 0, 1)
+
+	tests := []struct {
+		name        string
+		prev        *tor.Consensus
+		next        *tor.Consensus
+		prevWeights microdesc.BandwidthWeights
+		newWeights  microdesc.BandwidthWeights
+	}{
+		{"identical", prev, prev, syntheticWeights, syntheticWeights},
+		{"turnover", prev, next, syntheticWeights, syntheticWeights},
+		{"without weights", prev, next, nil, nil},
+		// Relays that went offline are weighted by the previous weights.
+		{"weights appear", prev, next, nil, syntheticWeights},
+		{"all relays gone", prev, emptyNext, syntheticWeights, syntheticWeights},
+		{"all relays new", emptyPrev, next, syntheticWeights, syntheticWeights},
+	}
+
+	for _, test := range tests {
+		indexer := NewIndexer()
+		prevIndex := indexer.Index(test.prev, test.prevWeights, nil)
+		newIndex := indexer.Index(test.next, test.newWeights, nil)
+
+		for _, flag := range RelayFlags {
+			expected, expectedAppeared, expectedGone := filteredChurn(test.prev, test.next, test.prevWeights, test.newWeights, flag)
+
+			churn, appeared, gone := indexChurn(prevIndex, newIndex, flag)
+			if !churnEqual(churn, expected) {
+				t.Errorf("%s, %s: indexed churn is %+v, but filtered churn is %+v.", test.name, flag, churn, expected)
+			}
+			if fprs := fingerprints(newIndex.consensus(appeared)); !reflect.DeepEqual(fprs, expectedAppeared) {
+				t.Errorf("%s, %s: %d relays appeared, but expected %d.", test.name, flag, len(fprs), len(expectedAppeared))
+			}
+			if fprs := fingerprints(prevIndex.consensus(gone)); !reflect.DeepEqual(fprs, expectedGone) {
+				t.Errorf("%s, %s: %d relays disappeared, but expected %d.", test.name, flag, len(fprs), len(expectedGone))
+			}
+		}
+	}
+}
+
+func TestIndexerReusesIDs(t *testing.T) {
+
+	// Every consensus replaces a tenth of the relays of its predecessor.
+	const relays = 200
+	rng := rand.New(rand.NewSource(1))
+	consensus := tor.NewConsensus()
+	for i := 0; i < relays; i++ {
+		fingerprint := tor.Fingerprint(fmt.Sprintf("%040X", i))
+		consensus.Set(fingerprint, randomStatus(rng, fingerprint))
+	}
+
+	indexer := NewIndexer()
+	prev, prevIndex := consensus, indexer.Index(consensus, syntheticWeights, nil)
+	for round := 1; round <= 50; round++ {
+		next := tor.NewConsensus()
+		i := 0
+		for fingerprint, getStatus := range prev.RouterStatuses {
+			if i < relays/10 {
+				fingerprint = tor.Fingerprint(fmt.Sprintf("%040X", round*relays+i))
+				next.Set(fingerprint, randomStatus(rng, fingerprint))
+			} else {
+				next.Set(fingerprint, getStatus())
+			}
+			i++
+		}
+		newIndex := indexer.Index(next, syntheticWeights, nil)
+
+		for _, flag := range RelayFlags {
+			expected, expectedAppeared, expectedGone := filteredChurn(prev, next, syntheticWeights, syntheticWeights, flag)
+			churn, appeared, gone := indexChurn(prevIndex, newIndex, flag)
+			if !churnEqual(churn, expected) {
+				t.Errorf("Round %d, %s: indexed churn is %+v, but filtered churn is %+v.", round, flag, churn, expected)
+			}
+			if fprs := fingerprints(newIndex.consensus(appeared)); !reflect.DeepEqual(fprs, expectedAppeared) {
+				t.Errorf("Round %d, %s: %d relays appeared, but expected %d.", round, flag, len(fprs), len(expectedAppeared))
+			}
+			if fprs := fingerprints(prevIndex.consensus(gone)); !reflect.DeepEqual(fprs, expectedGone) {
+				t.Errorf("Round %d, %s: %d relays disappeared, but expected %d.", round, flag, len(fprs), len(expectedGone))
+			}
+		}
+		prev, prevIndex = next, newIndex
+	}
+
+	// Relays that are gone don't take up room.
+	if size := len(prevIndex.relays); size > relays+relays/10 {
+		t.Errorf("Index holds %d relays, but expected at most %d.", size, relays+relays/10)
+	}
+}
+
+// benchmarkPrev and benchmarkNext are consensuses of about the size of
+// today's network, so that the benchmarks compare both paths on the same data.
+var benchmarkPrev, benchmarkNext = syntheticConsensuses(7000, 0.02, 1)
+
+func BenchmarkFilteredChurn(b *testing.B) {
+
+	for i := 0; i < b.N; i++ {
+		for _, flag := range RelayFlags {
+			prevFiltered := FilterConsensusByFlag(benchmarkPrev, flag)
+			newFiltered := FilterConsensusByFlag(benchmarkNext, flag)
+			DetermineWeighted(prevFiltered, newFiltered, syntheticWeights, syntheticWeights)
+		}
+	}
+}
+
+func BenchmarkIndexChurn(b *testing.B) {
+
+	// An analysis indexes every consensus once, so every iteration only
+	// indexes the new consensus.
+	indexer := NewIndexer()
+	prevIndex := indexer.Index(benchmarkPrev, syntheticWeights, nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		newIndex := indexer.Index(benchmarkNext, syntheticWeights, nil)
+		for _, flag := range RelayFlags {
+			indexChurn(prevIndex, newIndex, flag)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Test the churn analysis of consecutive consensuses.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscoverFlags(t *testing.T) {
+
+	configured := []string{"Guard", "Running"}
+	known := []string{"Exit", "Guard", "MiddleOnly", "Running"}
+
+	tests := []struct {
+		name     string
+		fixed    bool
+		expected []string
+	}{
+		// The CSV header isn't printed yet, so it gets columns for the
+		// known flags.
+		{"first consensus", false, []string{"Guard", "Running", "Exit", "MiddleOnly"}},
+		{"fixed columns", true, configured},
+	}
+
+	for _, test := range tests {
+		reported := make(map[string]bool)
+		flags := discoverFlags(append([]string(nil), configured...), known, reported, time.Time{}, test.fixed)
+		if !reflect.DeepEqual(flags, test.expected) {
+			t.Errorf("%s: flags are %v, but expected %v.", test.name, flags, test.expected)
+		}
+		if len(reported) > 0 != test.fixed {
+			t.Errorf("%s: reported flags %v.", test.name, reported)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Subcommands, each of which runs one analysis with its own flags.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Command represents a subcommand, e.g., "sybilhunter churn".
+type Command struct {
+	Name        string
+	Description string
+
+	// AddFlags adds the command's own flags to the given flag set.  Flags that
+	// all commands share are added by addCommonFlags.
+	AddFlags func(*flag.FlagSet, *CmdLineParams)
+
+	// Enable turns on the command's analysis in the given parameters, and
+	// returns an error if a mandatory flag is missing.
+	Enable func(*CmdLineParams) error
+
+	// Run is set for commands that don't run an analysis, e.g., "fetch".
+	// It parses the given arguments itself, and runs the command.
+	Run func(context.Context, []string) error
+}
+
+const fetchDescription = "Download CollecTor data into a local store that -data and -descdir can use."
+
+// The usage of flags that both the churn command and the top-level flags have.
+const (
+	gapPolicyUsage   = "What churn does if consensuses are missing.  'normalise' compares across the gap and divides churn by the number of consensus intervals, 'reset' starts over with empty moving average windows, and 'skip' ignores the gap.  Default is 'normalise'."
+	intervalUsage    = "Time between consecutive consensuses, e.g., 30m for test networks.  Default is the time for which consensuses are fresh."
+	detectorUsage    = "How churn is found to be suspicious.  'threshold' compares churn to -threshold, and 'robust' scores churn by how much it deviates from the recent churn of the same flag.  Default is 'threshold'."
+	churnConfigUsage = "JSON file that sets the threshold and window size per relay flag, adds flags to the analysis, and tunes the 'robust' detector per flag."
+)
+
+// Commands holds all subcommands in the order in which they are listed in the
+// usage message.
+var Commands = []*Command{
+	{
+		Name:        "churn",
+		Description: "Determine the churn rate of consecutive consensuses.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.Float64Var(&params.Threshold, "threshold", params.Threshold, "Churn rate in [0,1] at or above which new and disappeared relays are logged.")
+			flags.IntVar(&params.WindowSize, "windowsize", params.WindowSize, "Window size for moving average (default is 1).")
+			flags.StringVar(&params.CSVFormat, "csvformat", params.CSVFormat, "Must be either 'long' or 'wide'.  Default is 'long'.")
+			flags.StringVar(&params.GapPolicy, "gappolicy", params.GapPolicy, gapPolicyUsage)
+			flags.DurationVar(&params.ChurnInterval, "interval", params.ChurnInterval, intervalUsage)
+			flags.StringVar(&params.Detector, "detector", params.Detector, detectorUsage)
+			flags.StringVar(&params.ChurnConfig, "churnconfig", params.ChurnConfig, churnConfigUsage)
+		},
+		Enable: func(params *CmdLineParams) error {
+			params.Churn = true
+			return nil
+		},
+	},
+	{
+		Name:        "uptime",
+		Description: "Create an image that visualises relay uptimes.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.StringVar(&params.InputData, "image", params.InputData, "File name of the JPEG image to write.  Defaults to "+defaultUptimeImage+".")
+		},
+		Enable: func(params *CmdLineParams) error {
+			if params.InputData == "" {
+				params.InputData = defaultUptimeImage
+			}
+			params.Uptime = true
+			return nil
+		},
+	},
+	{
+		Name:        "matrix",
+		Description: "Calculate the O(n^2) similarity matrix for all relay descriptors, or for the relays in a regular or microdescriptor consensus.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.Float64Var(&params.Threshold, "threshold", params.Threshold, "Only report relay pairs whose similarity score is at or above the given threshold.")
+			flags.BoolVar(&params.Visualise, "visualise", params.Visualise, "Write DOT code to stdout, that can then be turned into a diagram using Graphviz.")
+			flags.BoolVar(&params.NoFamily, "nofamily", params.NoFamily, "Don't interpret MyFamily relationships as Sybils.")
+		},
+		Enable: func(params *CmdLineParams) error {
+			params.Matrix = true
+			return nil
+		},
+	},
+	{
+		Name:        "neighbours",
+		Description: "Find the nearest neighbours of a reference relay.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.IntVar(&params.Neighbours, "n", 10, "Number of nearest neighbours to find.")
+			flags.StringVar(&params.ReferenceRelay, "referencerelay", params.ReferenceRelay, "Fingerprint of the relay whose neighbours we are looking for.")
+			flags.StringVar(&params.SearchAlg, "search", params.SearchAlg, "Search algorithm to use.  Must be 'vptree' or 'linear'.  Default is 'linear'.")
+		},
+		Enable: func(params *CmdLineParams) error {
+			if params.ReferenceRelay == "" {
+				return errors.New("No reference relay given.  Please use the -referencerelay switch.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "fingerprints",
+		Description: "Find IP addresses whose relays changed their fingerprint.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.IntVar(&params.MinFprs, "minfingerprints", params.MinFprs, "In -watch mode, or if alerts are configured, report an IP address as soon as its relays used this many unique fingerprints (default is 2).")
+		},
+		Enable: func(params *CmdLineParams) error {
+			params.Fingerprints = true
+			return nil
+		},
+	},
+	{
+		Name:        "contrib",
+		Description: "Determine the bandwidth contribution of relays in the given IP address blocks.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.StringVar(&params.InputData, "netblocks", params.InputData, "File containing IP address blocks, one per line.  Lines starting with '#' name the subsequent blocks.")
+		},
+		Enable: func(params *CmdLineParams) error {
+			if params.InputData == "" {
+				return errors.New("Need a file containing IP address blocks, one per line.  Use -netblocks switch.")
+			}
+			params.Contrib = true
+			return nil
+		},
+	},
+	{
+		Name:        "bwfraction",
+		Description: "Determine which relays provide the given fraction of the total bandwidth.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.Float64Var(&params.BwFraction, "fraction", params.BwFraction, "Bandwidth fraction in [0,1].")
+		},
+		Enable: func(params *CmdLineParams) error {
+			if params.BwFraction == -1 {
+				return errors.New("No bandwidth fraction given.  Please use the -fraction switch.")
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "print",
+		Description: "Print all router statuses and descriptors.",
+		AddFlags:    func(flags *flag.FlagSet, params *CmdLineParams) {},
+		Enable: func(params *CmdLineParams) error {
+			params.PrintFiles = true
+			return nil
+		},
+	},
+	{
+		Name:        "printsome",
+		Description: "Print the router statuses and descriptors of the given relays.",
+		AddFlags: func(flags *flag.FlagSet, params *CmdLineParams) {
+			flags.StringVar(&params.InputData, "fingerprints", params.InputData, "File containing newline-separated relay fingerprints.")
+		},
+		Enable: func(params *CmdLineParams) error {
+			if params.InputData == "" {
+				return errors.New("Need a file containing newline-separated relay fingerprints.  Use -fingerprints switch.")
+			}
+			params.PrintSome = true
+			return nil
+		},
+	},
+	{
+		Name:        "fetch",
+		Description: fetchDescription,
+		Run:         runFetch,
+	},
+}
+
+// findCommand returns the command with the given name, or nil if there is no
+// such command.
+func findCommand(name string) *Command {
+
+	for _, command := range Commands {
+		if command.Name == name {
+			return command
+		}
+	}
+
+	return nil
+}
+
+// printUsage prints how to use sybilhunter, including the list of commands,
+// followed by the flags in the given flag set.
+func printUsage(flags *flag.FlagSet) {
+
+	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [FLAGS]\n\nCommands:\n", toolName)
+	for _, command := range Commands {
+		fmt.Fprintf(os.Stderr, "  %-14s%s\n", command.Name, command.Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"%s COMMAND -help\" for the flags of a command.\n", toolName)
+	fmt.Fprintf(os.Stderr, "\nThe following flags predate commands, and are kept for compatibility:\n")
+	flags.PrintDefaults()
+}
+
+// disableAnalyses turns off all analyses in the given parameters.
+func disableAnalyses(params *CmdLineParams) {
+
+	params.Uptime = false
+	params.Contrib = false
+	params.Churn = false
+	params.PrintFiles = false
+	params.PrintSome = false
+	params.Fingerprints = false
+	params.Matrix = false
+	params.BwFraction = -1
+	params.Neighbours = -1
+}
+
+// ParseCommand parses the given arguments for the given command and returns a
+// CmdLineParams struct.  If the given CmdLineParams struct is not nil, its
+// content is overwritten with the given arguments.
+func ParseCommand(command *Command, arguments []string, params *CmdLineParams) *CmdLineParams {
+
+	if params == nil {
+		params = NewCmdLineParams()
+	}
+
+	name := fmt.Sprintf("%s %s", toolName, command.Name)
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [FLAGS]\n\n%s\n\nFlags:\n", name, command.Description)
+		flags.PrintDefaults()
+	}
+	addCommonFlags(flags, params)
+
+	// The configuration file may have turned on analyses using top-level
+	// flags.  A command only runs its own analysis.
+	disableAnalyses(params)
+	command.AddFlags(flags, params)
+
+	err := flags.Parse(arguments)
+	if err != nil {
+		log.Fatalf("Aborting because couldn't parse arguments: %s\n", err)
+	}
+
+	if flags.NArg() > 0 {
+		log.Fatalf("Unexpected arguments %q.  Did you forget a switch?", flags.Args())
+	}
+
+	if err := command.Enable(params); err != nil {
+		log.Fatalln(err)
+	}
+
+	return params
+}
@@ -0,0 +1,124 @@
+// Package contrib determines the bandwidth contribution of relays in given
+// netblocks, e.g., those of cloud providers.
+package contrib
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// NetblockMap maps a network name to a set of netblocks.
+type NetblockMap map[string][]*net.IPNet
+
+// Contribution keeps track of the bandwidth contribution of a network name.
+type Contribution map[string]uint64
+
+// Result holds the number and bandwidth of relays in a consensus, and how many
+// of them are in the netblocks.
+type Result struct {
+	CloudCount uint64
+	TotalCount uint64
+	CloudBw    uint64
+	TotalBw    uint64
+}
+
+// Fraction returns the fraction of bandwidth that is contributed by relays in
+// the netblocks.
+func (r Result) Fraction() float32 {
+
+	return float32(r.CloudBw) / float32(r.TotalBw)
+}
+
+// Contains returns true if the given netblock map contains the given IP
+// address.  The lookup is very inefficient, but has to do for now.
+func (nbm NetblockMap) Contains(ipAddr net.IP) bool {
+
+	for _, netblocks := range nbm {
+		for _, netblock := range netblocks {
+			if netblock.Contains(ipAddr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ParseNetblocks parses the given file name, and extracts and returns all
+// netblocks contained within.  Lines starting with "#" are interpreted as
+// netblock names.  All subsequent netblocks are stored under that name.
+func ParseNetblocks(fileName string) (NetblockMap, error) {
+
+	log.Printf("Attempting to parse file %s.", fileName)
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	netblocks := make(NetblockMap)
+	netname := "default"
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// New netblock name.
+		if strings.HasPrefix(line, "#") {
+			netname = strings.TrimSpace(line[1:])
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fileName, err)
+		}
+		netblocks[netname] = append(netblocks[netname], ipnet)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for netname, netblocks := range netblocks {
+		log.Printf("Parsed %d IP address blocks for %s.\n", len(netblocks), netname)
+	}
+
+	return netblocks, nil
+}
+
+// Determine determines the bandwidth contribution made by relays in the given
+// consensus whose IP address is in the given netblocks.  The given
+// contribution is updated with the bandwidth of every netblock's relays.
+func Determine(consensus *tor.Consensus, netblockMap NetblockMap, contribution Contribution) Result {
+
+	var result Result
+
+	// Iterate over single relays in consensus.
+	for _, getStatus := range consensus.RouterStatuses {
+
+		status := getStatus()
+		result.TotalBw += status.Bandwidth
+		result.TotalCount += 1
+
+		for netname, netblocks := range netblockMap {
+			for _, netblock := range netblocks {
+				// Is the relay cloud-hosted?
+				if netblock.Contains(status.Address.IPv4Address) {
+					contribution[netname] += status.Bandwidth
+					result.CloudBw += status.Bandwidth
+					result.CloudCount += 1
+				}
+			}
+		}
+	}
+
+	return result
+}
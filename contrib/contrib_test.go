@@ -0,0 +1,98 @@
+// Test the bandwidth contribution of relays in netblocks.
+
+package contrib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// writeNetblocks writes the given netblocks to a temporary file, and returns
+// the file's name.
+func writeNetblocks(t *testing.T, content string) string {
+
+	fd, err := ioutil.TempFile("", "netblocks_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	t.Cleanup(func() { os.Remove(fd.Name()) })
+
+	if _, err := fd.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return fd.Name()
+}
+
+func TestParseNetblocks(t *testing.T) {
+
+	tests := []struct {
+		content string
+		counts  map[string]int
+		valid   bool
+	}{
+		{"192.0.2.0/24\n", map[string]int{"default": 1}, true},
+		{"# cloud\n192.0.2.0/24\n198.51.100.0/24\n# other\n2001:db8::/32\n",
+			map[string]int{"cloud": 2, "other": 1}, true},
+		{"# cloud\n192.0.2.1\n", nil, false},
+	}
+
+	for _, test := range tests {
+		netblocks, err := ParseNetblocks(writeNetblocks(t, test.content))
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error is %v, but expected valid: %t.", test.content, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+
+		if len(netblocks) != len(test.counts) {
+			t.Errorf("%q: got %d netblock names, but expected %d.", test.content, len(netblocks), len(test.counts))
+		}
+		for name, count := range test.counts {
+			if len(netblocks[name]) != count {
+				t.Errorf("%q: %s has %d netblocks, but expected %d.", test.content, name, len(netblocks[name]), count)
+			}
+		}
+	}
+}
+
+func TestDetermine(t *testing.T) {
+
+	_, cloud, _ := net.ParseCIDR("192.0.2.0/24")
+	netblocks := NetblockMap{"cloud": {cloud}}
+
+	consensus := tor.NewConsensus()
+	for _, relay := range []struct {
+		fingerprint tor.Fingerprint
+		address     string
+		bandwidth   uint64
+	}{
+		{"A", "192.0.2.1", 10},
+		{"B", "198.51.100.1", 30},
+	} {
+		status := &tor.RouterStatus{Fingerprint: relay.fingerprint, Bandwidth: relay.bandwidth}
+		status.Address.IPv4Address = net.ParseIP(relay.address)
+		consensus.Set(relay.fingerprint, status)
+	}
+
+	contribution := make(Contribution)
+	result := Determine(consensus, netblocks, contribution)
+
+	expected := Result{CloudCount: 1, TotalCount: 2, CloudBw: 10, TotalBw: 40}
+	if result != expected {
+		t.Errorf("Result is %+v, but expected %+v.", result, expected)
+	}
+	if result.Fraction() != 0.25 {
+		t.Errorf("Fraction is %f, but expected 0.25.", result.Fraction())
+	}
+	if contribution["cloud"] != 10 {
+		t.Errorf("Contribution of cloud is %d, but expected 10.", contribution["cloud"])
+	}
+}
@@ -0,0 +1,164 @@
+// Extract time stamps from file names and document headers.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of bytes at the beginning of a document that we search for a
+	// time stamp.
+	timestampPeekSize = 8192
+)
+
+var (
+	// CollecTor's file names for consensuses, votes, microdescriptor
+	// consensuses, and the descriptor files in "recent" start with a time
+	// stamp, e.g., 2015-07-31-15-00-00-consensus or
+	// 2015-07-31-15-05-00-server-descriptors.
+	collectorTimestamp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2})(-|$)`)
+
+	// Bridge network statuses are named, e.g.,
+	// 20150731-153712-4A0CCD2DDC7995083D73F5D667100C8A5831F16D.
+	bridgeTimestamp = regexp.MustCompile(`^(\d{8}-\d{6})-`)
+
+	// Monthly archives contain directories such as server-descriptors-2015-08
+	// or consensuses-2015-08.  Descriptors below these directories are named
+	// by their digest, so all we know is the month.
+	monthlyDirectory = regexp.MustCompile(`-(\d{4}-\d{2})$`)
+)
+
+// dateLayouts holds the date formats we accept on the command line, and the
+// time span that a date in the respective format covers.
+var dateLayouts = []struct {
+	layout string
+	span   time.Duration
+}{
+	{"2006-01-02T15", time.Hour},
+	{"2006-01-02", 24 * time.Hour},
+}
+
+// parseDate extracts and returns the date that is in the given date string.
+// The date has either day or hour precision.  In addition to the date, the
+// function returns the time span that the given date covers, i.e., a day or
+// an hour.
+func parseDate(dateString string) (time.Time, time.Duration, error) {
+
+	for _, format := range dateLayouts {
+		date, err := time.Parse(format.layout, dateString)
+		if err == nil {
+			return date, format.span, nil
+		}
+	}
+
+	return time.Time{}, 0, fmt.Errorf("Given date \"%s\" invalid.  We expect the format YYYY-MM-DD or YYYY-MM-DDTHH.", dateString)
+}
+
+// filenameTimestamp extracts the time that's part of CollecTor's file names,
+// e.g., 2015-07-31-15-00-00-consensus.  The boolean is false if the file name
+// contains no time stamp.
+func filenameTimestamp(fileName string) (time.Time, bool) {
+
+	base := path.Base(fileName)
+
+	if match := collectorTimestamp.FindStringSubmatch(base); match != nil {
+		date, err := time.Parse("2006-01-02-15-04-05", match[1])
+		return date, err == nil
+	}
+
+	if match := bridgeTimestamp.FindStringSubmatch(base); match != nil {
+		date, err := time.Parse("20060102-150405", match[1])
+		return date, err == nil
+	}
+
+	return time.Time{}, false
+}
+
+// filenameMonth extracts the month of the monthly archive directory that the
+// given file is in, e.g., server-descriptors-2015-08/0/0/00a1...  The boolean
+// is false if the file is not in such a directory.
+func filenameMonth(fileName string) (time.Time, bool) {
+
+	for _, directory := range strings.Split(path.Dir(fileName), "/") {
+		if match := monthlyDirectory.FindStringSubmatch(directory); match != nil {
+			month, err := time.Parse("2006-01", match[1])
+			if err == nil {
+				return month, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// documentTimestamp searches the given beginning of a document for a
+// "valid-after" or "published" line and returns the time stamp it contains.
+// Votes and microdescriptor consensuses list "published" first, but their
+// "valid-after" time stamp is the one that dates them, so it's preferred.
+// Files containing several descriptors are represented by the first
+// descriptor's time stamp.  If neither line is found, the zero time is
+// returned.
+func documentTimestamp(header []byte) time.Time {
+
+	var published time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(header))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "valid-after "):
+			if date, err := parseTimestamp(line[len("valid-after "):]); err == nil {
+				return date
+			}
+		case strings.HasPrefix(line, "published ") && published.IsZero():
+			if date, err := parseTimestamp(line[len("published "):]); err == nil {
+				published = date
+			}
+		}
+	}
+
+	return published
+}
+
+// parseTimestamp parses the given time stamp of a "valid-after" or
+// "published" line.
+func parseTimestamp(value string) (time.Time, error) {
+
+	return time.Parse("2006-01-02 15:04:05", strings.TrimSpace(value))
+}
+
+// fileInRange determines if the given document is in the inclusive date range
+// [startDate, endDate].  We first try to extract the document's time stamp
+// from its file name (and all files from CollecTor have one) because that lets
+// us discard irrelevant files significantly faster than by parsing their
+// content.  Failing that, we look for a time stamp in the given beginning of
+// the document.  If we cannot find a time stamp, fileInRange returns true, so
+// the file is parsed.
+func fileInRange(fileName string, header []byte, startDate, endDate time.Time) bool {
+
+	inRange := func(date time.Time) bool {
+		return !date.Before(startDate) && !date.After(endDate)
+	}
+
+	if date, ok := filenameTimestamp(fileName); ok {
+		return inRange(date)
+	}
+
+	if date := documentTimestamp(header); !date.IsZero() {
+		return inRange(date)
+	}
+
+	// Descriptors in monthly archives are in range if their month overlaps
+	// with the date range.
+	if month, ok := filenameMonth(fileName); ok {
+		return !month.After(endDate) && month.AddDate(0, 1, 0).After(startDate)
+	}
+
+	return true
+}
@@ -0,0 +1,50 @@
+// Test determining the dates of documents.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDocumentTimestamp(t *testing.T) {
+
+	validAfter := time.Date(2015, 8, 1, 1, 0, 0, 0, time.UTC)
+	published := time.Date(2015, 8, 1, 0, 50, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		header   string
+		expected time.Time
+	}{
+		{
+			name:     "consensus",
+			header:   "network-status-version 3\nvalid-after 2015-08-01 01:00:00\n",
+			expected: validAfter,
+		},
+		{
+			// Votes list the time they were published first.
+			name: "vote",
+			header: "network-status-version 3\nvote-status vote\npublished 2015-08-01 00:50:00\n" +
+				"valid-after 2015-08-01 01:00:00\n",
+			expected: validAfter,
+		},
+		{
+			name: "descriptors",
+			header: "router a 192.0.2.1 9001 0 0\npublished 2015-08-01 00:50:00\n" +
+				"router b 192.0.2.2 9001 0 0\npublished 2015-08-01 00:55:00\n",
+			expected: published,
+		},
+		{
+			name:     "no time stamp",
+			header:   "network-status-version 3\n",
+			expected: time.Time{},
+		},
+	}
+
+	for _, test := range tests {
+		if date := documentTimestamp([]byte(test.header)); !date.Equal(test.expected) {
+			t.Errorf("%s: time stamp is %s, but expected %s.", test.name, date, test.expected)
+		}
+	}
+}
@@ -0,0 +1,595 @@
+// An indexed, cached store of router descriptors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+const (
+	// Version of the on-disk index format.  Indexes of other versions are
+	// rebuilt.
+	descIndexVersion = 2
+
+	// Name of the index file in the index directory.
+	descIndexFile = "index.gob"
+
+	// Every descriptor we hand to zoossh's parser starts with this
+	// annotation, so the parser knows what it's dealing with.
+	descAnnotation = "@type server-descriptor 1.0\n"
+)
+
+// splitDescriptors passes every server descriptor in the given reader to the
+// given callback, together with the descriptor's hex-encoded digest,
+// publication time, and offset in the reader.  The digest is the SHA-1 hash
+// over the descriptor from "router" up to and including "router-signature",
+// which is what consensuses refer to.
+func splitDescriptors(r io.Reader, callback func(string, time.Time, int64, []byte) error) error {
+
+	var desc bytes.Buffer
+	var published time.Time
+	var offset, descOffset int64
+	var digestEnd int
+	inDesc := false
+
+	br := bufio.NewReader(r)
+	for {
+		rawLine, err := br.ReadBytes('\n')
+		if len(rawLine) > 0 {
+			line := strings.TrimRight(string(rawLine), "\r\n")
+			if strings.HasPrefix(line, "router ") {
+				desc.Reset()
+				published, digestEnd, inDesc = time.Time{}, 0, true
+				descOffset = offset
+			}
+			offset += int64(len(rawLine))
+
+			if inDesc {
+				desc.Write(rawLine)
+				switch {
+				case strings.HasPrefix(line, "published "):
+					published, _ = time.Parse("2006-01-02 15:04:05", strings.TrimPrefix(line, "published "))
+				case line == "router-signature":
+					digestEnd = desc.Len()
+				case line == "-----END SIGNATURE-----" && digestEnd > 0:
+					inDesc = false
+					if !published.IsZero() {
+						sum := sha1.Sum(desc.Bytes()[:digestEnd])
+						if err := callback(hex.EncodeToString(sum[:]), published, descOffset, desc.Bytes()); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// descSource is a file in the descriptor directory whose descriptors are in
+// the index.  Descriptors in plain files are read from the file itself.
+// Descriptors in compressed files and archives can't be accessed at random, so
+// we copy them to a blob file in the index directory, unless a plain file or
+// an unpacked monthly archive already holds them.  Archive is true for
+// compressed files and archives.  Blob is empty if no descriptor had to be
+// copied.
+type descSource struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Archive bool
+	Blob    string
+}
+
+// descLocation is where a descriptor can be found: in the given source file,
+// or its blob file, at the given offset.
+type descLocation struct {
+	Source int
+	Offset int64
+	Length int
+}
+
+// descIndex is the on-disk index that maps descriptor digests to locations.
+type descIndex struct {
+	Version   int
+	Sources   []descSource
+	Locations map[string]descLocation
+}
+
+// cacheEntry is a loaded descriptor, or the error we got trying to load it.
+type cacheEntry struct {
+	digest string
+	desc   *tor.RouterDescriptor
+	err    error
+}
+
+// lruCache is a fixed-size cache of loaded descriptors that evicts the least
+// recently used descriptor once it's full.  It's not safe for concurrent use.
+type lruCache struct {
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// newLRUCache returns a cache that holds up to the given number of
+// descriptors.
+func newLRUCache(size int) *lruCache {
+
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the cache entry for the given digest, or nil if there is none.
+func (c *lruCache) get(digest string) *cacheEntry {
+
+	element, ok := c.entries[digest]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+
+	return element.Value.(*cacheEntry)
+}
+
+// add adds the given entry to the cache.
+func (c *lruCache) add(entry *cacheEntry) {
+
+	if c.size <= 0 {
+		return
+	}
+
+	if element, ok := c.entries[entry.digest]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[entry.digest] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).digest)
+	}
+}
+
+// unpackedDescriptorPath returns where the descriptor with the given digest,
+// which was published at the given time, is in an unpacked monthly archive
+// below the given directory, e.g., server-descriptors-2015-08/a/b/ab01...
+func unpackedDescriptorPath(dir, digest string, published time.Time) string {
+
+	return filepath.Join(dir, "server-descriptors-"+published.Format("2006-01"),
+		digest[0:1], digest[1:2], digest)
+}
+
+// DescriptorStore loads router descriptors from a descriptor directory.  It
+// indexes the descriptors in concatenated descriptor files, e.g., CollecTor's
+// "recent" files, and in archives, e.g., server-descriptors-2015-08.tar.xz, so
+// every descriptor can be found by its digest without reading other files.
+// Unpacked monthly archives, e.g., server-descriptors-2015-08/, need no index.
+// Recently used descriptors are cached in memory.  A nil DescriptorStore has
+// no descriptors.  DescriptorStore is safe for concurrent use, and implements
+// the neighbours.DescriptorLoader interface.
+type DescriptorStore struct {
+	sync.Mutex
+	dir      string
+	indexDir string
+	index    *descIndex
+	cache    *lruCache
+}
+
+// OpenDescriptorStore returns a descriptor store for the given descriptor
+// directory.  The index is kept in the given index directory, and updated if
+// files in the descriptor directory were added or changed since it was built.
+// Up to cacheSize descriptors are cached in memory.
+func OpenDescriptorStore(dir, indexDir string, cacheSize int) (*DescriptorStore, error) {
+
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &DescriptorStore{dir: dir, indexDir: indexDir, cache: newLRUCache(cacheSize)}
+	if err := store.updateIndex(); err != nil {
+		return nil, fmt.Errorf("Couldn't index descriptors in %s: %s", dir, err)
+	}
+
+	return store, nil
+}
+
+// readIndex reads the on-disk index.  If there is none, or it has a different
+// version, an empty index is returned.
+func (store *DescriptorStore) readIndex() (*descIndex, error) {
+
+	empty := &descIndex{Version: descIndexVersion, Locations: make(map[string]descLocation)}
+
+	fd, err := os.Open(filepath.Join(store.indexDir, descIndexFile))
+	if os.IsNotExist(err) {
+		return empty, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	index := &descIndex{}
+	if err := gob.NewDecoder(bufio.NewReader(fd)).Decode(index); err != nil || index.Version != descIndexVersion {
+		log.Printf("Discarding outdated or corrupt descriptor index in %s.\n", store.indexDir)
+		return empty, nil
+	}
+
+	return index, nil
+}
+
+// writeIndex atomically replaces the on-disk index with the given index.
+func (store *DescriptorStore) writeIndex(index *descIndex) error {
+
+	tmpFile, err := ioutil.TempFile(store.indexDir, descIndexFile+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	w := bufio.NewWriter(tmpFile)
+	if err := gob.NewEncoder(w).Encode(index); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), filepath.Join(store.indexDir, descIndexFile))
+}
+
+// listSources returns the files in the descriptor directory that we index.
+// The index directory and unpacked monthly archives are skipped.
+func (store *DescriptorStore) listSources() ([]descSource, error) {
+
+	indexDir, _ := filepath.Abs(store.indexDir)
+
+	var sources []descSource
+	err := filepath.Walk(store.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			absPath, _ := filepath.Abs(path)
+			if absPath == indexDir || monthlyDirectory.MatchString(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			sources = append(sources, descSource{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+
+	return sources, err
+}
+
+// updateIndex reads the on-disk index, indexes the files that are new or
+// changed since the index was built, and writes the index back to disk.
+func (store *DescriptorStore) updateIndex() error {
+
+	oldIndex, err := store.readIndex()
+	if err != nil {
+		return err
+	}
+
+	sources, err := store.listSources()
+	if err != nil {
+		return err
+	}
+
+	// Map unchanged sources in the old index to their position in the new
+	// index.  Their descriptors don't have to be indexed again.
+	unchanged := make(map[int]int)
+	isUnchanged := make(map[int]bool)
+	for i, source := range sources {
+		for j, oldSource := range oldIndex.Sources {
+			if oldSource.Path == source.Path && oldSource.Size == source.Size && oldSource.ModTime.Equal(source.ModTime) {
+				unchanged[j] = i
+				isUnchanged[i] = true
+				sources[i].Archive = oldSource.Archive
+				sources[i].Blob = oldSource.Blob
+				break
+			}
+		}
+	}
+
+	// Archives don't copy the descriptors that plain files hold, so they
+	// are indexed again once plain files were removed or changed.
+	plainChanged := false
+	for j, oldSource := range oldIndex.Sources {
+		if _, ok := unchanged[j]; !ok && !oldSource.Archive {
+			plainChanged = true
+			break
+		}
+	}
+	if plainChanged {
+		for j, i := range unchanged {
+			if sources[i].Archive {
+				delete(unchanged, j)
+				isUnchanged[i] = false
+			}
+		}
+	}
+
+	index := &descIndex{Version: descIndexVersion, Sources: sources, Locations: make(map[string]descLocation)}
+	for digest, location := range oldIndex.Locations {
+		if i, ok := unchanged[location.Source]; ok {
+			location.Source = i
+			index.Locations[digest] = location
+		}
+	}
+
+	for i := range sources {
+		if isUnchanged[i] {
+			continue
+		}
+		plain, err := isPlainFile(sources[i].Path)
+		if err != nil {
+			return err
+		}
+		sources[i].Archive = !plain
+	}
+
+	// Plain files are indexed first, so archives know which descriptors
+	// they don't have to copy.
+	added := 0
+	for _, archives := range []bool{false, true} {
+		for i := range sources {
+			if isUnchanged[i] || sources[i].Archive != archives {
+				continue
+			}
+			count, err := store.indexSource(index, i)
+			if err != nil {
+				return fmt.Errorf("%s: %s", sources[i].Path, err)
+			}
+			added += count
+		}
+	}
+
+	store.removeStaleBlobs(index)
+
+	if len(unchanged) != len(sources) || len(oldIndex.Sources) != len(sources) {
+		log.Printf("Indexed %d new descriptors in %s.  The index has %d descriptors.\n", added, store.dir, len(index.Locations))
+		if err := store.writeIndex(index); err != nil {
+			return err
+		}
+	}
+	store.index = index
+
+	return nil
+}
+
+// indexSource adds the descriptors in the source with the given position to
+// the given index, and returns how many descriptors it added.  Descriptors in
+// archives that a plain file or an unpacked monthly archive already holds
+// aren't added.
+func (store *DescriptorStore) indexSource(index *descIndex, position int) (int, error) {
+
+	source := &index.Sources[position]
+	count := 0
+
+	// Descriptors in plain files are read from where they are.
+	if !source.Archive {
+		fd, err := os.Open(source.Path)
+		if err != nil {
+			return 0, err
+		}
+		defer fd.Close()
+
+		err = splitDescriptors(fd, func(digest string, published time.Time, offset int64, desc []byte) error {
+			index.Locations[digest] = descLocation{position, offset, len(desc)}
+			count++
+			return nil
+		})
+		return count, err
+	}
+
+	// The remaining descriptors in compressed files and archives are copied
+	// to a blob file.
+	sum := sha1.Sum([]byte(source.Path))
+	source.Blob = hex.EncodeToString(sum[:]) + ".blob"
+	blobFile, err := os.Create(filepath.Join(store.indexDir, source.Blob))
+	if err != nil {
+		return 0, err
+	}
+	blob := bufio.NewWriter(blobFile)
+	var blobOffset int64
+
+	callback := func(name string, info os.FileInfo, r io.Reader) error {
+		if r == nil {
+			return nil
+		}
+		return splitDescriptors(r, func(digest string, published time.Time, offset int64, desc []byte) error {
+			if location, ok := index.Locations[digest]; ok && !index.Sources[location.Source].Archive {
+				return nil
+			}
+			if _, ok := store.findUnpacked(digest, published); ok {
+				return nil
+			}
+			if _, err := blob.Write(desc); err != nil {
+				return err
+			}
+			index.Locations[digest] = descLocation{position, blobOffset, len(desc)}
+			blobOffset += int64(len(desc))
+			count++
+			return nil
+		})
+	}
+	onError := func(name string, err error) error {
+		return err
+	}
+
+	err = walkArchiveData(source.Path, callback, onError)
+	if flushErr := blob.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := blobFile.Close(); err == nil {
+		err = closeErr
+	}
+	// An empty blob file is removed together with stale blob files.
+	if blobOffset == 0 {
+		source.Blob = ""
+	}
+
+	return count, err
+}
+
+// findUnpacked returns the path of the descriptor with the given digest, which
+// was published at the given time, if it's in an unpacked monthly archive,
+// either right in the descriptor directory, or in the directory that the
+// fetch command unpacks descriptors to.  The boolean is false if there is no
+// such file.
+func (store *DescriptorStore) findUnpacked(digest string, published time.Time) (string, bool) {
+
+	for _, dir := range []string{store.dir, filepath.Join(store.dir, descriptorStoreDir)} {
+		path := unpackedDescriptorPath(dir, digest, published)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// removeStaleBlobs removes blob files that no source in the given index refers
+// to anymore.
+func (store *DescriptorStore) removeStaleBlobs(index *descIndex) {
+
+	used := make(map[string]bool)
+	for _, source := range index.Sources {
+		if source.Blob != "" {
+			used[source.Blob] = true
+		}
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(store.indexDir, "*.blob"))
+	for _, blob := range blobs {
+		if !used[filepath.Base(blob)] {
+			os.Remove(blob)
+		}
+	}
+}
+
+// readDescriptor reads and parses the descriptor at the given location in the
+// given source.
+func (store *DescriptorStore) readDescriptor(source descSource, location descLocation) (*tor.RouterDescriptor, error) {
+
+	path := source.Path
+	if source.Blob != "" {
+		path = filepath.Join(store.indexDir, source.Blob)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	content := make([]byte, len(descAnnotation)+location.Length)
+	copy(content, descAnnotation)
+	if _, err := fd.ReadAt(content[len(descAnnotation):], location.Offset); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return parseDescriptor(path, content)
+}
+
+// parseDescriptor parses the given content, which holds a single annotated
+// router descriptor that was read from the given path.
+func parseDescriptor(path string, content []byte) (*tor.RouterDescriptor, error) {
+
+	objects, err := tor.ParseUnknown(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	descs, ok := objects.(*tor.RouterDescriptors)
+	if !ok {
+		return nil, fmt.Errorf("%s: no router descriptor found", path)
+	}
+	for _, getDesc := range descs.RouterDescriptors {
+		return getDesc(), nil
+	}
+
+	return nil, fmt.Errorf("%s: no router descriptor found", path)
+}
+
+// loadUnpacked reads and parses the descriptor in the given file of an
+// unpacked monthly archive.
+func loadUnpacked(path string) (*tor.RouterDescriptor, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, []byte(descAnnotation)) {
+		content = append([]byte(descAnnotation), content...)
+	}
+
+	return parseDescriptor(path, content)
+}
+
+// LoadDescriptor returns the router descriptor with the given digest, which was
+// published around the given time.  Descriptors that aren't in the index are
+// looked up in unpacked monthly archives.  Both descriptors and errors are
+// cached, so we don't look for missing descriptors over and over again.  The
+// store is only locked while we look at the cache, so descriptors are read and
+// parsed concurrently.
+func (store *DescriptorStore) LoadDescriptor(digest string, published time.Time) (*tor.RouterDescriptor, error) {
+
+	if store == nil {
+		return nil, errors.New("No descriptor directory given.  Please use the -descdir switch.")
+	}
+
+	digest = strings.ToLower(digest)
+
+	store.Lock()
+	cached := store.cache.get(digest)
+	store.Unlock()
+	if cached != nil {
+		return cached.desc, cached.err
+	}
+
+	// The index doesn't change once the store is open, so it needs no lock.
+	entry := &cacheEntry{digest: digest}
+	if location, ok := store.index.Locations[digest]; ok {
+		entry.desc, entry.err = store.readDescriptor(store.index.Sources[location.Source], location)
+	} else if path, ok := store.findUnpacked(digest, published); ok {
+		entry.desc, entry.err = loadUnpacked(path)
+	} else {
+		entry.desc, entry.err = tor.LoadDescriptorFromDigest(store.dir, digest, published)
+	}
+
+	store.Lock()
+	store.cache.add(entry)
+	store.Unlock()
+
+	return entry.desc, entry.err
+}
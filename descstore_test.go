@@ -0,0 +1,115 @@
+// Test indexing router descriptors in a descriptor directory.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// descriptorFixture returns a server descriptor of the relay with the given
+// nickname that was published on August 1, 2015, and the descriptor's digest.
+func descriptorFixture(nickname string) (string, string) {
+
+	desc := strings.Replace(serverDescriptor, "router sybil ", fmt.Sprintf("router %s ", nickname), 1)
+	signed := desc[:strings.Index(desc, "router-signature\n")+len("router-signature\n")]
+	sum := sha1.Sum([]byte(signed))
+
+	return desc, hex.EncodeToString(sum[:])
+}
+
+// indexedDigests returns the sorted digests in the given store's index that
+// are located in a blob file, and those located in plain files.
+func indexedDigests(store *DescriptorStore) ([]string, []string) {
+
+	var blob, plain []string
+	for digest, location := range store.index.Locations {
+		if store.index.Sources[location.Source].Blob != "" {
+			blob = append(blob, digest)
+		} else {
+			plain = append(plain, digest)
+		}
+	}
+	sort.Strings(blob)
+	sort.Strings(plain)
+
+	return blob, plain
+}
+
+func TestDescriptorStoreIndex(t *testing.T) {
+
+	unpacked, unpackedDigest := descriptorFixture("unpacked")
+	recent, recentDigest := descriptorFixture("recent")
+	archived, archivedDigest := descriptorFixture("archived")
+
+	dir := filepath.Dir(writeFixture(t, "server-descriptors-2015-08.tar.xz", makeXZ(t, makeTar(t, map[string]string{
+		"server-descriptors-2015-08/u": unpacked,
+		"server-descriptors-2015-08/r": recent,
+		"server-descriptors-2015-08/a": archived,
+	}))))
+
+	// The fetch command unpacked one descriptor, and a recent file holds
+	// another.
+	unpackedPath := unpackedDescriptorPath(filepath.Join(dir, descriptorStoreDir), unpackedDigest,
+		time.Date(2015, 8, 1, 0, 12, 34, 0, time.UTC))
+	if err := os.MkdirAll(filepath.Dir(unpackedPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(unpackedPath, []byte(descAnnotation+unpacked), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recentPath := filepath.Join(dir, "2015-08-01-00-00-00-server-descriptors")
+	if err := ioutil.WriteFile(recentPath, []byte(recent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	indexDir := filepath.Join(dir, ".sybilhunter-index")
+	store, err := OpenDescriptorStore(dir, indexDir, 10)
+	if err != nil {
+		t.Fatalf("Opening descriptor store failed: %s", err)
+	}
+
+	// Only the descriptor that's nowhere else is copied.
+	blob, plain := indexedDigests(store)
+	if len(blob) != 1 || blob[0] != archivedDigest {
+		t.Errorf("Blob holds %v, but expected %s.", blob, archivedDigest)
+	}
+	if len(plain) != 1 || plain[0] != recentDigest {
+		t.Errorf("Plain files hold %v, but expected %s.", plain, recentDigest)
+	}
+	if path, ok := store.findUnpacked(unpackedDigest, time.Date(2015, 8, 1, 0, 12, 34, 0, time.UTC)); !ok || path != unpackedPath {
+		t.Errorf("Unpacked descriptor found at %q, but expected %q.", path, unpackedPath)
+	}
+	blobs, _ := filepath.Glob(filepath.Join(indexDir, "*.blob"))
+	if len(blobs) != 1 {
+		t.Fatalf("Index directory holds %d blob files, but expected 1.", len(blobs))
+	}
+	if info, err := os.Stat(blobs[0]); err != nil || info.Size() != int64(len(archived)) {
+		t.Errorf("Blob file isn't %d bytes: %v, %v", len(archived), info, err)
+	}
+
+	// Once the recent file is gone, the archive is indexed again, and its
+	// copy of the recent descriptor is used.
+	if err := os.Remove(recentPath); err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenDescriptorStore(dir, indexDir, 10)
+	if err != nil {
+		t.Fatalf("Reopening descriptor store failed: %s", err)
+	}
+	blob, plain = indexedDigests(store)
+	expected := []string{archivedDigest, recentDigest}
+	sort.Strings(expected)
+	if len(plain) != 0 || !reflect.DeepEqual(blob, expected) {
+		t.Errorf("Blob holds %v and plain files %v, but expected %v and nothing.", blob, plain, expected)
+	}
+}
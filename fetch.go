@@ -0,0 +1,428 @@
+// Downloads CollecTor data into a local store.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCollectorURL = "https://collector.torproject.org"
+
+	// The directory below the store that holds unpacked server descriptors,
+	// laid out as expected by -descdir.
+	descriptorStoreDir = "descriptors"
+
+	// The time format of time stamps in CollecTor's index.
+	collectorTimeLayout = "2006-01-02 15:04"
+)
+
+// collectorTypes maps the descriptor types that we can fetch to their
+// directories below CollecTor's "archive" and "recent" directories.
+var collectorTypes = map[string]string{
+	"consensuses":        "relay-descriptors/consensuses",
+	"server-descriptors": "relay-descriptors/server-descriptors",
+}
+
+// archiveMonth matches the month in the file names of CollecTor's monthly
+// archives, e.g., consensuses-2015-08.tar.xz.
+var archiveMonth = regexp.MustCompile(`-(\d{4}-\d{2})\.tar`)
+
+// collectorFile is a file in CollecTor's index.
+type collectorFile struct {
+	Path           string `json:"path"`
+	Size           int64  `json:"size"`
+	LastModified   string `json:"last_modified"`
+	FirstPublished string `json:"first_published"`
+	LastPublished  string `json:"last_published"`
+	SHA256         string `json:"sha256"`
+}
+
+// collectorDirectory is a directory in CollecTor's index.
+type collectorDirectory struct {
+	Path        string               `json:"path"`
+	Directories []collectorDirectory `json:"directories"`
+	Files       []collectorFile      `json:"files"`
+}
+
+// collectorIndex is CollecTor's index of all the files it serves, as found in
+// /index/index.json.
+type collectorIndex struct {
+	IndexCreated string               `json:"index_created"`
+	Path         string               `json:"path"`
+	Directories  []collectorDirectory `json:"directories"`
+	Files        []collectorFile      `json:"files"`
+}
+
+// lookup returns the directory with the given slash-separated path, or nil if
+// the index has no such directory.
+func (index *collectorIndex) lookup(dirPath string) *collectorDirectory {
+
+	dir := &collectorDirectory{Directories: index.Directories, Files: index.Files}
+	for _, name := range strings.Split(dirPath, "/") {
+		var next *collectorDirectory
+		for i := range dir.Directories {
+			if dir.Directories[i].Path == name {
+				next = &dir.Directories[i]
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		dir = next
+	}
+
+	return dir
+}
+
+// timeSpan returns the time span that the documents in the given file cover.
+// We use the publication times in the index if CollecTor provides them, and
+// otherwise the time stamp or month in the file name.  The boolean is false if
+// the time span is unknown.
+func (file *collectorFile) timeSpan() (time.Time, time.Time, bool) {
+
+	first, err1 := time.Parse(collectorTimeLayout, file.FirstPublished)
+	last, err2 := time.Parse(collectorTimeLayout, file.LastPublished)
+	if err1 == nil && err2 == nil {
+		return first, last, true
+	}
+
+	if date, ok := filenameTimestamp(file.Path); ok {
+		return date, date, true
+	}
+
+	if match := archiveMonth.FindStringSubmatch(file.Path); match != nil {
+		month, err := time.Parse("2006-01", match[1])
+		if err == nil {
+			return month, month.AddDate(0, 1, 0).Add(-time.Nanosecond), true
+		}
+	}
+
+	return time.Time{}, time.Time{}, false
+}
+
+// Fetcher mirrors CollecTor files into a local store.  The store has the same
+// layout as CollecTor, e.g., <store>/recent/relay-descriptors/consensuses/,
+// so these directories can be used with -data.  In addition, server
+// descriptors are unpacked into <store>/descriptors/, which can be used with
+// -descdir.
+type Fetcher struct {
+	BaseURL   string
+	Store     string
+	Types     []string
+	Archive   bool
+	Recent    bool
+	StartDate time.Time
+	EndDate   time.Time
+	Client    *http.Client
+}
+
+// get sends a GET request for the given path below the CollecTor base URL.
+func (f *Fetcher) get(ctx context.Context, urlPath string) (*http.Response, error) {
+
+	url := strings.TrimSuffix(f.BaseURL, "/") + "/" + strings.TrimPrefix(urlPath, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", toolName, version))
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// fetchIndex downloads and decodes CollecTor's index.
+func (f *Fetcher) fetchIndex(ctx context.Context) (*collectorIndex, error) {
+
+	resp, err := f.get(ctx, "index/index.json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	index := &collectorIndex{}
+	if err := json.NewDecoder(resp.Body).Decode(index); err != nil {
+		return nil, fmt.Errorf("Couldn't decode CollecTor index: %s", err)
+	}
+	log.Printf("Fetched CollecTor index created at %s.\n", index.IndexCreated)
+
+	return index, nil
+}
+
+// wanted returns true if the given file is in the date range, and not yet in
+// the store.
+func (f *Fetcher) wanted(file *collectorFile, localPath string) bool {
+
+	if first, last, ok := file.timeSpan(); ok {
+		if last.Before(f.StartDate) || first.After(f.EndDate) {
+			return false
+		}
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return true
+	}
+
+	return info.Size() != file.Size
+}
+
+// download fetches the given file to the given local path, verifies its size
+// and digest, and then passes the downloaded file to the given function before
+// it's moved into place.  Partially downloaded or unpacked files thus don't
+// end up in the store.
+func (f *Fetcher) download(ctx context.Context, file *collectorFile, localPath string, unpack func(string) error) error {
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	resp, err := f.get(ctx, file.Path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(localPath), ".fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, digest), resp.Body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", file.Path, err)
+	}
+
+	if err := verifyDownload(file, size, digest); err != nil {
+		return err
+	}
+
+	if unpack != nil {
+		if err := unpack(tmpFile.Name()); err != nil {
+			return fmt.Errorf("%s: %s", file.Path, err)
+		}
+	}
+
+	return os.Rename(tmpFile.Name(), localPath)
+}
+
+// verifyDownload compares the given size and SHA-256 digest of a downloaded
+// file to what CollecTor's index says.  Older indexes have no digests, so we
+// can only check the size.
+func verifyDownload(file *collectorFile, size int64, digest hash.Hash) error {
+
+	if size != file.Size {
+		return fmt.Errorf("%s: expected %d bytes, but got %d", file.Path, file.Size, size)
+	}
+
+	if file.SHA256 == "" {
+		return nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(file.SHA256)
+	if err != nil {
+		return fmt.Errorf("%s: invalid digest in index: %s", file.Path, err)
+	}
+	if !bytes.Equal(expected, digest.Sum(nil)) {
+		return fmt.Errorf("%s: SHA-256 digest mismatch", file.Path)
+	}
+
+	return nil
+}
+
+// storeDescriptors unpacks all server descriptors in the given file, which may
+// be an archive, into the store's descriptor directory.  Every descriptor ends
+// up in its own file, e.g., server-descriptors-2015-08/a/b/ab01..., which is
+// where -descdir looks for it.
+func (f *Fetcher) storeDescriptors(fileName string) error {
+
+	count := 0
+	writeDescriptor := func(digest string, published time.Time, offset int64, desc []byte) error {
+		descPath := unpackedDescriptorPath(filepath.Join(f.Store, descriptorStoreDir), digest, published)
+		if _, err := os.Stat(descPath); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(descPath), 0755); err != nil {
+			return err
+		}
+		count++
+		content := append([]byte("@type server-descriptor 1.0\n"), desc...)
+		return ioutil.WriteFile(descPath, content, 0644)
+	}
+
+	callback := func(name string, info os.FileInfo, r io.Reader) error {
+		if r == nil {
+			return nil
+		}
+		return splitDescriptors(r, writeDescriptor)
+	}
+	onError := func(name string, err error) error {
+		return err
+	}
+
+	if err := walkArchiveData(fileName, callback, onError); err != nil {
+		return err
+	}
+	log.Printf("Unpacked %d new server descriptors.\n", count)
+
+	return nil
+}
+
+// Fetch downloads all files of the wanted types, sources, and date range that
+// are missing in the store.
+func (f *Fetcher) Fetch(ctx context.Context) error {
+
+	index, err := f.fetchIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	var sources []string
+	if f.Archive {
+		sources = append(sources, "archive")
+	}
+	if f.Recent {
+		sources = append(sources, "recent")
+	}
+
+	fetched := 0
+	for _, source := range sources {
+		for _, descType := range f.Types {
+			dirPath := path.Join(source, collectorTypes[descType])
+			dir := index.lookup(dirPath)
+			if dir == nil {
+				log.Printf("CollecTor index has no directory \"%s\".\n", dirPath)
+				continue
+			}
+
+			var unpack func(string) error
+			if descType == "server-descriptors" {
+				unpack = f.storeDescriptors
+			}
+
+			for i := range dir.Files {
+				file := &dir.Files[i]
+				file.Path = path.Join(dirPath, file.Path)
+				localPath := filepath.Join(f.Store, filepath.FromSlash(file.Path))
+				if !f.wanted(file, localPath) {
+					continue
+				}
+
+				log.Printf("Fetching \"%s\" (%d bytes).\n", file.Path, file.Size)
+				if err := f.download(ctx, file, localPath, unpack); err != nil {
+					return err
+				}
+				fetched++
+			}
+		}
+	}
+	log.Printf("Fetched %d files.\n", fetched)
+
+	for _, source := range sources {
+		for _, descType := range f.Types {
+			if descType == "server-descriptors" {
+				continue
+			}
+			log.Printf("Use -data %s for %s.\n",
+				filepath.Join(f.Store, source, filepath.FromSlash(collectorTypes[descType])), descType)
+		}
+	}
+	for _, descType := range f.Types {
+		if descType == "server-descriptors" {
+			log.Printf("Use -descdir %s for server descriptors.\n", filepath.Join(f.Store, descriptorStoreDir))
+		}
+	}
+
+	return nil
+}
+
+// runFetch parses the given arguments of the fetch command, and then fetches
+// CollecTor files into the store.
+func runFetch(ctx context.Context, arguments []string) error {
+
+	name := fmt.Sprintf("%s fetch", toolName)
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [FLAGS]\n\n%s\n\nFlags:\n", name, fetchDescription)
+		flags.PrintDefaults()
+	}
+
+	f := &Fetcher{Client: &http.Client{}}
+	var types, startDateStr, endDateStr string
+	flags.StringVar(&f.BaseURL, "collector", defaultCollectorURL, "Base URL of the CollecTor instance to fetch from.")
+	flags.StringVar(&f.Store, "store", "", "Directory to store the fetched files in.")
+	flags.StringVar(&types, "types", "consensuses,server-descriptors", "Comma-separated descriptor types to fetch.  Must be 'consensuses' or 'server-descriptors'.")
+	flags.BoolVar(&f.Archive, "archive", true, "Fetch monthly archives.")
+	flags.BoolVar(&f.Recent, "recent", true, "Fetch the files of the last few days.")
+	flags.StringVar(&startDateStr, "startdate", "", "Only fetch files with data from this date on, in format YYYY-MM-DD or YYYY-MM-DDTHH.")
+	flags.StringVar(&endDateStr, "enddate", "", "Only fetch files with data up to this date, in format YYYY-MM-DD or YYYY-MM-DDTHH.")
+
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments %q.  Did you forget a switch?", flags.Args())
+	}
+
+	if f.Store == "" {
+		return errors.New("No store directory given.  Please use the -store switch.")
+	}
+
+	for _, descType := range strings.Split(types, ",") {
+		if _, ok := collectorTypes[descType]; !ok {
+			return fmt.Errorf("Unknown descriptor type \"%s\".", descType)
+		}
+		f.Types = append(f.Types, descType)
+	}
+
+	if startDateStr != "" {
+		date, _, err := parseDate(startDateStr)
+		if err != nil {
+			return err
+		}
+		f.StartDate = date
+	}
+
+	f.EndDate = time.Now()
+	if endDateStr != "" {
+		date, span, err := parseDate(endDateStr)
+		if err != nil {
+			return err
+		}
+		f.EndDate = date.Add(span - time.Nanosecond)
+	}
+
+	return f.Fetch(ctx)
+}
@@ -0,0 +1,246 @@
+// Test fetching CollecTor data into a local store.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	consensusDir  = "recent/relay-descriptors/consensuses"
+	serverDescDir = "recent/relay-descriptors/server-descriptors"
+)
+
+// serverDescriptor is a server descriptor that was published on August 1, 2015.
+const serverDescriptor = `router sybil 192.0.2.1 9001 0 0
+published 2015-08-01 00:12:34
+router-signature
+-----BEGIN SIGNATURE-----
+AAAA
+-----END SIGNATURE-----
+`
+
+// newCollectorFile returns the index entry of a file with the given name and
+// content.
+func newCollectorFile(name string, content []byte) collectorFile {
+
+	digest := sha256.Sum256(content)
+
+	return collectorFile{
+		Path:   name,
+		Size:   int64(len(content)),
+		SHA256: base64.StdEncoding.EncodeToString(digest[:]),
+	}
+}
+
+// newCollector starts a CollecTor server that serves the given files, keyed by
+// their path, and an index of the given consensus and server descriptor files.
+// It returns the server and the paths that were requested.
+func newCollector(t *testing.T, files map[string][]byte, consensuses, serverDescs []collectorFile) (*httptest.Server, *[]string) {
+
+	index := collectorIndex{
+		IndexCreated: "2015-08-02 00:00",
+		Directories: []collectorDirectory{{
+			Path: "recent",
+			Directories: []collectorDirectory{{
+				Path: "relay-descriptors",
+				Directories: []collectorDirectory{
+					{Path: "consensuses", Files: consensuses},
+					{Path: "server-descriptors", Files: serverDescs},
+				},
+			}},
+		}},
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Couldn't encode index: %s", err)
+	}
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := strings.TrimPrefix(r.URL.Path, "/")
+		if urlPath == "index/index.json" {
+			w.Write(indexJSON)
+			return
+		}
+		content, ok := files[urlPath]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		requested = append(requested, urlPath)
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requested
+}
+
+// newTestFetcher returns a fetcher for the recent consensuses and server
+// descriptors of August 1, 2015.
+func newTestFetcher(t *testing.T, server *httptest.Server) *Fetcher {
+
+	store, err := ioutil.TempDir("", "sybilhunter-store-")
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(store) })
+
+	return &Fetcher{
+		BaseURL:   server.URL,
+		Store:     store,
+		Types:     []string{"consensuses", "server-descriptors"},
+		Recent:    true,
+		StartDate: time.Date(2015, 8, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2015, 8, 1, 23, 59, 59, 0, time.UTC),
+		Client:    server.Client(),
+	}
+}
+
+// storedFiles returns the sorted slash-separated paths of all files in the
+// given store.
+func storedFiles(t *testing.T, store string) []string {
+
+	var files []string
+	err := filepath.Walk(store, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			relPath, err := filepath.Rel(store, name)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't walk store: %s", err)
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+func TestFetch(t *testing.T) {
+
+	consensus := []byte("network-status-version 3\nvalid-after 2015-08-01 00:00:00\n")
+	descriptors := []byte(serverDescriptor)
+	files := map[string][]byte{
+		path.Join(consensusDir, "2015-07-31-23-00-00-consensus"):           consensus,
+		path.Join(consensusDir, "2015-08-01-00-00-00-consensus"):           consensus,
+		path.Join(consensusDir, "2015-08-02-00-00-00-consensus"):           consensus,
+		path.Join(serverDescDir, "2015-08-01-00-00-00-server-descriptors"): descriptors,
+	}
+	consensuses := []collectorFile{
+		newCollectorFile("2015-07-31-23-00-00-consensus", consensus),
+		newCollectorFile("2015-08-01-00-00-00-consensus", consensus),
+		newCollectorFile("2015-08-02-00-00-00-consensus", consensus),
+	}
+	serverDescs := []collectorFile{
+		newCollectorFile("2015-08-01-00-00-00-server-descriptors", descriptors),
+	}
+
+	server, requested := newCollector(t, files, consensuses, serverDescs)
+	fetcher := newTestFetcher(t, server)
+	if err := fetcher.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+
+	// Only the files of August 1 are in the date range.
+	expectedRequests := []string{
+		path.Join(consensusDir, "2015-08-01-00-00-00-consensus"),
+		path.Join(serverDescDir, "2015-08-01-00-00-00-server-descriptors"),
+	}
+	if !reflect.DeepEqual(*requested, expectedRequests) {
+		t.Errorf("Fetched %v, but expected %v.", *requested, expectedRequests)
+	}
+
+	signed := serverDescriptor[:strings.Index(serverDescriptor, "router-signature\n")+len("router-signature\n")]
+	sum := sha1.Sum([]byte(signed))
+	digest := hex.EncodeToString(sum[:])
+	descPath := path.Join(descriptorStoreDir, "server-descriptors-2015-08", digest[0:1], digest[1:2], digest)
+
+	expectedFiles := append([]string{descPath}, expectedRequests...)
+	sort.Strings(expectedFiles)
+	if stored := storedFiles(t, fetcher.Store); !reflect.DeepEqual(stored, expectedFiles) {
+		t.Errorf("Store holds %v, but expected %v.", stored, expectedFiles)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(fetcher.Store, filepath.FromSlash(descPath)))
+	if err != nil {
+		t.Fatalf("Couldn't read unpacked descriptor: %s", err)
+	}
+	if expected := "@type server-descriptor 1.0\n" + serverDescriptor; string(content) != expected {
+		t.Errorf("Unpacked descriptor is %q, but expected %q.", content, expected)
+	}
+
+	// Files that are already in the store aren't fetched again.
+	*requested = nil
+	if err := fetcher.Fetch(context.Background()); err != nil {
+		t.Fatalf("Second fetch failed: %s", err)
+	}
+	if len(*requested) > 0 {
+		t.Errorf("Second fetch fetched %v, but expected nothing.", *requested)
+	}
+}
+
+func TestFetchMismatch(t *testing.T) {
+
+	consensus := []byte("network-status-version 3\nvalid-after 2015-08-01 00:00:00\n")
+	descriptors := []byte(serverDescriptor)
+
+	tests := []struct {
+		name   string
+		modify func(file *collectorFile)
+	}{
+		{"size", func(file *collectorFile) { file.Size++ }},
+		{"digest", func(file *collectorFile) {
+			file.SHA256 = newCollectorFile(file.Path, []byte("something else")).SHA256
+		}},
+		{"invalid digest", func(file *collectorFile) { file.SHA256 = "!!!" }},
+	}
+
+	for _, test := range tests {
+		consensusFile := newCollectorFile("2015-08-01-00-00-00-consensus", consensus)
+		serverDescFile := newCollectorFile("2015-08-01-00-00-00-server-descriptors", descriptors)
+		test.modify(&consensusFile)
+		test.modify(&serverDescFile)
+
+		files := map[string][]byte{
+			path.Join(consensusDir, consensusFile.Path):   consensus,
+			path.Join(serverDescDir, serverDescFile.Path): descriptors,
+		}
+
+		for _, descType := range []string{"consensuses", "server-descriptors"} {
+			server, _ := newCollector(t, files, []collectorFile{consensusFile}, []collectorFile{serverDescFile})
+			fetcher := newTestFetcher(t, server)
+			fetcher.Types = []string{descType}
+
+			if err := fetcher.Fetch(context.Background()); err == nil {
+				t.Errorf("%s: fetching %s with mismatching %s succeeded.", test.name, descType, test.name)
+			}
+			// Neither the download nor unpacked descriptors end up in the store.
+			if stored := storedFiles(t, fetcher.Store); len(stored) > 0 {
+				t.Errorf("%s: store holds %v after failed fetch of %s.", test.name, stored, descType)
+			}
+		}
+	}
+}
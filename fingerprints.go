@@ -3,99 +3,97 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"sort"
-	"sync"
+	"time"
 
+	"github.com/NullHypothesis/sybilhunter/fingerprints"
+	"github.com/NullHypothesis/sybilhunter/microdesc"
 	tor "github.com/NullHypothesis/zoossh"
 )
 
-type ValueSorter struct {
-	// IP addresses in string format.
-	keys []string
-	// Amount of unique fingerprints.
-	vals []int
-}
+// writeAddressStats writes the fingerprints that were observed on an IP
+// address to the given sink.  The given date is only used in JSON format.
+func writeAddressStats(stats fingerprints.AddressStats, date time.Time, params *CmdLineParams, sink Sink) {
+
+	if params.Format == jsonFormat {
+		record := NewRecord("fingerprints", "address_fingerprints", date)
+		record.Data["address"] = stats.Address
+		record.Data["unique_fingerprints"] = len(stats.Fingerprints)
+		record.Data["seen"] = stats.Fingerprints
+		for fingerprint, _ := range stats.Fingerprints {
+			record.Fingerprints = append(record.Fingerprints, fingerprint)
+		}
+		sink.Emit(record)
+		return
+	}
 
-// Implement the sort interface (1/3).
-func (vs ValueSorter) Len() int {
-	return len(vs.keys)
+	fmt.Fprintf(sink, "%s (%d unique fingerprints)\n", stats.Address, len(stats.Fingerprints))
+	for fingerprint, count := range stats.Fingerprints {
+		fmt.Fprintf(sink, "\t%s (seen %d times)\n", fingerprint, count)
+	}
 }
 
-// Implement the sort interface (2/3).
-func (vs ValueSorter) Swap(i int, j int) {
-	vs.keys[i], vs.keys[j] = vs.keys[j], vs.keys[i]
-	vs.vals[i], vs.vals[j] = vs.vals[j], vs.vals[i]
-}
+// alertFingerprints sends alerts about the IP addresses in the given slice whose
+// relays used at least params.MinFprs unique fingerprints.  In watch mode, the
+// addresses are also written to the given sink, so we learn about them right
+// away.
+func alertFingerprints(ctx context.Context, fprAnalysis fingerprints.Analysis, changed []string, objects tor.ObjectSet, params *CmdLineParams, sink Sink) {
 
-// Implement the sort interface (3/3).
-func (vs ValueSorter) Less(i int, j int) bool {
-	return vs.vals[i] < vs.vals[j]
-}
+	var date time.Time
+	if consensus, ok := microdesc.ConsensusOf(objects); ok {
+		date = consensus.ValidAfter
+	}
+
+	alerted := make(map[string]bool)
+	for _, address := range changed {
+		fprStats := fprAnalysis[address]
+		if alerted[address] || len(fprStats) < params.MinFprs {
+			continue
+		}
+		alerted[address] = true
+
+		log.Printf("Relays on %s used %d unique fingerprints.\n", address, len(fprStats))
+		if params.Watch {
+			writeAddressStats(fingerprints.AddressStats{Address: address, Fingerprints: fprStats}, date, params, sink)
+		}
+
+		if params.Alerter != nil {
+			var fprs []tor.Fingerprint
+			for fingerprint, _ := range fprStats {
+				fprs = append(fprs, fingerprint)
+			}
+			record := NewRecord("fingerprints", "fingerprints_alert", date, fprs...)
+			record.Data["address"] = address
+			record.Data["unique_fingerprints"] = len(fprStats)
+			record.Data["threshold"] = params.MinFprs
 
-// Used to count how often a given fingerprint was observed.
-type FprStats map[tor.Fingerprint]int
-
-// countFingerprints updates the fingerprint statistics with the given
-// fingerprint and address.
-func countFingerprints(fpr tor.Fingerprint, address string, analysis map[string]FprStats) {
-
-	fprStats, ok := analysis[address]
-	if ok {
-		_, ok := fprStats[fpr]
-		if ok {
-			// Fingerprint already present for address: update counter.
-			fprStats[fpr] += 1
-		} else {
-			// Fingerprint new: add it to the map.
-			fprStats[fpr] = 1
+			summary := fmt.Sprintf("Relays on %s used %d unique fingerprints (>= %d).", address, len(fprStats), params.MinFprs)
+			params.Alerter.Alert(ctx, NewAlert(record, "fingerprints/"+address, summary))
 		}
-	} else {
-		analysis[address] = FprStats{fpr: 1}
 	}
 }
 
 // AnalyseFingerprints determines how many unique fingerprints were used by all
-// Tor relays in the given object set.
-func AnalyseFingerprints(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
+// Tor relays in the given object set.  Once the relays on an IP address used
+// params.MinFprs unique fingerprints, an alert is sent, and, in watch mode, the
+// address is written right away.
+func AnalyseFingerprints(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
-	defer group.Done()
-
-	// Go does not like net.IP as a map key.  So we use an IP address's string
-	// representation instead.
-	var fprAnalysis map[string]FprStats = map[string]FprStats{}
+	fprAnalysis := make(fingerprints.Analysis)
 
 	for objects := range channel {
-		switch v := objects.(type) {
-		case *tor.Consensus:
-			for fpr, getVal := range v.RouterStatuses {
-				countFingerprints(fpr, getVal().Address.String(), fprAnalysis)
-			}
-		case *tor.RouterDescriptors:
-			for fpr, getVal := range v.RouterDescriptors {
-				countFingerprints(fpr, getVal().Address.String(), fprAnalysis)
-			}
+		changed := fprAnalysis.Add(objects)
+		if params.Watch || params.Alerter != nil {
+			alertFingerprints(ctx, fprAnalysis, changed, objects, params, sink)
 		}
 	}
 
-	vs := ValueSorter{
-		keys: make([]string, 0),
-		vals: make([]int, 0),
-	}
-
-	// Use ValueSorter to sort by IP addresses with most unique fingerprints.
 	log.Println("Now sorting by IP addresses with most unique fingerprints.")
-	for ipAddr, fprList := range fprAnalysis {
-		vs.keys = append(vs.keys, ipAddr)
-		vs.vals = append(vs.vals, len(fprList))
+	for _, stats := range fprAnalysis.Sorted() {
+		writeAddressStats(stats, time.Time{}, params, sink)
 	}
-	sort.Sort(vs)
 
-	for i, val := range vs.keys {
-		fmt.Printf("%s (%d unique fingerprints)\n", val, vs.vals[i])
-		for fingerprint, count := range fprAnalysis[val] {
-			fmt.Printf("\t%s (seen %d times)\n", fingerprint, count)
-		}
-	}
+	return nil
 }
@@ -0,0 +1,125 @@
+// Package fingerprints looks for relays manipulating their fingerprints, by
+// counting the unique fingerprints that were used on every IP address.
+package fingerprints
+
+import (
+	"sort"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+type ValueSorter struct {
+	// IP addresses in string format.
+	keys []string
+	// Amount of unique fingerprints.
+	vals []int
+}
+
+// Implement the sort interface (1/3).
+func (vs ValueSorter) Len() int {
+	return len(vs.keys)
+}
+
+// Implement the sort interface (2/3).
+func (vs ValueSorter) Swap(i int, j int) {
+	vs.keys[i], vs.keys[j] = vs.keys[j], vs.keys[i]
+	vs.vals[i], vs.vals[j] = vs.vals[j], vs.vals[i]
+}
+
+// Implement the sort interface (3/3).
+func (vs ValueSorter) Less(i int, j int) bool {
+	return vs.vals[i] < vs.vals[j]
+}
+
+// Used to count how often a given fingerprint was observed.
+type FprStats map[tor.Fingerprint]int
+
+// Analysis maps IP addresses to the fingerprints that were observed on them.
+// Go does not like net.IP as a map key.  So we use an IP address's string
+// representation instead.
+type Analysis map[string]FprStats
+
+// AddressStats holds the fingerprints that were observed on an IP address.
+type AddressStats struct {
+	Address      string
+	Fingerprints FprStats
+}
+
+// countFingerprints updates the fingerprint statistics with the given
+// fingerprint and address.  It returns true if the fingerprint wasn't observed
+// on the address before.
+func countFingerprints(fpr tor.Fingerprint, address string, analysis Analysis) bool {
+
+	fprStats, ok := analysis[address]
+	if ok {
+		_, ok := fprStats[fpr]
+		if ok {
+			// Fingerprint already present for address: update counter.
+			fprStats[fpr] += 1
+			return false
+		} else {
+			// Fingerprint new: add it to the map.
+			fprStats[fpr] = 1
+		}
+	} else {
+		analysis[address] = FprStats{fpr: 1}
+	}
+
+	return true
+}
+
+// Add counts the fingerprints of all relays in the given object set.  It
+// returns the IP addresses on which a fingerprint was observed for the first
+// time.
+func (analysis Analysis) Add(objects tor.ObjectSet) []string {
+
+	var changed []string
+
+	if consensus, ok := microdesc.ConsensusOf(objects); ok {
+		objects = consensus
+	}
+
+	switch v := objects.(type) {
+	case *tor.Consensus:
+		for fpr, getVal := range v.RouterStatuses {
+			address := getVal().Address.String()
+			if countFingerprints(fpr, address, analysis) {
+				changed = append(changed, address)
+			}
+		}
+	case *tor.RouterDescriptors:
+		for fpr, getVal := range v.RouterDescriptors {
+			address := getVal().Address.String()
+			if countFingerprints(fpr, address, analysis) {
+				changed = append(changed, address)
+			}
+		}
+	}
+
+	return changed
+}
+
+// Sorted returns the statistics of all IP addresses, sorted by the number of
+// unique fingerprints, in ascending order.
+func (analysis Analysis) Sorted() []AddressStats {
+
+	vs := ValueSorter{
+		keys: make([]string, 0),
+		vals: make([]int, 0),
+	}
+
+	// Use ValueSorter to sort by IP addresses with most unique fingerprints.
+	for ipAddr, fprList := range analysis {
+		vs.keys = append(vs.keys, ipAddr)
+		vs.vals = append(vs.vals, len(fprList))
+	}
+	sort.Sort(vs)
+
+	stats := make([]AddressStats, len(vs.keys))
+	for i, ipAddr := range vs.keys {
+		stats[i] = AddressStats{ipAddr, analysis[ipAddr]}
+	}
+
+	return stats
+}
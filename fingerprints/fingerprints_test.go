@@ -0,0 +1,65 @@
+// Test counting the fingerprints that were used on IP addresses.
+
+package fingerprints
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// newDescriptors returns router descriptors that map the given fingerprints to
+// IP addresses.
+func newDescriptors(addresses map[tor.Fingerprint]string) *tor.RouterDescriptors {
+
+	descs := tor.NewRouterDescriptors()
+	for fingerprint, address := range addresses {
+		descs.Set(fingerprint, &tor.RouterDescriptor{
+			Fingerprint: fingerprint,
+			Address:     net.ParseIP(address),
+		})
+	}
+
+	return descs
+}
+
+func TestAdd(t *testing.T) {
+
+	analysis := make(Analysis)
+
+	tests := []struct {
+		addresses map[tor.Fingerprint]string
+		changed   []string
+	}{
+		{map[tor.Fingerprint]string{"A": "192.0.2.1", "B": "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.2"}},
+		// Fingerprints that were seen on an address before don't count.
+		{map[tor.Fingerprint]string{"A": "192.0.2.1", "B": "192.0.2.2"}, nil},
+		{map[tor.Fingerprint]string{"A": "192.0.2.1", "C": "192.0.2.1"}, []string{"192.0.2.1"}},
+	}
+
+	for i, test := range tests {
+		changed := analysis.Add(newDescriptors(test.addresses))
+		sort.Strings(changed)
+		if len(changed) != len(test.changed) {
+			t.Errorf("Set #%d: changed addresses are %v, but expected %v.", i, changed, test.changed)
+			continue
+		}
+		for j := range changed {
+			if changed[j] != test.changed[j] {
+				t.Errorf("Set #%d: changed addresses are %v, but expected %v.", i, changed, test.changed)
+				break
+			}
+		}
+	}
+
+	stats := analysis.Sorted()
+	if len(stats) != 2 {
+		t.Fatalf("Got statistics of %d addresses, but expected 2.", len(stats))
+	}
+	last := stats[len(stats)-1]
+	if last.Address != "192.0.2.1" || len(last.Fingerprints) != 2 || last.Fingerprints["A"] != 3 {
+		t.Errorf("Address with most fingerprints is %+v, but expected 192.0.2.1 with A seen thrice and C.", last)
+	}
+}
@@ -0,0 +1,162 @@
+// Analyses microdescriptor consensuses and microdescriptors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	"github.com/NullHypothesis/sybilhunter/similarity"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// consensusAnnotation starts CollecTor's consensus files.
+const consensusAnnotation = "@type network-status-consensus-3 "
+
+// parseObjects parses the data objects in the given reader.  zoossh doesn't
+// know microdescriptor consensuses and microdescriptors, so we recognise them
+// by their CollecTor annotation and parse them ourselves.  Everything else is
+// left to zoossh.  zoossh also ignores the bandwidth weights in consensus
+// footers, and flags that it doesn't know, which we add to consensuses.
+func parseObjects(br *bufio.Reader) (tor.ObjectSet, error) {
+
+	header, _ := br.Peek(len(microdesc.ConsensusAnnotation))
+
+	if bytes.HasPrefix(header, []byte(consensusAnnotation)) {
+		document, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := tor.ParseUnknown(bytes.NewReader(document))
+		if consensus, ok := objects.(*tor.Consensus); ok && err == nil {
+			flags, weights := microdesc.ParseFlagsAndWeights(document)
+			return &microdesc.WeightedConsensus{
+				Consensus:        consensus,
+				BandwidthWeights: weights,
+				Flags:            flags,
+			}, nil
+		}
+		return objects, err
+	}
+
+	if bytes.HasPrefix(header, []byte(microdesc.ConsensusAnnotation)) {
+		consensus, err := microdesc.ParseConsensus(br)
+		if err != nil {
+			return nil, err
+		}
+		return consensus, nil
+	}
+
+	if bytes.HasPrefix(header, []byte(microdesc.Annotation)) {
+		descs, err := microdesc.Parse(br)
+		// Don't turn a nil pointer into a non-nil interface value.
+		if descs == nil {
+			return nil, err
+		}
+		return descs, err
+	}
+
+	return tor.ParseUnknown(br)
+}
+
+// PrintMicrodescriptor prints a microdescriptor to the given sink, either in
+// human-readable format or, if the given format is JSON, as a record.
+// Microdescriptors have neither a fingerprint nor a publication time.
+func PrintMicrodescriptor(desc *microdesc.Microdescriptor, format string, sink Sink) {
+
+	if format == jsonFormat {
+		record := NewRecord("print", "microdescriptor", time.Time{})
+		record.Data["digest"] = desc.Digest
+		record.Data["ntor_onion_key"] = desc.NTorOnionKey
+		record.Data["family"] = desc.Family
+		record.Data["ipv4_policy"] = desc.IPv4Policy
+		record.Data["ipv6_policy"] = desc.IPv6Policy
+		sink.Emit(record)
+		return
+	}
+
+	fmt.Fprintln(sink, desc)
+}
+
+// microdescSimilarityRecord turns the given similarity between two relays in a
+// microdescriptor consensus into a record for machine-readable output.
+func microdescSimilarityRecord(s *similarity.MicrodescSimilarity, validAfter time.Time) *Record {
+
+	record := NewRecord("matrix", "similar_pair", validAfter,
+		s.Status1.Fingerprint, s.Status2.Fingerprint)
+
+	record.Data["nicknames"] = []string{s.Status1.Nickname, s.Status2.Nickname}
+	record.Data["score"] = s.SimilarityScore
+	record.Data["bandwidth_diff"] = s.BandwidthDiff
+	record.Data["or_port_diff"] = s.ORPortDiff
+	record.Data["shared_fpr_prefix"] = s.SharedFprPrefix
+	record.Data["levenshtein_dist"] = s.LevenshteinDist
+	record.Data["same_family"] = s.SameFamily
+	record.Data["same_address"] = s.SameAddress
+	record.Data["same_version"] = s.SameVersion
+	record.Data["same_policy"] = s.SamePolicy
+	record.Data["same_ntor_key"] = s.SameNTorKey
+
+	return record
+}
+
+// genMicrodescSimilarityMatrix computes pairwise similarities for all relays in
+// the given microdescriptor consensus, using the given microdescriptors.  The
+// output is the same as genSimilarityMatrix's.
+func genMicrodescSimilarityMatrix(ctx context.Context, consensus *microdesc.Consensus, descs *microdesc.Microdescriptors, params *CmdLineParams, sink Sink) error {
+
+	validAfter := consensus.ValidAfter
+	pairs, count, missing, err := similarity.MicrodescMatrix(ctx, consensus, descs,
+		params.Threshold, params.NoFamily)
+
+	if missing > 0 {
+		log.Printf("Couldn't find microdescriptors of %d of %d relays in consensus valid after %s.\n",
+			missing, consensus.Length(), validAfter.Format(time.RFC3339))
+	}
+	log.Printf("Computed %d pairwise similarities, %d are part of output.\n",
+		count, len(pairs))
+
+	if params.Alerter != nil && len(pairs) > 0 {
+		var maxScore float64
+		var fingerprints []tor.Fingerprint
+		seen := make(map[tor.Fingerprint]bool)
+		for _, pair := range pairs {
+			for _, status := range []*tor.RouterStatus{pair.Status1, pair.Status2} {
+				if !seen[status.Fingerprint] {
+					seen[status.Fingerprint] = true
+					fingerprints = append(fingerprints, status.Fingerprint)
+				}
+			}
+			if pair.SimilarityScore > maxScore {
+				maxScore = pair.SimilarityScore
+			}
+		}
+		alertSimilarRelays(ctx, len(pairs), fingerprints, validAfter, maxScore, params)
+	}
+
+	if params.Visualise {
+		GenerateMicrodescDOTGraph(pairs, sink)
+		return err
+	}
+
+	for _, pair := range pairs {
+		if params.Format == jsonFormat {
+			sink.Emit(microdescSimilarityRecord(pair, validAfter))
+			continue
+		}
+
+		fmt.Fprintf(sink, "<https://atlas.torproject.org/#details/%s> (%s)\n",
+			pair.Status1.Fingerprint, pair.Status1.Nickname)
+		fmt.Fprintf(sink, "<https://atlas.torproject.org/#details/%s> (%s)\n",
+			pair.Status2.Fingerprint, pair.Status2.Nickname)
+		fmt.Fprintln(sink, pair)
+	}
+
+	return err
+}
@@ -0,0 +1,170 @@
+// Parses relay flags by name, including flags that zoossh doesn't know.
+
+package microdesc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// Flags holds the flags that a consensus' "known-flags" line lists, and the
+// flags of every relay in the consensus, by name.  zoossh's RouterFlags only
+// has fields for the flags that existed when it was written, so flags that
+// were introduced later, e.g., StaleDesc, NoEdConsensus, or MiddleOnly, would
+// otherwise be lost.
+type Flags struct {
+	Known  []string
+	Relays map[tor.Fingerprint][]string
+}
+
+// NewFlags allocates and returns a new, empty set of relay flags.
+func NewFlags() *Flags {
+
+	return &Flags{Relays: make(map[tor.Fingerprint][]string)}
+}
+
+// Has returns true if the relay with the given fingerprint has the given flag.
+func (f *Flags) Has(fingerprint tor.Fingerprint, flag string) bool {
+
+	for _, relayFlag := range f.Relays[fingerprint] {
+		if relayFlag == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// set sets the given flags of the relay with the given fingerprint.  Flag
+// names that the "known-flags" line lists are shared, so the flags don't keep
+// their lines in memory.
+func (f *Flags) set(fingerprint tor.Fingerprint, flags []string) {
+
+	relayFlags := make([]string, len(flags))
+	for i, flag := range flags {
+		relayFlags[i] = flag
+		for _, known := range f.Known {
+			if known == flag {
+				relayFlags[i] = known
+				break
+			}
+		}
+	}
+	f.Relays[fingerprint] = relayFlags
+}
+
+// FlagsOf returns the relay flags of the consensus in the given object set.
+// If the object set is no consensus, or its flags weren't parsed, nil is
+// returned.
+func FlagsOf(objects tor.ObjectSet) *Flags {
+
+	switch v := objects.(type) {
+	case *WeightedConsensus:
+		return v.Flags
+	case *Consensus:
+		return v.Flags
+	}
+
+	return nil
+}
+
+// identityFingerprint turns the given base64-encoded identity of an "r" line
+// into a fingerprint.
+func identityFingerprint(identity string) (tor.Fingerprint, bool) {
+
+	// The identity is base64-encoded without padding.
+	decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(identity, "="))
+	if err != nil {
+		return "", false
+	}
+
+	return tor.Fingerprint(strings.ToUpper(hex.EncodeToString(decoded))), true
+}
+
+// merge adds the given flags to f.  Flags of relays that are in both sets are
+// replaced by the given flags, just like the relays' router statuses are when
+// consensuses are merged.
+func (f *Flags) merge(other *Flags) {
+
+	if other == nil {
+		return
+	}
+
+	for _, flag := range other.Known {
+		known := false
+		for _, existing := range f.Known {
+			if existing == flag {
+				known = true
+				break
+			}
+		}
+		if !known {
+			f.Known = append(f.Known, flag)
+		}
+	}
+
+	for fingerprint, flags := range other.Relays {
+		f.Relays[fingerprint] = flags
+	}
+}
+
+// ParseFlags extracts the "known-flags" line and the flags of every relay
+// from the given consensus document.  It works for both regular and
+// microdescriptor-flavoured consensuses.
+func ParseFlags(document []byte) *Flags {
+
+	flags, _ := ParseFlagsAndWeights(document)
+
+	return flags
+}
+
+// ParseFlagsAndWeights extracts the relay flags, like ParseFlags, and the
+// bandwidth weights, like ParseBandwidthWeights, from the given consensus
+// document in a single pass.
+func ParseFlagsAndWeights(document []byte) (*Flags, BandwidthWeights) {
+
+	flags := NewFlags()
+	var fingerprint tor.Fingerprint
+	var inRelay bool
+	var paramsLine, weightsLine string
+
+	scanner := bufio.NewScanner(bytes.NewReader(document))
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		case "known-flags":
+			flags.Known = words[1:]
+		case "params":
+			if paramsLine == "" {
+				paramsLine = scanner.Text()
+			}
+		case "r":
+			// A malformed "r" line must not pass its flags on to the
+			// previous relay.
+			inRelay = false
+			if len(words) > 2 {
+				fingerprint, inRelay = identityFingerprint(words[2])
+			}
+		case "s":
+			if inRelay {
+				flags.set(fingerprint, words[1:])
+			}
+		case "directory-footer":
+			inRelay = false
+		case "bandwidth-weights":
+			// The footer's weights come last, so they win.
+			weightsLine = scanner.Text()
+		}
+	}
+
+	return flags, parseWeights(paramsLine, weightsLine)
+}
@@ -0,0 +1,410 @@
+// Package microdesc parses microdescriptor-flavoured consensuses and
+// microdescriptors, which is the data that Tor clients use.  It also parses
+// the bandwidth weights in consensus footers, which zoossh ignores.
+package microdesc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+const (
+	// ConsensusAnnotation starts CollecTor's microdescriptor consensus
+	// files.
+	ConsensusAnnotation = "@type network-status-microdesc-consensus-3 "
+
+	// Annotation starts CollecTor's microdescriptor files.
+	Annotation = "@type microdescriptor "
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+// Consensus is a microdescriptor-flavoured consensus.  It behaves like a
+// regular consensus, except that the Digest field of its router statuses holds
+// the base64-encoded SHA-256 digest of the relay's microdescriptor instead of
+// the digest of its server descriptor.  Flags holds the flags of its relays by
+// name.
+type Consensus struct {
+	*tor.Consensus
+	BandwidthWeights BandwidthWeights
+	Flags            *Flags
+}
+
+// Merge implements the tor.ObjectSet interface.  The flags of the given
+// consensus are added to ours.  Bandwidth weights can't be combined, so we
+// keep ours, and only take over the given consensus' weights if we have none.
+func (c *Consensus) Merge(objects tor.ObjectSet) {
+
+	c.Flags, c.BandwidthWeights = mergeExtras(c.Flags, c.BandwidthWeights, objects)
+	if consensus, ok := ConsensusOf(objects); ok {
+		c.Consensus.Merge(consensus)
+		return
+	}
+	c.Consensus.Merge(objects)
+}
+
+// ConsensusOf returns the consensus in the given object set, which is either a
+// regular consensus, with or without bandwidth weights, or a
+// microdescriptor-flavoured consensus.  The boolean is false if the object set
+// is no consensus.
+func ConsensusOf(objects tor.ObjectSet) (*tor.Consensus, bool) {
+
+	switch v := objects.(type) {
+	case *tor.Consensus:
+		return v, true
+	case *WeightedConsensus:
+		return v.Consensus, true
+	case *Consensus:
+		return v.Consensus, true
+	}
+
+	return nil, false
+}
+
+// Microdescriptor holds the fields of a microdescriptor that we care about.
+// Microdescriptors don't contain a fingerprint, so they are identified by
+// their digest.
+type Microdescriptor struct {
+	Digest       string
+	NTorOnionKey string
+	Family       []string
+	IPv4Policy   string
+	IPv6Policy   string
+}
+
+// GetFingerprint implements the tor.Object interface.  Microdescriptors have
+// no fingerprint, so we return the microdescriptor's digest instead.
+func (m *Microdescriptor) GetFingerprint() tor.Fingerprint {
+
+	return tor.Fingerprint(m.Digest)
+}
+
+// String implements the tor.Object interface.
+func (m *Microdescriptor) String() string {
+
+	return fmt.Sprintf("%s,%s,%s,%s,%s", m.Digest, m.NTorOnionKey,
+		strings.Join(m.Family, " "), m.IPv4Policy, m.IPv6Policy)
+}
+
+// HasFamily returns true if the given relay is in the microdescriptor's
+// family.
+func (m *Microdescriptor) HasFamily(fingerprint tor.Fingerprint) bool {
+
+	for _, member := range m.Family {
+		// Members are either nicknames or fingerprints that may be
+		// followed by a nickname, e.g., $AAAA...=nickname.
+		member = strings.TrimPrefix(member, "$")
+		if i := strings.IndexAny(member, "=~"); i != -1 {
+			member = member[:i]
+		}
+		if strings.EqualFold(member, string(fingerprint)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Microdescriptors is a set of microdescriptors that are mapped to by their
+// digest.  It implements the tor.ObjectSet interface.
+type Microdescriptors struct {
+	ByDigest map[string]*Microdescriptor
+}
+
+// NewMicrodescriptors returns an empty set of microdescriptors.
+func NewMicrodescriptors() *Microdescriptors {
+
+	return &Microdescriptors{ByDigest: make(map[string]*Microdescriptor)}
+}
+
+// Iterate implements the tor.ObjectSet interface.  Object filters match
+// fingerprints, addresses, and nicknames, none of which microdescriptors
+// have, so the given filter is ignored.
+func (m *Microdescriptors) Iterate(filter *tor.ObjectFilter) <-chan tor.Object {
+
+	ch := make(chan tor.Object)
+	go func() {
+		for _, desc := range m.ByDigest {
+			ch <- desc
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// GetObject implements the tor.ObjectSet interface.  The given fingerprint is
+// interpreted as a microdescriptor digest.
+func (m *Microdescriptors) GetObject(fingerprint tor.Fingerprint) (tor.Object, bool) {
+
+	desc, ok := m.ByDigest[string(fingerprint)]
+	return desc, ok
+}
+
+// Length implements the tor.ObjectSet interface.
+func (m *Microdescriptors) Length() int {
+
+	return len(m.ByDigest)
+}
+
+// Merge implements the tor.ObjectSet interface.
+func (m *Microdescriptors) Merge(objects tor.ObjectSet) {
+
+	other, ok := objects.(*Microdescriptors)
+	if !ok {
+		return
+	}
+	for digest, desc := range other.ByDigest {
+		m.ByDigest[digest] = desc
+	}
+}
+
+// digest returns the unpadded base64-encoded SHA-256 digest of the given
+// microdescriptor, which is how consensuses refer to it.
+func digest(content []byte) string {
+
+	sum := sha256.Sum256(content)
+	return strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+}
+
+// Parse parses all microdescriptors in the given reader.  Every
+// microdescriptor starts with an "onion-key" line.
+func Parse(r io.Reader) (*Microdescriptors, error) {
+
+	descs := NewMicrodescriptors()
+
+	var content bytes.Buffer
+	var desc *Microdescriptor
+	finish := func() {
+		if desc != nil {
+			desc.Digest = digest(content.Bytes())
+			descs.ByDigest[desc.Digest] = desc
+		}
+		desc = nil
+		content.Reset()
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		rawLine, err := br.ReadBytes('\n')
+		if len(rawLine) > 0 {
+			line := strings.TrimRight(string(rawLine), "\r\n")
+			switch {
+			case strings.HasPrefix(line, "@"):
+				// Annotations aren't part of the microdescriptor.
+				finish()
+				rawLine = nil
+			case line == "onion-key" || strings.HasPrefix(line, "onion-key "):
+				finish()
+				desc = &Microdescriptor{}
+			}
+
+			if desc != nil {
+				content.Write(rawLine)
+				words := strings.SplitN(line, " ", 2)
+				value := ""
+				if len(words) == 2 {
+					value = words[1]
+				}
+				switch words[0] {
+				case "ntor-onion-key":
+					desc.NTorOnionKey = value
+				case "family":
+					desc.Family = strings.Fields(value)
+				case "p":
+					desc.IPv4Policy = value
+				case "p6":
+					desc.IPv6Policy = value
+				}
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	finish()
+
+	if descs.Length() == 0 {
+		return nil, nil
+	}
+
+	return descs, nil
+}
+
+// setFlags sets the given flags in the given router status.
+func setFlags(status *tor.RouterStatus, flags []string) {
+
+	for _, flag := range flags {
+		switch flag {
+		case "Authority":
+			status.Flags.Authority = true
+		case "BadExit":
+			status.Flags.BadExit = true
+		case "Exit":
+			status.Flags.Exit = true
+		case "Fast":
+			status.Flags.Fast = true
+		case "Guard":
+			status.Flags.Guard = true
+		case "HSDir":
+			status.Flags.HSDir = true
+		case "Named":
+			status.Flags.Named = true
+		case "Running":
+			status.Flags.Running = true
+		case "Stable":
+			status.Flags.Stable = true
+		case "Unnamed":
+			status.Flags.Unnamed = true
+		case "V2Dir":
+			status.Flags.V2Dir = true
+		case "Valid":
+			status.Flags.Valid = true
+		}
+	}
+}
+
+// parseRouterLine parses the given "r" line of a microdescriptor consensus,
+// i.e., "r nickname identity published-date published-time address orport
+// dirport".
+func parseRouterLine(words []string) (*tor.RouterStatus, error) {
+
+	if len(words) != 8 {
+		return nil, fmt.Errorf("expected 8 fields in \"r\" line, but got %d", len(words))
+	}
+
+	fingerprint, ok := identityFingerprint(words[2])
+	if !ok {
+		return nil, fmt.Errorf("invalid identity \"%s\"", words[2])
+	}
+
+	published, err := time.Parse(timeLayout, words[3]+" "+words[4])
+	if err != nil {
+		return nil, err
+	}
+
+	orPort, err := strconv.ParseUint(words[6], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	dirPort, err := strconv.ParseUint(words[7], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &tor.RouterStatus{
+		Nickname:    words[1],
+		Fingerprint: fingerprint,
+		Publication: published,
+	}
+	status.Address.IPv4Address = net.ParseIP(words[5])
+	status.Address.IPv4ORPort = uint16(orPort)
+	status.Address.IPv4DirPort = uint16(dirPort)
+
+	return status, nil
+}
+
+// ParseConsensus parses the microdescriptor-flavoured consensus in the given
+// reader.
+func ParseConsensus(r io.Reader) (*Consensus, error) {
+
+	consensus := &Consensus{Consensus: tor.NewConsensus(), Flags: NewFlags()}
+	var status *tor.RouterStatus
+	var paramsLine, weightsLine string
+
+	finish := func() {
+		if status != nil {
+			consensus.Set(status.Fingerprint, status)
+		}
+		status = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		value := strings.Join(words[1:], " ")
+
+		var err error
+		switch words[0] {
+		case "valid-after":
+			consensus.ValidAfter, err = time.Parse(timeLayout, value)
+		case "fresh-until":
+			consensus.FreshUntil, err = time.Parse(timeLayout, value)
+		case "valid-until":
+			consensus.ValidUntil, err = time.Parse(timeLayout, value)
+		case "r":
+			finish()
+			status, err = parseRouterLine(words)
+		case "known-flags":
+			consensus.Flags.Known = words[1:]
+		case "params":
+			paramsLine = scanner.Text()
+		case "directory-footer":
+			finish()
+		case "bandwidth-weights":
+			weightsLine = scanner.Text()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("microdescriptor consensus: %s", err)
+		}
+
+		if status == nil {
+			continue
+		}
+
+		switch words[0] {
+		case "a":
+			host, port, err := net.SplitHostPort(value)
+			if err == nil && status.Address.IPv6Address == nil {
+				orPort, _ := strconv.ParseUint(port, 10, 16)
+				status.Address.IPv6Address = net.ParseIP(host)
+				status.Address.IPv6ORPort = uint16(orPort)
+			}
+		case "s":
+			setFlags(status, words[1:])
+			consensus.Flags.set(status.Fingerprint, words[1:])
+		case "v":
+			status.TorVersion = value
+		case "w":
+			for _, word := range words[1:] {
+				keyValue := strings.SplitN(word, "=", 2)
+				if len(keyValue) != 2 {
+					continue
+				}
+				switch keyValue[0] {
+				case "Bandwidth":
+					status.Bandwidth, _ = strconv.ParseUint(keyValue[1], 10, 64)
+				case "Unmeasured":
+					status.Unmeasured = keyValue[1] == "1"
+				}
+			}
+		case "p":
+			status.PortList = value
+		case "m":
+			status.Digest = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+	consensus.BandwidthWeights = parseWeights(paramsLine, weightsLine)
+
+	return consensus, nil
+}
@@ -0,0 +1,295 @@
+// Test parsing microdescriptor consensuses and bandwidth weights.
+
+package microdesc
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+const (
+	guardFingerprint = "1111111111111111111111111111111111111111"
+	exitFingerprint  = "ABABABABABABABABABABABABABABABABABABABAB"
+)
+
+// consensusDocument is a microdescriptor consensus with two relays, one of
+// which has a flag that zoossh doesn't know.
+const consensusDocument = `@type network-status-microdesc-consensus-3 1.0
+network-status-version 3 microdesc
+vote-status consensus
+valid-after 2015-08-01 01:00:00
+fresh-until 2015-08-01 02:00:00
+valid-until 2015-08-01 04:00:00
+known-flags Exit Fast Guard Running StaleDesc Valid
+params bwweightscale=1000 CircuitPriorityHalflifeMsec=30000
+r guard ERERERERERERERERERERERERERE 2015-08-01 00:12:34 192.0.2.1 9001 0
+a [2001:db8::1]:9001
+m rrLTDaqEXHmCtXs0TLXtXqqqHD3kQjdb3Qm+3s1x6DU
+s Fast Guard Running StaleDesc Valid
+v Tor 0.2.7.6
+w Bandwidth=2000
+r exit q6urq6urq6urq6urq6urq6urq6s 2015-08-01 00:56:12 192.0.2.2 443 80
+m 7h1E4LCTcVgRHbhF8BqXK8sV8Nr5y3n8LEiBTAeTbHQ
+s Exit Fast Running Valid
+v Tor 0.2.6.10
+w Bandwidth=1000 Unmeasured=1
+p accept 80,443
+directory-footer
+bandwidth-weights Wed=500 Wee=1000 Weg=250 Wgd=500 Wgg=750 Wgm=0
+directory-signature 0000000000000000000000000000000000000000 0000000000000000000000000000000000000000
+`
+
+func TestParseConsensus(t *testing.T) {
+
+	consensus, err := ParseConsensus(strings.NewReader(consensusDocument))
+	if err != nil {
+		t.Fatalf("Parsing consensus failed: %s", err)
+	}
+
+	validAfter := time.Date(2015, 8, 1, 1, 0, 0, 0, time.UTC)
+	if !consensus.ValidAfter.Equal(validAfter) {
+		t.Errorf("Consensus is valid after %s, but expected %s.", consensus.ValidAfter, validAfter)
+	}
+	if consensus.Length() != 2 {
+		t.Fatalf("Consensus has %d relays, but expected 2.", consensus.Length())
+	}
+
+	tests := []struct {
+		fingerprint tor.Fingerprint
+		nickname    string
+		orPort      uint16
+		bandwidth   uint64
+		unmeasured  bool
+		flags       tor.RouterFlags
+		digest      string
+		portList    string
+	}{
+		{
+			fingerprint: guardFingerprint,
+			nickname:    "guard",
+			orPort:      9001,
+			bandwidth:   2000,
+			flags:       tor.RouterFlags{Fast: true, Guard: true, Running: true, Valid: true},
+			digest:      "rrLTDaqEXHmCtXs0TLXtXqqqHD3kQjdb3Qm+3s1x6DU",
+		},
+		{
+			fingerprint: exitFingerprint,
+			nickname:    "exit",
+			orPort:      443,
+			bandwidth:   1000,
+			unmeasured:  true,
+			flags:       tor.RouterFlags{Exit: true, Fast: true, Running: true, Valid: true},
+			digest:      "7h1E4LCTcVgRHbhF8BqXK8sV8Nr5y3n8LEiBTAeTbHQ",
+			portList:    "accept 80,443",
+		},
+	}
+
+	for _, test := range tests {
+		status, ok := consensus.Get(test.fingerprint)
+		if !ok {
+			t.Errorf("%s: relay is missing.", test.nickname)
+			continue
+		}
+		if status.Nickname != test.nickname {
+			t.Errorf("%s: nickname is %q.", test.nickname, status.Nickname)
+		}
+		if status.Address.IPv4ORPort != test.orPort {
+			t.Errorf("%s: ORPort is %d, but expected %d.", test.nickname, status.Address.IPv4ORPort, test.orPort)
+		}
+		if status.Bandwidth != test.bandwidth || status.Unmeasured != test.unmeasured {
+			t.Errorf("%s: bandwidth is %d (unmeasured: %t), but expected %d (%t).",
+				test.nickname, status.Bandwidth, status.Unmeasured, test.bandwidth, test.unmeasured)
+		}
+		if status.Flags != test.flags {
+			t.Errorf("%s: flags are %+v, but expected %+v.", test.nickname, status.Flags, test.flags)
+		}
+		if status.Digest != test.digest {
+			t.Errorf("%s: digest is %q, but expected %q.", test.nickname, status.Digest, test.digest)
+		}
+		if status.PortList != test.portList {
+			t.Errorf("%s: port list is %q, but expected %q.", test.nickname, status.PortList, test.portList)
+		}
+	}
+
+	guard, _ := consensus.Get(guardFingerprint)
+	if guard.Address.IPv6Address.String() != "2001:db8::1" || guard.Address.IPv6ORPort != 9001 {
+		t.Errorf("IPv6 address is %s, port %d, but expected 2001:db8::1, port 9001.",
+			guard.Address.IPv6Address, guard.Address.IPv6ORPort)
+	}
+
+	// Flags that zoossh doesn't know are kept by name.
+	if !consensus.Flags.Has(guardFingerprint, "StaleDesc") || consensus.Flags.Has(exitFingerprint, "StaleDesc") {
+		t.Errorf("Only the guard should have the StaleDesc flag: %v", consensus.Flags.Relays)
+	}
+	knownFlags := []string{"Exit", "Fast", "Guard", "Running", "StaleDesc", "Valid"}
+	if !reflect.DeepEqual(consensus.Flags.Known, knownFlags) {
+		t.Errorf("Known flags are %v, but expected %v.", consensus.Flags.Known, knownFlags)
+	}
+
+	if consensus.BandwidthWeights["Wgg"] != 0.75 {
+		t.Errorf("Bandwidth weight Wgg is %f, but expected 0.75.", consensus.BandwidthWeights["Wgg"])
+	}
+}
+
+func TestParseConsensusInvalid(t *testing.T) {
+
+	tests := []string{
+		"valid-after yesterday\n",
+		"r guard ERERERERERERERERERERERERERE 2015-08-01 00:12:34 192.0.2.1 9001\n",
+		"r guard !!! 2015-08-01 00:12:34 192.0.2.1 9001 0\n",
+		"r guard ERERERERERERERERERERERERERE 2015-08-01 00:12:34 192.0.2.1 99999 0\n",
+	}
+
+	for _, document := range tests {
+		if _, err := ParseConsensus(strings.NewReader(document)); err == nil {
+			t.Errorf("Parsing invalid consensus %q succeeded.", document)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+
+	flags := ParseFlags([]byte(consensusDocument))
+
+	expected := map[tor.Fingerprint][]string{
+		guardFingerprint: {"Fast", "Guard", "Running", "StaleDesc", "Valid"},
+		exitFingerprint:  {"Exit", "Fast", "Running", "Valid"},
+	}
+	if !reflect.DeepEqual(flags.Relays, expected) {
+		t.Errorf("Relay flags are %v, but expected %v.", flags.Relays, expected)
+	}
+}
+
+func TestParseFlagsMalformedRelay(t *testing.T) {
+
+	// The flags after a truncated "r" line don't belong to the guard.
+	document := strings.Replace(consensusDocument, "v Tor 0.2.7.6\n", "v Tor 0.2.7.6\nr broken\ns BadExit\n", 1)
+	flags := ParseFlags([]byte(document))
+
+	expected := []string{"Fast", "Guard", "Running", "StaleDesc", "Valid"}
+	if !reflect.DeepEqual(flags.Relays[guardFingerprint], expected) {
+		t.Errorf("Guard flags are %v, but expected %v.", flags.Relays[guardFingerprint], expected)
+	}
+}
+
+func TestParseBandwidthWeights(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		document string
+		expected BandwidthWeights
+	}{
+		{
+			name:     "default scale",
+			document: "network-status-version 3\nbandwidth-weights Wgg=5000 Wee=10000\n",
+			expected: BandwidthWeights{"Wgg": 0.5, "Wee": 1},
+		},
+		{
+			name: "custom scale",
+			document: "network-status-version 3\nparams bwweightscale=1000\n" +
+				"bandwidth-weights Wgg=500 Wee=1000\n",
+			expected: BandwidthWeights{"Wgg": 0.5, "Wee": 1},
+		},
+		{
+			// The footer's weights come last, so they win.
+			name: "last line",
+			document: "network-status-version 3\nbandwidth-weights Wgg=1\n" +
+				"directory-footer\nbandwidth-weights Wgg=2500 Wee=bogus\n",
+			expected: BandwidthWeights{"Wgg": 0.25},
+		},
+		{
+			name:     "no weights",
+			document: "network-status-version 3\nvalid-after 2015-08-01 00:00:00\n",
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		weights := ParseBandwidthWeights([]byte(test.document))
+		if !reflect.DeepEqual(weights, test.expected) {
+			t.Errorf("%s: weights are %v, but expected %v.", test.name, weights, test.expected)
+		}
+		// Parsing flags along with the weights yields the same weights.
+		if _, weights := ParseFlagsAndWeights([]byte(test.document)); !reflect.DeepEqual(weights, test.expected) {
+			t.Errorf("%s: weights parsed with flags are %v, but expected %v.", test.name, weights, test.expected)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	first, err := ParseConsensus(strings.NewReader(consensusDocument))
+	if err != nil {
+		t.Fatalf("Parsing consensus failed: %s", err)
+	}
+
+	// The second consensus has no weights, a new flag, and another relay.
+	second := &WeightedConsensus{
+		Consensus: tor.NewConsensus(),
+		Flags:     NewFlags(),
+	}
+	second.Flags.Known = []string{"MiddleOnly", "Running"}
+	second.Set("2222222222222222222222222222222222222222", &tor.RouterStatus{})
+	second.Flags.set("2222222222222222222222222222222222222222", []string{"MiddleOnly", "Running"})
+
+	first.Merge(second)
+	if first.Length() != 3 {
+		t.Errorf("Merged consensus has %d relays, but expected 3.", first.Length())
+	}
+	if !first.Flags.Has("2222222222222222222222222222222222222222", "MiddleOnly") ||
+		!first.Flags.Has(guardFingerprint, "StaleDesc") {
+		t.Errorf("Merged consensus lacks flags: %v", first.Flags.Relays)
+	}
+	knownFlags := []string{"Exit", "Fast", "Guard", "Running", "StaleDesc", "Valid", "MiddleOnly"}
+	if !reflect.DeepEqual(first.Flags.Known, knownFlags) {
+		t.Errorf("Known flags are %v, but expected %v.", first.Flags.Known, knownFlags)
+	}
+	if first.BandwidthWeights["Wgg"] != 0.75 {
+		t.Errorf("Merged consensus lost its bandwidth weights: %v", first.BandwidthWeights)
+	}
+
+	// A consensus without weights takes over the merged consensus' weights.
+	second.Merge(first)
+	if second.BandwidthWeights["Wgg"] != 0.75 || !second.Flags.Has(guardFingerprint, "StaleDesc") {
+		t.Errorf("Merged consensus has weights %v and flags %v.", second.BandwidthWeights, second.Flags.Relays)
+	}
+}
+
+func TestPosition(t *testing.T) {
+
+	weights := BandwidthWeights{
+		"Wgd": 0.1, "Wed": 0.2,
+		"Wgg": 0.3, "Weg": 0.4,
+		"Wee": 0.6,
+		"Wgm": 0.7, "Wem": 0.8,
+	}
+
+	tests := []struct {
+		name    string
+		weights BandwidthWeights
+		flags   tor.RouterFlags
+		guard   float64
+		exit    float64
+	}{
+		{"guard and exit", weights, tor.RouterFlags{Guard: true, Exit: true}, 0.1, 0.2},
+		{"guard", weights, tor.RouterFlags{Guard: true}, 0.3, 0.4},
+		// Wge is missing in the footer, so it's zero.
+		{"exit", weights, tor.RouterFlags{Exit: true}, 0, 0.6},
+		{"bad exit", weights, tor.RouterFlags{Exit: true, BadExit: true}, 0.7, 0.8},
+		{"middle", weights, tor.RouterFlags{}, 0.7, 0.8},
+		{"no weights", nil, tor.RouterFlags{Guard: true}, 1, 1},
+	}
+
+	for _, test := range tests {
+		guard, exit := test.weights.Position(&test.flags)
+		if math.Abs(guard-test.guard) > 1e-9 || math.Abs(exit-test.exit) > 1e-9 {
+			t.Errorf("%s: position weights are %f and %f, but expected %f and %f.",
+				test.name, guard, exit, test.guard, test.exit)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Parses the bandwidth weights in consensus footers, which zoossh ignores.
+
+package microdesc
+
+import (
+	"strconv"
+	"strings"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// defaultWeightScale is the scale of bandwidth weights, unless the consensus'
+// "params" line sets "bwweightscale".
+const defaultWeightScale = 10000
+
+// BandwidthWeights maps the bandwidth weights in a consensus footer, e.g.,
+// "Wgg", to their value, divided by the weight scale.  The weights determine
+// how much of a relay's bandwidth clients use in guard, middle, and exit
+// position.
+type BandwidthWeights map[string]float64
+
+// WeightedConsensus is a regular consensus together with the bandwidth
+// weights in its footer, and the flags of its relays by name.
+type WeightedConsensus struct {
+	*tor.Consensus
+	BandwidthWeights BandwidthWeights
+	Flags            *Flags
+}
+
+// Merge implements the tor.ObjectSet interface.  The flags of the given
+// consensus are added to ours.  Bandwidth weights can't be combined, so we
+// keep ours, and only take over the given consensus' weights if we have none.
+func (c *WeightedConsensus) Merge(objects tor.ObjectSet) {
+
+	c.Flags, c.BandwidthWeights = mergeExtras(c.Flags, c.BandwidthWeights, objects)
+	if consensus, ok := ConsensusOf(objects); ok {
+		c.Consensus.Merge(consensus)
+		return
+	}
+	c.Consensus.Merge(objects)
+}
+
+// mergeExtras merges the flags and bandwidth weights of the consensus in the
+// given object set into the given flags and weights, and returns the result.
+func mergeExtras(flags *Flags, weights BandwidthWeights, objects tor.ObjectSet) (*Flags, BandwidthWeights) {
+
+	if otherFlags := FlagsOf(objects); otherFlags != nil {
+		if flags == nil {
+			flags = NewFlags()
+		}
+		flags.merge(otherFlags)
+	}
+	if weights == nil {
+		weights = WeightsOf(objects)
+	}
+
+	return flags, weights
+}
+
+// WeightsOf returns the bandwidth weights of the consensus in the given object
+// set.  If the object set is no consensus, or the consensus has no bandwidth
+// weights, nil is returned.
+func WeightsOf(objects tor.ObjectSet) BandwidthWeights {
+
+	switch v := objects.(type) {
+	case *WeightedConsensus:
+		return v.BandwidthWeights
+	case *Consensus:
+		return v.BandwidthWeights
+	}
+
+	return nil
+}
+
+// parseWeights parses the given "params" and "bandwidth-weights" lines, either
+// of which may be empty.  If there are no bandwidth weights, nil is returned.
+func parseWeights(paramsLine, weightsLine string) BandwidthWeights {
+
+	words := strings.Fields(weightsLine)
+	if len(words) < 2 || words[0] != "bandwidth-weights" {
+		return nil
+	}
+
+	scale := float64(defaultWeightScale)
+	for _, param := range strings.Fields(paramsLine) {
+		if !strings.HasPrefix(param, "bwweightscale=") {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimPrefix(param, "bwweightscale="), 10, 64)
+		if err == nil && value > 0 {
+			scale = float64(value)
+		}
+	}
+
+	weights := make(BandwidthWeights)
+	for _, word := range words[1:] {
+		keyValue := strings.SplitN(word, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(keyValue[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		weights[keyValue[0]] = float64(value) / scale
+	}
+
+	return weights
+}
+
+// ParseBandwidthWeights extracts the bandwidth weights from the footer of the
+// given consensus document.  If the consensus has no bandwidth weights, as is
+// the case for consensuses that were made before Tor's path selection became
+// weighted, nil is returned.
+func ParseBandwidthWeights(document []byte) BandwidthWeights {
+
+	_, weights := ParseFlagsAndWeights(document)
+
+	return weights
+}
+
+// weight returns the bandwidth weight with the given name.  Without bandwidth
+// weights, clients use relays in every position, so the weight is one.
+// Weights that are missing in the footer, such as "Wge", are zero.
+func (w BandwidthWeights) weight(name string) float64 {
+
+	if w == nil {
+		return 1
+	}
+
+	return w[name]
+}
+
+// Position returns the fractions of a relay's bandwidth that clients use in
+// guard and in exit position, given the relay's flags.
+func (w BandwidthWeights) Position(flags *tor.RouterFlags) (guard, exit float64) {
+
+	isGuard := flags.Guard
+	isExit := flags.Exit && !flags.BadExit
+
+	switch {
+	case isGuard && isExit:
+		return w.weight("Wgd"), w.weight("Wed")
+	case isGuard:
+		return w.weight("Wgg"), w.weight("Weg")
+	case isExit:
+		return w.weight("Wge"), w.weight("Wee")
+	default:
+		return w.weight("Wgm"), w.weight("Wem")
+	}
+}
@@ -2,189 +2,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"sort"
-	"sync"
-	"time"
 
+	"github.com/NullHypothesis/sybilhunter/neighbours"
 	tor "github.com/NullHypothesis/zoossh"
-	vptree "github.com/DataWraith/vptree"
 )
 
-type FingerprintMap map[tor.Fingerprint]bool
+// printNeighbours writes the given nearest neighbours to the given sink.  If
+// verbose is true, the strings that were compared are printed too.
+func printNeighbours(result *neighbours.Result, verbose bool, params *CmdLineParams, sink Sink) {
 
-// QuadraticComparison determines pairwise relay similarities for all relays in
-// the given object set.  If the given threshold is not 0, only relay pairs
-// whose distance fall under the threshold are printed to stdout.  distFunc is
-// used as distance function.
-func QuadraticComparison(objects tor.ObjectSet, distFunc Distance, threshold float32) {
-
-	// Turn the relays' fingerprints into a list.
-	size := objects.Length()
-	fprs := make([]tor.Fingerprint, size)
-
-	i := 0
-	for obj := range objects.Iterate(nil) {
-		fprs[i] = obj.GetFingerprint()
-		i++
-	}
-
-	// Compute pairwise relay similarities.
-	for i := 0; i < size; i++ {
-
-		fpr1 := fprs[i]
-		for j := i + 1; j < size; j++ {
-
-			fpr2 := fprs[j]
-			obj1, _ := objects.GetObject(fpr1)
-			obj2, _ := objects.GetObject(fpr2)
-
-			distance := distFunc(obj1, obj2)
-
-			if (threshold == 0) || (distance < threshold) {
-				fmt.Printf("Dist(%s, %s) : %.3f\n", fpr1[:8], fpr2[:8], distance)
-			}
-		}
-	}
-}
-
-// LinearSearch linearly searches for nearest neighbours to the given relay
-// identified by its fingerprint.  THe result is printed to stdout.
-func LinearSearch(objects tor.ObjectSet, params *CmdLineParams) (FingerprintMap, error) {
-
-	rootrelay := tor.Fingerprint(params.ReferenceRelay)
-	relayDists := RelayDistances{}
-	foundNeighbours := make(FingerprintMap)
-
-	log.Printf("Running linear search for relay %s.", rootrelay)
-
-	// Get router status and corresponding descriptor for target relay.
-	targetRelay, found := objects.GetObject(tor.SanitiseFingerprint(rootrelay))
-	if !found {
-		return nil, fmt.Errorf("Could not find relay with fingerprint %s.", rootrelay)
-	}
-	targetStatus := targetRelay.(*tor.RouterStatus)
-	targetDesc, err := tor.LoadDescriptorFromDigest(params.DescriptorDir, targetStatus.Digest, targetStatus.Publication)
-	if err != nil {
-		return nil, err
-	}
-
-	// Now determine Levenshtein distance to all relays in given object set.
-	for object := range objects.Iterate(nil) {
-		status := object.(*tor.RouterStatus)
-		if status.Fingerprint == targetStatus.Fingerprint {
+	target := result.Target
+	for i, neighbour := range result.Neighbours {
+		if params.Format == jsonFormat {
+			emitNeighbour(target, neighbour.Status, neighbour.Distance, i+1, sink)
 			continue
 		}
-		desc, err := tor.LoadDescriptorFromDigest(params.DescriptorDir, status.Digest, status.Publication)
-		if err != nil {
-			return nil, err
-		}
 
-		distance := Levenshtein(targetStatus, status, targetDesc, desc)
-		relayDists.Add(status, distance)
-	}
-	log.Printf("Calculated %d distances.", len(relayDists.Distances))
+		if verbose {
+			_, comparedBlurb := neighbours.LevenshteinVerbose(neighbour.Status, target,
+				neighbour.Descriptor, result.TargetDescriptor)
+			fmt.Fprintln(sink, comparedBlurb)
+		}
 
-	// Sort distances and print top n.
-	sort.Sort(relayDists)
-	for i := 0; i < params.Neighbours; i++ {
-		foundNeighbours[relayDists.Relays[i].Fingerprint] = true
-		fmt.Printf("Dist(%s, %s) = %.0f, <https://atlas.torproject.org/#details/%s>\n\n",
-			targetRelay.GetFingerprint()[:8],
-			relayDists.Relays[i].GetFingerprint()[:8],
-			relayDists.Distances[i],
-			relayDists.Relays[i].GetFingerprint())
+		fmt.Fprintf(sink, "Dist(%s, %s) = %.0f, <https://atlas.torproject.org/#details/%s>\n\n",
+			target.Fingerprint[:8],
+			neighbour.Status.Fingerprint[:8],
+			neighbour.Distance,
+			neighbour.Status.Fingerprint)
 	}
-
-	return foundNeighbours, nil
 }
 
-// VantagePointTreeSearch builds a vantage point tree out of the given objects.
-// It then attempts to find the nearest neighbours to the given relay
-// identified by its fingerprint.  The result is printed to stdout.
-func VantagePointTreeSearch(objects tor.ObjectSet, params *CmdLineParams) (FingerprintMap, error) {
-
-	rootrelay := tor.Fingerprint(params.ReferenceRelay)
-	neighbours := params.Neighbours
-
-	foundNeighbours := make(FingerprintMap)
-
-	// Find the relay whose distance to all other relays is to be determined.
-	targetRelay, found := objects.GetObject(tor.SanitiseFingerprint(rootrelay))
-	if !found {
-		return nil, fmt.Errorf("Could not find relay with fingerprint %s.", rootrelay)
-	}
-
-	// Convert object set to interface{} slice because that's what the
-	// levenshtein package expects.
-	objSlice := make([]interface{}, objects.Length())
-	i := 0
-	for obj := range objects.Iterate(params.Filter) {
-		objSlice[i] = interface{}(obj)
-		i++
-	}
-
-	// We need a wrapper for Levenshtein() because the levenshtein package's
-	// function signature differs from our Distance type.
-	lvnst := func(stat1, stat2 interface{}) float64 {
-		status1 := stat1.(*tor.RouterStatus)
-		status2 := stat2.(*tor.RouterStatus)
-		desc1, _ := tor.LoadDescriptorFromDigest(params.DescriptorDir, status1.Digest, status1.Publication)
-		desc2, _ := tor.LoadDescriptorFromDigest(params.DescriptorDir, status2.Digest, status2.Publication)
-		return float64(Levenshtein(status1, status2, desc1, desc2))
-	}
-
-	log.Println("Building vantage point tree.")
-	now := time.Now()
-	tree := vptree.New(lvnst, objSlice)
-	log.Printf("Done building vantage point tree after %s.", time.Since(now))
-
-	log.Printf("Searching %d nearest neighbours to %s.\n", neighbours, rootrelay)
-	now = time.Now()
-	similarRelays, distances := tree.Search(targetRelay, neighbours+1)
-	log.Printf("Found relays after looking for %s.", time.Since(now))
-
-	targetStatus := targetRelay.(*tor.RouterStatus)
-	targetDesc, _ := tor.LoadDescriptorFromDigest(params.DescriptorDir, targetStatus.Digest, targetStatus.Publication)
-	// We skip the most similar relay because it's targetRelay.
-	for i := 1; i < len(similarRelays); i++ {
-
-		similarRelay := similarRelays[i].(*tor.RouterStatus)
-		similarDesc, _ := tor.LoadDescriptorFromDigest(params.DescriptorDir, similarRelay.Digest, similarRelay.Publication)
-
-		foundNeighbours[similarRelay.Fingerprint] = true
-
-		_, comparedBlurb := LevenshteinVerbose(similarRelay, targetStatus, similarDesc, targetDesc)
-		fmt.Println(comparedBlurb)
+// emitNeighbour emits a record for the given neighbour of the given target
+// relay to the given sink.  The rank is 1 for the nearest neighbour.
+func emitNeighbour(target, neighbour *tor.RouterStatus, distance float32, rank int, sink Sink) {
 
-		fmt.Printf("Dist(%s, %s) = %.0f, <https://atlas.torproject.org/#details/%s>\n\n",
-			targetRelay.GetFingerprint()[:8],
-			similarRelay.GetFingerprint()[:8],
-			distances[i],
-			similarRelay.GetFingerprint())
-	}
-
-	return foundNeighbours, nil
+	record := NewRecord("neighbours", "neighbour", neighbour.Publication,
+		target.Fingerprint, neighbour.Fingerprint)
+	record.Data["nickname"] = neighbour.Nickname
+	record.Data["distance"] = distance
+	record.Data["rank"] = rank
+	sink.Emit(record)
 }
 
 // FindNearestNeighbours attempts to find the n nearest neighbours for the
 // given reference relay.
-func FindNearestNeighbours(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
+func FindNearestNeighbours(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
-	defer group.Done()
+	rootrelay := tor.Fingerprint(params.ReferenceRelay)
 
 	for objects := range channel {
 		if params.SearchAlg == "linear" {
-			if _, err := LinearSearch(objects, params); err != nil {
-				log.Fatal(err)
+			result, err := neighbours.LinearSearch(ctx, objects, rootrelay, params.Descriptors, params.Neighbours)
+			if result != nil {
+				printNeighbours(result, false, params, sink)
+			}
+			if err != nil {
+				return err
 			}
 		} else if params.SearchAlg == "vptree" {
-			if _, err := VantagePointTreeSearch(objects, params); err != nil {
-				log.Fatal(err)
+			result, err := neighbours.VantagePointTreeSearch(ctx, objects, rootrelay, params.Descriptors, params.Neighbours, params.Filter)
+			if err != nil {
+				return err
 			}
+			printNeighbours(result, true, params, sink)
 		} else {
-			log.Fatalf("Invalid search algorithm %q.  Must be \"linear\" or \"vptree\".", params.SearchAlg)
+			return fmt.Errorf("Invalid search algorithm %q.  Must be \"linear\" or \"vptree\".", params.SearchAlg)
 		}
 	}
+
+	return nil
 }
@@ -1,13 +1,11 @@
 // Distance metrics for Tor objects.
-package main
+package neighbours
 
 import (
 	"fmt"
 
 	tor "github.com/NullHypothesis/zoossh"
-	cluster "github.com/NullHypothesis/mlgo/cluster"
 	levenshtein "github.com/arbovm/levenshtein"
-	statistics "github.com/mcgrew/gostats"
 )
 
 // RelayDistances contains a slice for relays and their corresponding distance
@@ -53,17 +51,6 @@ func Levenshtein(stat1, stat2 *tor.RouterStatus, desc1, desc2 *tor.RouterDescrip
 	return distance
 }
 
-// PearsonWrapper is a wrapper around PearsonCorrelation.
-func PearsonWrapper(a, b cluster.Vector) float64 {
-	return 1 - PearsonCorrelation(a, b)
-}
-
-// PearsonCorrelation determines the Pearson correlation coefficient.
-func PearsonCorrelation(a, b []float64) float64 {
-
-	return statistics.PearsonCorrelation(a, b)
-}
-
 // LevenshteinVerbose determines the Levenshtein distance, a string metric,
 // between the given router statuses and descriptors.
 func LevenshteinVerbose(status1, status2 *tor.RouterStatus, desc1, desc2 *tor.RouterDescriptor) (float32, string) {
@@ -113,3 +100,32 @@ func LevenshteinVerbose(status1, status2 *tor.RouterStatus, desc1, desc2 *tor.Ro
 
 	return float32(levenshtein.Distance(str1, str2)), verbose
 }
+
+// RouterFlagsToString converts a RouterFlags struct to a constant-size string
+// containing a series of bits.
+func RouterFlagsToString(flags *tor.RouterFlags) string {
+
+	// Convert a boolean value to 1 or 0.
+	b2i := func(flag bool) int {
+		if flag == true {
+			return 1
+		} else {
+			return 0
+		}
+	}
+
+	return fmt.Sprintf("%d%d%d%d%d%d%d%d%d%d%d%d%d",
+		b2i(flags.Authority),
+		b2i(flags.BadExit),
+		b2i(flags.Exit),
+		b2i(flags.Fast),
+		b2i(flags.Guard),
+		b2i(flags.HSDir),
+		b2i(flags.Named),
+		b2i(flags.Stable),
+		b2i(flags.Running),
+		b2i(flags.Unnamed),
+		b2i(flags.Valid),
+		b2i(flags.V2Dir),
+		b2i(flags.Authority))
+}
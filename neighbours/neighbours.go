@@ -0,0 +1,214 @@
+// Package neighbours determines the nearest neighbours of Tor relays, i.e.,
+// the relays that are most similar to a given reference relay.
+package neighbours
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	vptree "github.com/DataWraith/vptree"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// DescriptorLoader loads router descriptors, e.g., from a directory or an
+// indexed descriptor store.
+type DescriptorLoader interface {
+	// LoadDescriptor returns the router descriptor with the given digest,
+	// which was published around the given time.
+	LoadDescriptor(digest string, published time.Time) (*tor.RouterDescriptor, error)
+}
+
+// DirLoader loads router descriptors from a directory that contains unpacked
+// CollecTor archives, e.g., server-descriptors-2015-08/.
+type DirLoader string
+
+// LoadDescriptor implements the DescriptorLoader interface.
+func (dir DirLoader) LoadDescriptor(digest string, published time.Time) (*tor.RouterDescriptor, error) {
+
+	return tor.LoadDescriptorFromDigest(string(dir), digest, published)
+}
+
+// Pair is a pair of relays together with their distance.
+type Pair struct {
+	Fingerprint1 tor.Fingerprint
+	Fingerprint2 tor.Fingerprint
+	Distance     float32
+}
+
+// Neighbour is a relay together with its distance to a reference relay.  If
+// the relay's descriptor could not be loaded, Descriptor is nil.
+type Neighbour struct {
+	Status     *tor.RouterStatus
+	Descriptor *tor.RouterDescriptor
+	Distance   float32
+}
+
+// Result holds the reference relay and its nearest neighbours, ordered by
+// distance, nearest first.
+type Result struct {
+	Target           *tor.RouterStatus
+	TargetDescriptor *tor.RouterDescriptor
+	Neighbours       []Neighbour
+}
+
+// QuadraticComparison determines pairwise relay similarities for all relays in
+// the given object set.  If the given threshold is not 0, only relay pairs
+// whose distance fall under the threshold are returned.  distFunc is used as
+// distance function.
+func QuadraticComparison(objects tor.ObjectSet, distFunc Distance, threshold float32) []Pair {
+
+	var pairs []Pair
+
+	// Turn the relays' fingerprints into a list.
+	size := objects.Length()
+	fprs := make([]tor.Fingerprint, size)
+
+	i := 0
+	for obj := range objects.Iterate(nil) {
+		fprs[i] = obj.GetFingerprint()
+		i++
+	}
+
+	// Compute pairwise relay similarities.
+	for i := 0; i < size; i++ {
+
+		fpr1 := fprs[i]
+		for j := i + 1; j < size; j++ {
+
+			fpr2 := fprs[j]
+			obj1, _ := objects.GetObject(fpr1)
+			obj2, _ := objects.GetObject(fpr2)
+
+			distance := distFunc(obj1, obj2)
+
+			if (threshold == 0) || (distance < threshold) {
+				pairs = append(pairs, Pair{fpr1, fpr2, distance})
+			}
+		}
+	}
+
+	return pairs
+}
+
+// LinearSearch linearly searches for the n nearest neighbours to the given
+// relay identified by its fingerprint.  Relay descriptors are loaded from the
+// given descriptor loader.  If the given context is cancelled, the search
+// stops, and the nearest neighbours among the relays we got to are returned,
+// together with the context's error.
+func LinearSearch(ctx context.Context, objects tor.ObjectSet, rootrelay tor.Fingerprint, loader DescriptorLoader, n int) (*Result, error) {
+
+	relayDists := RelayDistances{}
+
+	log.Printf("Running linear search for relay %s.", rootrelay)
+
+	// Get router status and corresponding descriptor for target relay.
+	targetRelay, found := objects.GetObject(tor.SanitiseFingerprint(rootrelay))
+	if !found {
+		return nil, fmt.Errorf("Could not find relay with fingerprint %s.", rootrelay)
+	}
+	targetStatus := targetRelay.(*tor.RouterStatus)
+	targetDesc, err := loader.LoadDescriptor(targetStatus.Digest, targetStatus.Publication)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now determine Levenshtein distance to all relays in given object set.
+	descs := make(map[tor.Fingerprint]*tor.RouterDescriptor)
+	for object := range objects.Iterate(nil) {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		status := object.(*tor.RouterStatus)
+		if status.Fingerprint == targetStatus.Fingerprint {
+			continue
+		}
+		desc, err := loader.LoadDescriptor(status.Digest, status.Publication)
+		if err != nil {
+			return nil, err
+		}
+		descs[status.Fingerprint] = desc
+
+		distance := Levenshtein(targetStatus, status, targetDesc, desc)
+		relayDists.Add(status, distance)
+	}
+	log.Printf("Calculated %d distances.", len(relayDists.Distances))
+
+	// Sort distances and keep top n.
+	sort.Sort(relayDists)
+	result := &Result{Target: targetStatus, TargetDescriptor: targetDesc}
+	for i := 0; i < n && i < len(relayDists.Relays); i++ {
+		relay := relayDists.Relays[i]
+		result.Neighbours = append(result.Neighbours,
+			Neighbour{relay, descs[relay.Fingerprint], relayDists.Distances[i]})
+	}
+
+	return result, err
+}
+
+// VantagePointTreeSearch builds a vantage point tree out of the given objects.
+// It then attempts to find the n nearest neighbours to the given relay
+// identified by its fingerprint.  Only objects that match the given filter are
+// part of the tree.  Relay descriptors are loaded from the given descriptor
+// loader.  Building the tree cannot be interrupted, but if the given context
+// is cancelled before, no search takes place and the context's error is
+// returned.
+func VantagePointTreeSearch(ctx context.Context, objects tor.ObjectSet, rootrelay tor.Fingerprint, loader DescriptorLoader, n int, filter *tor.ObjectFilter) (*Result, error) {
+
+	// Find the relay whose distance to all other relays is to be determined.
+	targetRelay, found := objects.GetObject(tor.SanitiseFingerprint(rootrelay))
+	if !found {
+		return nil, fmt.Errorf("Could not find relay with fingerprint %s.", rootrelay)
+	}
+
+	// Convert object set to interface{} slice because that's what the
+	// levenshtein package expects.
+	objSlice := make([]interface{}, objects.Length())
+	i := 0
+	for obj := range objects.Iterate(filter) {
+		objSlice[i] = interface{}(obj)
+		i++
+	}
+
+	// We need a wrapper for Levenshtein() because the levenshtein package's
+	// function signature differs from our Distance type.
+	lvnst := func(stat1, stat2 interface{}) float64 {
+		status1 := stat1.(*tor.RouterStatus)
+		status2 := stat2.(*tor.RouterStatus)
+		desc1, _ := loader.LoadDescriptor(status1.Digest, status1.Publication)
+		desc2, _ := loader.LoadDescriptor(status2.Digest, status2.Publication)
+		return float64(Levenshtein(status1, status2, desc1, desc2))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Println("Building vantage point tree.")
+	now := time.Now()
+	tree := vptree.New(lvnst, objSlice)
+	log.Printf("Done building vantage point tree after %s.", time.Since(now))
+
+	log.Printf("Searching %d nearest neighbours to %s.\n", n, rootrelay)
+	now = time.Now()
+	similarRelays, distances := tree.Search(targetRelay, n+1)
+	log.Printf("Found relays after looking for %s.", time.Since(now))
+
+	targetStatus := targetRelay.(*tor.RouterStatus)
+	targetDesc, _ := loader.LoadDescriptor(targetStatus.Digest, targetStatus.Publication)
+	result := &Result{Target: targetStatus, TargetDescriptor: targetDesc}
+
+	// We skip the most similar relay because it's targetRelay.
+	for i := 1; i < len(similarRelays); i++ {
+
+		similarRelay := similarRelays[i].(*tor.RouterStatus)
+		similarDesc, _ := loader.LoadDescriptor(similarRelay.Digest, similarRelay.Publication)
+
+		result.Neighbours = append(result.Neighbours,
+			Neighbour{similarRelay, similarDesc, float32(distances[i])})
+	}
+
+	return result, nil
+}
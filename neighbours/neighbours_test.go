@@ -0,0 +1,86 @@
+// Test finding similar relays.
+
+package neighbours
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// bandwidthDistance is the difference between two relays' bandwidth.
+func bandwidthDistance(obj1, obj2 tor.Object) float32 {
+
+	bw1, bw2 := obj1.(*tor.RouterStatus).Bandwidth, obj2.(*tor.RouterStatus).Bandwidth
+	if bw1 > bw2 {
+		return float32(bw1 - bw2)
+	}
+
+	return float32(bw2 - bw1)
+}
+
+func TestQuadraticComparison(t *testing.T) {
+
+	consensus := tor.NewConsensus()
+	for fingerprint, bandwidth := range map[tor.Fingerprint]uint64{"A": 100, "B": 105, "C": 200} {
+		consensus.Set(fingerprint, &tor.RouterStatus{Fingerprint: fingerprint, Bandwidth: bandwidth})
+	}
+
+	tests := []struct {
+		threshold float32
+		pairs     []string
+	}{
+		// A threshold of zero returns all pairs.
+		{0, []string{"AB 5", "AC 100", "BC 95"}},
+		{10, []string{"AB 5"}},
+		{5, nil},
+	}
+
+	for _, test := range tests {
+		var pairs []string
+		for _, pair := range QuadraticComparison(consensus, bandwidthDistance, test.threshold) {
+			fprs := []string{string(pair.Fingerprint1), string(pair.Fingerprint2)}
+			sort.Strings(fprs)
+			pairs = append(pairs, fprs[0]+fprs[1]+" "+formatDistance(pair.Distance))
+		}
+		sort.Strings(pairs)
+
+		if len(pairs) != len(test.pairs) {
+			t.Errorf("Threshold %f: pairs are %v, but expected %v.", test.threshold, pairs, test.pairs)
+			continue
+		}
+		for i := range pairs {
+			if pairs[i] != test.pairs[i] {
+				t.Errorf("Threshold %f: pairs are %v, but expected %v.", test.threshold, pairs, test.pairs)
+				break
+			}
+		}
+	}
+}
+
+// formatDistance formats the given distance without decimals.
+func formatDistance(distance float32) string {
+
+	return fmt.Sprintf("%.0f", distance)
+}
+
+func TestRouterFlagsToString(t *testing.T) {
+
+	tests := []struct {
+		flags    tor.RouterFlags
+		expected string
+	}{
+		{tor.RouterFlags{}, "0000000000000"},
+		{tor.RouterFlags{Exit: true, Guard: true}, "0010100000000"},
+		// The Authority flag is both the first and the last bit.
+		{tor.RouterFlags{Authority: true}, "1000000000001"},
+	}
+
+	for _, test := range tests {
+		if s := RouterFlagsToString(&test.flags); s != test.expected {
+			t.Errorf("Flags %+v are %s, but expected %s.", test.flags, s, test.expected)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Walk over archive data in chronological rather than file system order.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	zstd "github.com/klauspost/compress/zstd"
+)
+
+// InRangeFunc decides, given a document's name and the beginning of its
+// content, if the document is in the desired date range.
+type InRangeFunc func(string, []byte) bool
+
+// IndexEntry identifies a single document by the file it's stored in and its
+// position within that file.  Plain files contain exactly one document while
+// archives can contain many.
+type IndexEntry struct {
+	File      string
+	FileIndex int
+	Ordinal   int
+	Name      string
+	Info      os.FileInfo
+	Timestamp time.Time
+	Digest    [sha256.Size]byte
+
+	// Spilled is the name of the file that holds the spilled document, or
+	// empty if the document is a plain file.
+	Spilled string
+}
+
+// removeSpilled removes the index entry's spilled document, if any.
+func (e *IndexEntry) removeSpilled() {
+
+	if e.Spilled != "" {
+		os.Remove(e.Spilled)
+		e.Spilled = ""
+	}
+}
+
+// ByTimestamp sorts index entries by time stamp.  Entries with identical time
+// stamps keep the order in which they were found.
+type ByTimestamp []*IndexEntry
+
+// Implement the sort interface (1/3).
+func (bt ByTimestamp) Len() int {
+	return len(bt)
+}
+
+// Implement the sort interface (2/3).
+func (bt ByTimestamp) Swap(i, j int) {
+	bt[i], bt[j] = bt[j], bt[i]
+}
+
+// Implement the sort interface (3/3).
+func (bt ByTimestamp) Less(i, j int) bool {
+
+	if !bt[i].Timestamp.Equal(bt[j].Timestamp) {
+		return bt[i].Timestamp.Before(bt[j].Timestamp)
+	}
+	if bt[i].FileIndex != bt[j].FileIndex {
+		return bt[i].FileIndex < bt[j].FileIndex
+	}
+
+	return bt[i].Ordinal < bt[j].Ordinal
+}
+
+// listFiles returns all regular files in the given sources, which can be files
+// or directories.  Paths that cannot be walked are passed to onError.
+func listFiles(sources []string, onError ErrorFunc) ([]string, []os.FileInfo, error) {
+
+	var files []string
+	var infos []os.FileInfo
+
+	for _, source := range sources {
+		err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return onError(path, err)
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, path)
+				infos = append(infos, info)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return files, infos, nil
+}
+
+// isPlainFile returns true if the given file is neither compressed nor an
+// archive, so its document can be read again at little cost.
+func isPlainFile(path string) (bool, error) {
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	header := make([]byte, maxMagicLength)
+	n, err := fd.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return matchArchiveFormat(header[:n]) == nil, nil
+}
+
+// spiller writes documents to compressed files in a temporary directory, so
+// archives don't have to be decompressed again when it's their documents'
+// turn.
+type spiller struct {
+	dir     string
+	encoder *zstd.Encoder
+}
+
+// newSpiller creates a new temporary directory for spilled documents.
+func newSpiller() (*spiller, error) {
+
+	dir, err := ioutil.TempDir("", "sybilhunter_spill_")
+	if err != nil {
+		return nil, err
+	}
+
+	// Spilled documents are read only once, so we favour speed over size.
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &spiller{dir: dir, encoder: encoder}, nil
+}
+
+// spill copies the given document to a new spill file and to the given writer,
+// and returns the spill file's name.
+func (s *spiller) spill(r io.Reader, w io.Writer) (string, error) {
+
+	fd, err := ioutil.TempFile(s.dir, "spill_")
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	s.encoder.Reset(fd)
+	if _, err = io.Copy(io.MultiWriter(s.encoder, w), r); err == nil {
+		err = s.encoder.Close()
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+
+	return fd.Name(), nil
+}
+
+// close removes the spill directory with all spill files that are left.
+func (s *spiller) close() {
+
+	s.encoder.Close()
+	os.RemoveAll(s.dir)
+}
+
+// indexFiles walks the given files and returns an index entry for every
+// document it finds.  The document's time stamp is taken from its file name
+// or, failing that, from its header.  Documents that the given function deems
+// out of range are left out before they are read in full, as are documents
+// that are identical to a document that was seen before.  Documents in
+// compressed files and archives are spilled, so every file is decompressed
+// only once.  Files that cannot be walked are passed to onError, and none of
+// their documents are indexed.  Indexing stops once the given context is
+// cancelled.
+func indexFiles(ctx context.Context, files []string, infos []os.FileInfo, inRange InRangeFunc, spill *spiller, onError ErrorFunc) ([]*IndexEntry, error) {
+
+	var index []*IndexEntry
+	seen := make(map[[sha256.Size]byte]bool)
+	duplicates, outOfRange := 0, 0
+
+	for i, file := range files {
+		var fileIndex []*IndexEntry
+
+		plain, err := isPlainFile(file)
+		if err == nil {
+			err = walkFile(file, infos[i], func(name string, info os.FileInfo, r io.Reader) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+
+				br := bufio.NewReaderSize(r, timestampPeekSize)
+				header, _ := br.Peek(timestampPeekSize)
+				if inRange != nil && !inRange(name, header) {
+					outOfRange++
+					return nil
+				}
+				timestamp, ok := filenameTimestamp(name)
+				if !ok {
+					timestamp = documentTimestamp(header)
+				}
+
+				entry := &IndexEntry{
+					File:      file,
+					FileIndex: i,
+					Ordinal:   len(fileIndex),
+					Name:      name,
+					Info:      info,
+					Timestamp: timestamp,
+				}
+
+				// Hash the entire document, so we can detect duplicates.
+				hash := sha256.New()
+				var err error
+				if plain {
+					_, err = io.Copy(hash, br)
+				} else {
+					entry.Spilled, err = spill.spill(br, hash)
+				}
+				if err != nil {
+					return err
+				}
+				copy(entry.Digest[:], hash.Sum(nil))
+
+				fileIndex = append(fileIndex, entry)
+				return nil
+			})
+		}
+		if err != nil {
+			for _, entry := range fileIndex {
+				entry.removeSpilled()
+			}
+			if err = onError(file, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, entry := range fileIndex {
+			if seen[entry.Digest] {
+				entry.removeSpilled()
+				duplicates++
+				continue
+			}
+			seen[entry.Digest] = true
+			index = append(index, entry)
+		}
+	}
+
+	if outOfRange > 0 {
+		log.Printf("Skipped %d documents that aren't in the desired date range.\n", outOfRange)
+	}
+	if duplicates > 0 {
+		log.Printf("Discarded %d duplicate documents.\n", duplicates)
+	}
+
+	return index, nil
+}
+
+// walkEntry passes the document of the given index entry to the callback.
+// Spilled documents are removed afterwards.
+func walkEntry(entry *IndexEntry, callback WalkFunc) error {
+
+	if entry.Spilled == "" {
+		fd, err := os.Open(entry.File)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		return callback(entry.Name, entry.Info, fd)
+	}
+
+	defer entry.removeSpilled()
+
+	fd, err := os.Open(entry.Spilled)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	r, err := zstdReader(fd)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return callback(entry.Name, entry.Info, r)
+}
+
+// walkChronologically walks over all documents in the given sources and passes
+// them to callback in chronological order, regardless of the order in which
+// they appear in the file system or in archives.  Documents that are contained
+// in several sources are passed only once.  If the given function isn't nil,
+// only documents that it deems in range are passed.
+//
+// To that end, the documents are first indexed by their time stamp.  While
+// we index the documents in range, those in compressed files and archives are
+// spilled to a temporary directory, compressed with zstd, so that we don't
+// have to decompress their files a second time.  Documents out of range are
+// never spilled.  We then pass the documents to the callback in chronological
+// order.  The walk stops once the given context is cancelled.
+func walkChronologically(ctx context.Context, sources []string, inRange InRangeFunc, callback WalkFunc, onError ErrorFunc) error {
+
+	files, infos, err := listFiles(sources, onError)
+	if err != nil {
+		return err
+	}
+
+	spill, err := newSpiller()
+	if err != nil {
+		return err
+	}
+	defer spill.close()
+
+	log.Printf("Indexing time stamps of documents in %d files.\n", len(files))
+	index, err := indexFiles(ctx, files, infos, inRange, spill, onError)
+	if err != nil {
+		return err
+	}
+	log.Printf("Indexed %d documents.\n", len(index))
+	sort.Stable(ByTimestamp(index))
+
+	for _, entry := range index {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walkEntry(entry, callback); err != nil {
+			if err = onError(entry.File, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
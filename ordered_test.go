@@ -0,0 +1,179 @@
+// Test walking over archive data in chronological order.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// consensusFixture returns the file name and content of a consensus that was
+// published at the given hour of August 1, 2015.
+func consensusFixture(hour int) (string, string) {
+
+	name := fmt.Sprintf("consensuses-2015-08/01/2015-08-01-%02d-00-00-consensus", hour)
+	content := fmt.Sprintf("network-status-version 3\nvalid-after 2015-08-01 %02d:00:00\n", hour)
+
+	return name, content
+}
+
+// consensusArchive returns archive entries holding the consensuses of the
+// given hours.
+func consensusArchive(hours ...int) map[string]string {
+
+	entries := make(map[string]string)
+	for _, hour := range hours {
+		name, content := consensusFixture(hour)
+		entries[name] = content
+	}
+
+	return entries
+}
+
+// walkChronologicalFixtures walks over the given sources in chronological
+// order, and returns the base names of the documents in the order in which
+// they were walked, and the files that onError was called for.  If the given
+// function isn't nil, only documents in its range are walked.
+func walkChronologicalFixtures(t *testing.T, sources []string, inRange InRangeFunc) ([]string, []string) {
+
+	var walked, failed []string
+	callback := func(name string, info os.FileInfo, r io.Reader) error {
+		if _, err := ioutil.ReadAll(r); err != nil {
+			return err
+		}
+		walked = append(walked, path.Base(name))
+		return nil
+	}
+	onError := func(name string, err error) error {
+		failed = append(failed, name)
+		return nil
+	}
+
+	if err := walkChronologically(context.Background(), sources, inRange, callback, onError); err != nil {
+		t.Fatalf("Chronological walk failed: %s", err)
+	}
+
+	return walked, failed
+}
+
+func TestWalkChronologically(t *testing.T) {
+
+	plainName, plainContent := consensusFixture(4)
+	sources := []string{
+		writeFixture(t, "a.tar.xz", makeXZ(t, makeTar(t, consensusArchive(2, 0)))),
+		// The consensus of hour 2 is a duplicate.
+		writeFixture(t, "b.tar.gz", makeGzip(t, makeTar(t, consensusArchive(3, 1, 2)))),
+		writeFixture(t, path.Base(plainName), []byte(plainContent)),
+	}
+
+	walked, failed := walkChronologicalFixtures(t, sources, nil)
+	if len(failed) > 0 {
+		t.Errorf("Walk failed for %v.", failed)
+	}
+
+	var expected []string
+	for hour := 0; hour <= 4; hour++ {
+		name, _ := consensusFixture(hour)
+		expected = append(expected, path.Base(name))
+	}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Walked %v, but expected %v.", walked, expected)
+	}
+}
+
+func TestWalkChronologicallyBrokenArchive(t *testing.T) {
+
+	broken := makeXZ(t, makeTar(t, consensusArchive(0, 1, 2)))
+	broken = broken[:len(broken)-4]
+	brokenPath := writeFixture(t, "broken.tar.xz", broken)
+	sources := []string{
+		brokenPath,
+		writeFixture(t, "good.tar.xz", makeXZ(t, makeTar(t, consensusArchive(3)))),
+	}
+
+	walked, failed := walkChronologicalFixtures(t, sources, nil)
+
+	// The broken archive is reported once, and none of its documents are
+	// walked.
+	if !reflect.DeepEqual(failed, []string{brokenPath}) {
+		t.Errorf("Walk failed for %v, but expected only %s.", failed, brokenPath)
+	}
+	name, _ := consensusFixture(3)
+	if expected := []string{path.Base(name)}; !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Walked %v, but expected %v.", walked, expected)
+	}
+}
+
+// hoursInRange returns a function that deems the documents of August 1, 2015,
+// from the given first to the given last hour in range.
+func hoursInRange(first, last int) InRangeFunc {
+
+	startDate := time.Date(2015, 8, 1, first, 0, 0, 0, time.UTC)
+	endDate := time.Date(2015, 8, 1, last, 59, 59, 0, time.UTC)
+
+	return func(name string, header []byte) bool {
+		return fileInRange(name, header, startDate, endDate)
+	}
+}
+
+func TestWalkChronologicallyDateRange(t *testing.T) {
+
+	plainName, plainContent := consensusFixture(4)
+	sources := []string{
+		writeFixture(t, "a.tar.xz", makeXZ(t, makeTar(t, consensusArchive(3, 2, 1, 0)))),
+		writeFixture(t, path.Base(plainName), []byte(plainContent)),
+	}
+
+	walked, failed := walkChronologicalFixtures(t, sources, hoursInRange(1, 2))
+	if len(failed) > 0 {
+		t.Errorf("Walk failed for %v.", failed)
+	}
+
+	var expected []string
+	for hour := 1; hour <= 2; hour++ {
+		name, _ := consensusFixture(hour)
+		expected = append(expected, path.Base(name))
+	}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Walked %v, but expected %v.", walked, expected)
+	}
+}
+
+func TestIndexFilesDateRange(t *testing.T) {
+
+	source := writeFixture(t, "a.tar.xz", makeXZ(t, makeTar(t, consensusArchive(3, 2, 1, 0))))
+	files, infos, err := listFiles([]string{source}, nil)
+	if err != nil {
+		t.Fatalf("Listing files failed: %s", err)
+	}
+
+	spill, err := newSpiller()
+	if err != nil {
+		t.Fatalf("Creating spiller failed: %s", err)
+	}
+	defer spill.close()
+
+	index, err := indexFiles(context.Background(), files, infos, hoursInRange(2, 3), spill, nil)
+	if err != nil {
+		t.Fatalf("Indexing failed: %s", err)
+	}
+	if len(index) != 2 {
+		t.Errorf("Indexed %d documents, but expected 2.", len(index))
+	}
+
+	// Documents out of range aren't spilled.
+	spilled, err := ioutil.ReadDir(spill.dir)
+	if err != nil {
+		t.Fatalf("Reading spill directory failed: %s", err)
+	}
+	if len(spilled) != len(index) {
+		t.Errorf("Spilled %d documents, but expected %d.", len(spilled), len(index))
+	}
+}
@@ -0,0 +1,261 @@
+// Parse files concurrently and deliver the result in chronological order.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// parseJob is a file whose content is waiting to be parsed.
+type parseJob struct {
+	seq     int
+	path    string
+	content []byte
+}
+
+// parseResult is a parsed file.  The size of the file's content is used to
+// estimate the memory that the object set occupies.
+type parseResult struct {
+	seq     int
+	path    string
+	size    int
+	objects tor.ObjectSet
+}
+
+// timestamp returns the time that is used to order the parse result.  Object
+// sets without a time stamp, e.g., router descriptors, return the zero time,
+// so they keep their input order.
+func (r *parseResult) timestamp() time.Time {
+
+	if consensus, ok := microdesc.ConsensusOf(r.objects); ok {
+		return consensus.ValidAfter
+	}
+
+	return time.Time{}
+}
+
+// ReorderBuffer is a min-heap of parse results, ordered by time stamp and, for
+// identical time stamps, by input order.  It implements heap.Interface.
+type ReorderBuffer struct {
+	results []*parseResult
+	size    int
+}
+
+// Len implements heap.Interface.
+func (rb *ReorderBuffer) Len() int {
+	return len(rb.results)
+}
+
+// Less implements heap.Interface.
+func (rb *ReorderBuffer) Less(i, j int) bool {
+
+	ti, tj := rb.results[i].timestamp(), rb.results[j].timestamp()
+	if ti.Equal(tj) {
+		return rb.results[i].seq < rb.results[j].seq
+	}
+
+	return ti.Before(tj)
+}
+
+// Swap implements heap.Interface.
+func (rb *ReorderBuffer) Swap(i, j int) {
+	rb.results[i], rb.results[j] = rb.results[j], rb.results[i]
+}
+
+// Push implements heap.Interface.
+func (rb *ReorderBuffer) Push(x interface{}) {
+
+	result := x.(*parseResult)
+	rb.size += result.size
+	rb.results = append(rb.results, result)
+}
+
+// Pop implements heap.Interface.
+func (rb *ReorderBuffer) Pop() interface{} {
+
+	last := len(rb.results) - 1
+	result := rb.results[last]
+	rb.results = rb.results[:last]
+	rb.size -= result.size
+
+	return result
+}
+
+// readJobs returns a walk function that reads all files in the desired date
+// range into memory and sends them to the given job channel.
+func readJobs(ctx context.Context, jobs chan<- *parseJob, params *CmdLineParams, summary *ParseSummary) WalkFunc {
+
+	seq := 0
+
+	return func(path string, info os.FileInfo, r io.Reader) error {
+
+		// Stop walking if a worker failed to parse a file, or if we were
+		// cancelled.
+		if err := summary.Err(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return summary.AddFailed(path, err)
+		}
+
+		header := content
+		if len(header) > timestampPeekSize {
+			header = header[:timestampPeekSize]
+		}
+		if !fileInRange(path, header, params.StartDate, params.EndDate) {
+			log.Printf("File %s not in desired date range.\n", path)
+			summary.AddSkipped(path, "not in date range")
+			return nil
+		}
+
+		select {
+		case jobs <- &parseJob{seq: seq, path: path, content: content}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		seq++
+
+		return nil
+	}
+}
+
+// parseJobs parses the files received over the given job channel and sends the
+// parsed object sets to the given result channel.  Once the run is aborted,
+// the remaining jobs are discarded.
+func parseJobs(ctx context.Context, jobs <-chan *parseJob, results chan<- *parseResult, summary *ParseSummary, group *sync.WaitGroup) {
+
+	defer group.Done()
+
+	for job := range jobs {
+		if summary.Err() != nil || ctx.Err() != nil {
+			continue
+		}
+
+		objects, err := parseObjects(bufio.NewReader(bytes.NewReader(job.content)))
+		if err != nil {
+			summary.AddFailed(job.path, err)
+			continue
+		}
+		if objects == nil {
+			summary.AddSkipped(job.path, "no data objects found")
+			continue
+		}
+		summary.AddParsed()
+
+		results <- &parseResult{
+			seq:     job.seq,
+			path:    job.path,
+			size:    len(job.content),
+			objects: objects,
+		}
+	}
+}
+
+// ParseFilesParallel walks the given archive data and parses the files it
+// contains using params.Workers goroutines.  The given parse summary keeps
+// track of parsed, skipped, and failed files.  The parsed object sets are passed
+// to deliver in chronological order.  To that end, parsed object sets are held
+// in a reorder buffer until its size exceeds params.ReorderBuffer MiB, measured
+// as the size of the unparsed files.  An object set that arrives after a more
+// recent one was already delivered is delivered late, and a warning is logged.
+// If deliver returns an error, parsing stops and the error is returned.  The
+// walk also stops once the given context is cancelled.
+func ParseFilesParallel(ctx context.Context, params *CmdLineParams, summary *ParseSummary, deliver func(tor.ObjectSet) error) error {
+
+	// Cancelling our own context stops the walk and the workers once
+	// delivery failed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var walkErr error
+	var workers sync.WaitGroup
+	jobs := make(chan *parseJob, params.Workers)
+	results := make(chan *parseResult, params.Workers)
+
+	go func() {
+		onError := func(path string, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return summary.AddFailed(path, err)
+		}
+		walkErr = walkInput(ctx, params, readJobs(ctx, jobs, params, summary), onError)
+		close(jobs)
+	}()
+
+	workers.Add(params.Workers)
+	for i := 0; i < params.Workers; i++ {
+		go parseJobs(ctx, jobs, results, summary, &workers)
+	}
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var lastDelivered time.Time
+	buffer := &ReorderBuffer{}
+	maxSize := params.ReorderBuffer * 1024 * 1024
+
+	emit := func() error {
+		result := heap.Pop(buffer).(*parseResult)
+		if result.timestamp().Before(lastDelivered) {
+			log.Printf("Delivering %s out of order.  Consider increasing -reorderbuffer.\n", result.path)
+		} else {
+			lastDelivered = result.timestamp()
+		}
+		return deliver(result.objects)
+	}
+
+	var deliverErr error
+	for result := range results {
+		// Once delivery failed, we only drain the results, so the
+		// workers can finish the jobs they already started.
+		if deliverErr != nil {
+			continue
+		}
+		heap.Push(buffer, result)
+		for buffer.size > maxSize && buffer.Len() > 0 && deliverErr == nil {
+			deliverErr = emit()
+		}
+		if deliverErr != nil {
+			cancel()
+		}
+	}
+	if deliverErr != nil {
+		return deliverErr
+	}
+
+	// Flush what's left in the reorder buffer, unless we are aborting.
+	if err := summary.Err(); err != nil {
+		return err
+	}
+	for buffer.Len() > 0 {
+		if err := emit(); err != nil {
+			return err
+		}
+	}
+
+	return walkErr
+}
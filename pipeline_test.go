@@ -0,0 +1,94 @@
+// Test parsing files in parallel.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// microdescArchive returns an archive holding microdescriptor consensuses of
+// every hour of the given number of days, starting on August 1, 2015.
+func microdescArchive(t *testing.T, days int) []byte {
+
+	entries := make(map[string]string)
+	for hour := 0; hour < days*24; hour++ {
+		date := time.Date(2015, 8, 1, hour, 0, 0, 0, time.UTC)
+		name := fmt.Sprintf("consensuses-2015-08/%s-consensus-microdesc", date.Format("2006-01-02-15-04-05"))
+		entries[name] = fmt.Sprintf("%s1.0\nnetwork-status-version 3 microdesc\nvalid-after %s\n",
+			microdesc.ConsensusAnnotation, date.Format("2006-01-02 15:04:05"))
+	}
+
+	return makeXZ(t, makeTar(t, entries))
+}
+
+// parallelParams returns parameters that parse the given archive data with two
+// workers and no reorder buffer.
+func parallelParams(archiveData string) *CmdLineParams {
+
+	return &CmdLineParams{
+		ArchiveData:   []string{archiveData},
+		Workers:       2,
+		ReorderBuffer: 0,
+		EndDate:       time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC),
+	}
+}
+
+func TestParseFilesParallel(t *testing.T) {
+
+	params := parallelParams(writeFixture(t, "consensuses.tar.xz", microdescArchive(t, 4)))
+	// All consensuses fit into the reorder buffer, so they are delivered in
+	// order.
+	params.ReorderBuffer = 1
+	summary := NewParseSummary(warnPolicy)
+
+	var delivered []time.Time
+	deliver := func(objects tor.ObjectSet) error {
+		consensus, _ := microdesc.ConsensusOf(objects)
+		delivered = append(delivered, consensus.ValidAfter)
+		return nil
+	}
+
+	if err := ParseFilesParallel(context.Background(), params, summary, deliver); err != nil {
+		t.Fatalf("Parsing failed: %s", err)
+	}
+	if summary.Parsed != 96 || len(delivered) != 96 {
+		t.Fatalf("Parsed %d and delivered %d consensuses, but expected 96.", summary.Parsed, len(delivered))
+	}
+	for i := 1; i < len(delivered); i++ {
+		if !delivered[i].After(delivered[i-1]) {
+			t.Errorf("Consensus %s was delivered after %s.", delivered[i], delivered[i-1])
+		}
+	}
+}
+
+func TestParseFilesParallelDeliveryError(t *testing.T) {
+
+	params := parallelParams(writeFixture(t, "consensuses.tar.xz", microdescArchive(t, 4)))
+	summary := NewParseSummary(warnPolicy)
+
+	deliveryErr := errors.New("sink is full")
+	deliveries := 0
+	deliver := func(objects tor.ObjectSet) error {
+		deliveries++
+		return deliveryErr
+	}
+
+	if err := ParseFilesParallel(context.Background(), params, summary, deliver); err != deliveryErr {
+		t.Errorf("Parsing returned %v, but expected %v.", err, deliveryErr)
+	}
+	if deliveries != 1 {
+		t.Errorf("Delivered %d times after delivery failed, but expected once.", deliveries)
+	}
+	// Only the files that were already read or parsed when delivery failed
+	// are parsed.
+	if summary.Parsed > 2*params.Workers+2 {
+		t.Errorf("Parsed %d consensuses after delivery failed.", summary.Parsed)
+	}
+}
@@ -3,54 +3,100 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"sync"
 
+	"github.com/NullHypothesis/sybilhunter/microdesc"
 	tor "github.com/NullHypothesis/zoossh"
 )
 
-var printedBanner bool = false
+// PrintInfo prints a router status to the given sink.  If the given descriptor
+// store has the status's router descriptor, we print that too.  The output is either CSV or, if
+// the given format is JSON, a record.  printedBanner keeps track of whether
+// the sink already got a CSV header.
+func PrintInfo(descriptors *DescriptorStore, status *tor.RouterStatus, format string, sink Sink, printedBanner *bool) {
 
-// PrintInfo prints a router status.  If we also have access to router
-// descriptors, we print those too.
-func PrintInfo(descriptorDir string, status *tor.RouterStatus) {
+	desc, err := descriptors.LoadDescriptor(status.Digest, status.Publication)
+	if format == jsonFormat {
+		record := NewRecord("print", "router_status", status.Publication, status.Fingerprint)
+		statusData(record, status)
+		if err == nil {
+			record.Data["platform"] = desc.OperatingSystem
+			record.Data["bandwidth_avg"] = desc.BandwidthAvg
+			record.Data["bandwidth_burst"] = desc.BandwidthBurst
+			record.Data["uptime"] = desc.Uptime
+			record.Data["family_size"] = len(desc.Family)
+		}
+		sink.Emit(record)
+		return
+	}
 
-	desc, err := tor.LoadDescriptorFromDigest(descriptorDir, status.Digest, status.Publication)
 	if err == nil {
-		if !printedBanner {
-			fmt.Println("fingerprint,nickname,ip_addr,or_port,dir_port,flags,published,version,platform,bandwidthavg,bandwidthburst,uptime,familysize")
-			printedBanner = true
+		if !*printedBanner {
+			fmt.Fprintln(sink, "fingerprint,nickname,ip_addr,or_port,dir_port,flags,published,version,platform,bandwidthavg,bandwidthburst,uptime,familysize")
+			*printedBanner = true
 		}
-		fmt.Printf("%s,%s,%d,%d,%d,%d\n", status, desc.OperatingSystem, desc.BandwidthAvg, desc.BandwidthBurst, desc.Uptime, len(desc.Family))
+		fmt.Fprintf(sink, "%s,%s,%d,%d,%d,%d\n", status, desc.OperatingSystem, desc.BandwidthAvg, desc.BandwidthBurst, desc.Uptime, len(desc.Family))
 	} else {
-		if !printedBanner {
-			fmt.Println("fingerprint,nickname,ip_addr,or_port,dir_port,flags,published,version")
-			printedBanner = true
+		if !*printedBanner {
+			fmt.Fprintln(sink, "fingerprint,nickname,ip_addr,or_port,dir_port,flags,published,version")
+			*printedBanner = true
 		}
-		fmt.Println(status)
+		fmt.Fprintln(sink, status)
+	}
+}
+
+// PrintDescriptor prints a router descriptor to the given sink, either in
+// human-readable format or, if the given format is JSON, as a record.
+func PrintDescriptor(desc *tor.RouterDescriptor, format string, sink Sink) {
+
+	if format == jsonFormat {
+		record := NewRecord("print", "router_descriptor", desc.Published, desc.Fingerprint)
+		descriptorData(record, desc)
+		sink.Emit(record)
+		return
+	}
+
+	fmt.Fprintln(sink, desc)
+}
+
+// statusDescriptors returns the descriptor store in which we look for the
+// router descriptors of the router statuses in the given object set.  The
+// router statuses of microdescriptor consensuses refer to microdescriptors, so
+// we don't look them up.
+func statusDescriptors(objects tor.ObjectSet, descriptors *DescriptorStore) *DescriptorStore {
+
+	if _, ok := objects.(*microdesc.Consensus); ok {
+		return nil
 	}
+
+	return descriptors
 }
 
 // PrettyPrint prints all objects within the object sets received over the
 // given channel.  The output is meant to be human-readable and easy to analyse
 // and grep.
-func PrettyPrint(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
-
-	defer group.Done()
+func PrettyPrint(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
 	counter := 0
+	printedBanner := false
 	for objects := range channel {
+		descriptors := statusDescriptors(objects, params.Descriptors)
 		for object := range objects.Iterate(params.Filter) {
 			counter += 1
 
 			switch obj := object.(type) {
 			case *tor.RouterStatus:
-				PrintInfo(params.DescriptorDir, obj)
+				PrintInfo(descriptors, obj, params.Format, sink, &printedBanner)
 			case *tor.RouterDescriptor:
-				fmt.Println(obj)
+				PrintDescriptor(obj, params.Format, sink)
+			case *microdesc.Microdescriptor:
+				PrintMicrodescriptor(obj, params.Format, sink)
 			}
 		}
 	}
 	log.Printf("Printed %d objects.\n", counter)
+
+	return nil
 }
@@ -4,12 +4,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"regexp"
 	"strings"
-	"sync"
 
 	tor "github.com/NullHypothesis/zoossh"
 )
@@ -38,13 +38,13 @@ func LooksLikeFingerprint(blurb string) error {
 
 // LoadFingerprints loads newline-separated fingerprints from the given file
 // and returns a map with all fingerprints.
-func LoadFingerprints(fileName string) FingerprintSet {
+func LoadFingerprints(fileName string) (FingerprintSet, error) {
 
 	fprset := make(FingerprintSet)
 
 	fd, err := os.Open(fileName)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer fd.Close()
 
@@ -52,43 +52,48 @@ func LoadFingerprints(fileName string) FingerprintSet {
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if err := LooksLikeFingerprint(line); err != nil {
-			log.Fatalf("Error while reading %s: %s", fileName, err)
+			return nil, fmt.Errorf("Error while reading %s: %s", fileName, err)
 		}
 
 		fprset[tor.Fingerprint(line)] = true
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return fprset
+	return fprset, nil
 }
 
 // PrintSome prints all objects for which we have the fingerprint.  The output
 // is meant to be human-readable and easy to analyse and grep.
-func PrintSome(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
+func PrintSome(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
-	defer group.Done()
-
-	fprset := LoadFingerprints(params.InputData)
+	fprset, err := LoadFingerprints(params.InputData)
+	if err != nil {
+		return err
+	}
 	counter := 0
+	printedBanner := false
 
 	for objects := range channel {
+		descriptors := statusDescriptors(objects, params.Descriptors)
 		for object := range objects.Iterate(params.Filter) {
 			switch obj := object.(type) {
 			case *tor.RouterStatus:
 				if _, exists := fprset[object.GetFingerprint()]; exists == true {
 					counter += 1
-					PrintInfo(params.DescriptorDir, obj)
+					PrintInfo(descriptors, obj, params.Format, sink, &printedBanner)
 				}
 			case *tor.RouterDescriptor:
 				if _, exists := fprset[object.GetFingerprint()]; exists == true {
 					counter += 1
-					fmt.Println(obj)
+					PrintDescriptor(obj, params.Format, sink)
 				}
 			}
 		}
 	}
 	log.Printf("Printed %d objects.\n", counter)
+
+	return nil
 }
@@ -0,0 +1,112 @@
+// Machine-readable analysis results.
+
+package main
+
+import (
+	"time"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+const (
+	textFormat = "text"
+	jsonFormat = "json"
+)
+
+// Record represents a single finding of an analysis, e.g., the churn rate of a
+// relay flag, or a pair of relays that are suspiciously similar.  In JSON
+// format, every record is written as one line, so the output can be processed
+// line by line.
+type Record struct {
+	// Analysis is the name of the analysis, e.g., "churn".
+	Analysis string `json:"analysis"`
+	// Type is the kind of finding, e.g., "churn_rate".
+	Type string `json:"type"`
+	// Time is the time the finding refers to, typically the valid-after
+	// time of a consensus.
+	Time *time.Time `json:"time,omitempty"`
+	// Fingerprints holds the fingerprints of the relays the finding is
+	// about.
+	Fingerprints []tor.Fingerprint `json:"fingerprints,omitempty"`
+	// Data holds the analysis-specific details of the finding.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// NewRecord allocates and returns a new record.  If the given time is the zero
+// time, the record has no time.
+func NewRecord(analysis, recordType string, date time.Time, fingerprints ...tor.Fingerprint) *Record {
+
+	record := &Record{
+		Analysis:     analysis,
+		Type:         recordType,
+		Fingerprints: fingerprints,
+		Data:         make(map[string]interface{}),
+	}
+
+	if !date.IsZero() {
+		date = date.UTC()
+		record.Time = &date
+	}
+
+	return record
+}
+
+// flagNames returns the names of all flags that are set in the given router
+// flags.
+func flagNames(flags *tor.RouterFlags) []string {
+
+	names := []string{}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"Authority", flags.Authority},
+		{"BadExit", flags.BadExit},
+		{"Exit", flags.Exit},
+		{"Fast", flags.Fast},
+		{"Guard", flags.Guard},
+		{"HSDir", flags.HSDir},
+		{"Named", flags.Named},
+		{"Running", flags.Running},
+		{"Stable", flags.Stable},
+		{"Unnamed", flags.Unnamed},
+		{"V2Dir", flags.V2Dir},
+		{"Valid", flags.Valid},
+	} {
+		if flag.set {
+			names = append(names, flag.name)
+		}
+	}
+
+	return names
+}
+
+// statusData adds the given router status to the given record's data.
+func statusData(record *Record, status *tor.RouterStatus) {
+
+	record.Data["nickname"] = status.Nickname
+	record.Data["address"] = status.Address.IPv4Address.String()
+	record.Data["or_port"] = status.Address.IPv4ORPort
+	record.Data["dir_port"] = status.Address.IPv4DirPort
+	record.Data["flags"] = flagNames(&status.Flags)
+	record.Data["published"] = status.Publication.UTC()
+	record.Data["version"] = status.TorVersion
+	record.Data["bandwidth"] = status.Bandwidth
+}
+
+// descriptorData adds the given router descriptor to the given record's data.
+func descriptorData(record *Record, desc *tor.RouterDescriptor) {
+
+	record.Data["nickname"] = desc.Nickname
+	record.Data["address"] = desc.Address.String()
+	record.Data["or_port"] = desc.ORPort
+	record.Data["dir_port"] = desc.DirPort
+	record.Data["published"] = desc.Published.UTC()
+	record.Data["version"] = desc.TorVersion
+	record.Data["platform"] = desc.OperatingSystem
+	record.Data["contact"] = desc.Contact
+	record.Data["bandwidth_avg"] = desc.BandwidthAvg
+	record.Data["bandwidth_burst"] = desc.BandwidthBurst
+	record.Data["uptime"] = desc.Uptime
+	record.Data["family_size"] = len(desc.Family)
+}
@@ -3,263 +3,199 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
-	"sync"
+	"time"
 
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	"github.com/NullHypothesis/sybilhunter/similarity"
 	tor "github.com/NullHypothesis/zoossh"
-	levenshtein "github.com/arbovm/levenshtein"
 )
 
-// hasDefaultExitPolicy returns true if the given descriptor's reject policy is
-// the default reject policy.
-func hasDefaultExitPolicy(desc *tor.RouterDescriptor) bool {
+// similarityRecord turns the given similarity into a record for
+// machine-readable output.
+func similarityRecord(s *similarity.DescriptorSimilarity) *Record {
 
-	defaultReject1 := "0.0.0.0/8:* 169.254.0.0/16:* 127.0.0.0/8:* " +
-		"192.168.0.0/16:* 10.0.0.0/8:* 172.16.0.0/12:* "
-	defaultReject2 := ":* *:25 *:119 *:135-139 *:445 *:563 *:1214 " +
-		"*:4661-4666 *:6346-6429 *:6699 *:6881-6999"
-	defaultReject := defaultReject1 + desc.Address.String() + defaultReject2
-
-	return strings.TrimSpace(desc.RawReject) == defaultReject
-}
-
-// SybilCluster represents a cluster of potential Sybils.
-type SybilCluster struct {
-	SybilPairs []*DescriptorSimilarity
-}
-
-// DescriptorSimilarity is a heterogeneous vector representing the similarity
-// between two router descriptors.
-type DescriptorSimilarity struct {
-	desc1 *tor.RouterDescriptor
-	desc2 *tor.RouterDescriptor
-
-	UptimeDiff      uint64
-	BandwidthDiff   uint64
-	ORPortDiff      uint16
-	SharedFprPrefix uint32
-	LevenshteinDist int
-	SimilarityScore float64
-
-	SameFamily   bool
-	SameAddress  bool
-	SameContact  bool
-	SameVersion  bool
-	HaveDirPort  bool
-	SamePolicy   bool
-	SamePlatform bool
-
-	StringSummary string
-}
-
-// genStringSimilarity generates and stores a human-readable string
-// representation of the similarity between two relay descriptors.
-func (s *DescriptorSimilarity) genStringSimilarity() {
-
-	var contact, version, bandwidth, sharedFpr, family, policy, uptime, orport, platform string
-	var similarities int
-
-	if s.SameFamily {
-		family = ", but same family"
+	// The pair's time is when the more recent descriptor was published.
+	published := s.Desc1.Published
+	if s.Desc2.Published.After(published) {
+		published = s.Desc2.Published
 	}
 
-	if s.SamePlatform {
-		similarities++
-		platform = fmt.Sprintf("Same platform: %s\n", s.desc1.OperatingSystem)
-	}
+	record := NewRecord("matrix", "similar_pair", published,
+		s.Desc1.Fingerprint, s.Desc2.Fingerprint)
+
+	record.Data["nicknames"] = []string{s.Desc1.Nickname, s.Desc2.Nickname}
+	record.Data["score"] = s.SimilarityScore
+	record.Data["uptime_diff"] = s.UptimeDiff
+	record.Data["bandwidth_diff"] = s.BandwidthDiff
+	record.Data["or_port_diff"] = s.ORPortDiff
+	record.Data["shared_fpr_prefix"] = s.SharedFprPrefix
+	record.Data["levenshtein_dist"] = s.LevenshteinDist
+	record.Data["same_family"] = s.SameFamily
+	record.Data["same_address"] = s.SameAddress
+	record.Data["same_contact"] = s.SameContact
+	record.Data["same_version"] = s.SameVersion
+	record.Data["have_dir_port"] = s.HaveDirPort
+	record.Data["same_policy"] = s.SamePolicy
+	record.Data["same_platform"] = s.SamePlatform
+
+	return record
+}
 
-	if s.SameContact {
-		similarities++
-		contact = fmt.Sprintf("Same contact: %s\n", s.desc1.Contact)
-	}
+// alertSimilarPairs sends an alert about the given similar relay pairs, whose
+// similarity is at or above the threshold.
+func alertSimilarPairs(ctx context.Context, pairs []*similarity.DescriptorSimilarity, params *CmdLineParams) {
 
-	if s.SameVersion {
-		similarities++
-		version = fmt.Sprintf("Same version: %s\n", s.desc1.TorVersion)
+	if params.Alerter == nil || len(pairs) == 0 {
+		return
 	}
 
-	if s.BandwidthDiff == 0 {
-		similarities++
-		// The default bandwidth rate is 1 GiB/s, i.e., 1024^3 Bps.
-		if s.desc1.BandwidthAvg == 1073741824 {
-			bandwidth = fmt.Sprintln("Default 1 GiB/s bandwidth")
-		} else {
-			bandwidth = fmt.Sprintf("Same bandwidth: %d\n", s.desc1.BandwidthAvg)
+	var published time.Time
+	var maxScore float64
+	var fingerprints []tor.Fingerprint
+	seen := make(map[tor.Fingerprint]bool)
+	for _, pair := range pairs {
+		for _, desc := range []*tor.RouterDescriptor{pair.Desc1, pair.Desc2} {
+			if desc.Published.After(published) {
+				published = desc.Published
+			}
+			if !seen[desc.Fingerprint] {
+				seen[desc.Fingerprint] = true
+				fingerprints = append(fingerprints, desc.Fingerprint)
+			}
 		}
-	}
-
-	if s.SharedFprPrefix >= 2 {
-		similarities++
-		sharedFpr = fmt.Sprintf("First %d hex digits of fingerprint: %s\n",
-			s.SharedFprPrefix, s.desc1.Fingerprint[:s.SharedFprPrefix])
-	}
-
-	if s.SamePolicy {
-		similarities++
-		policy = fmt.Sprintf("Same exit policy: %s\n", s.desc1.RawReject)
-	}
-
-	if s.UptimeDiff < (60 * 60 * 3) {
-		similarities++
-		uptime = fmt.Sprintf("Uptime diff: %d sec\n", s.UptimeDiff)
-	}
-
-	if (s.ORPortDiff < 10) && (s.desc1.ORPort != 9001) {
-		similarities++
-		orport = fmt.Sprintf("ORPort similar: desc1=%d, desc2=%d\n",
-			s.desc1.ORPort, s.desc2.ORPort)
-	}
-
-	s.SimilarityScore = float64(similarities)
-	s.StringSummary = fmt.Sprintf("%d similarities%s:\n"+
-		"%s%s%s%s%s%s%s%s",
-		similarities, family,
-		sharedFpr,
-		contact,
-		version,
-		policy,
-		uptime,
-		orport,
-		bandwidth,
-		platform)
-}
-
-// String implements the Stringer interface for pretty printing.  The output is
-// meant to be human-readable and easy to grep(1).
-func (s *DescriptorSimilarity) String() string {
-
-	return s.StringSummary
-}
-
-// CalcDescSimilarity determines the similarity between the two given relay
-// descriptors.  The similarity is a vector of numbers, which is returned.
-func CalcDescSimilarity(desc1, desc2 *tor.RouterDescriptor) *DescriptorSimilarity {
-
-	similarity := new(DescriptorSimilarity)
-
-	similarity.desc1 = desc1
-	similarity.desc2 = desc2
-
-	similarity.UptimeDiff = MaxUInt64(desc1.Uptime, desc2.Uptime) -
-		MinUInt64(desc1.Uptime, desc2.Uptime)
-	similarity.BandwidthDiff = MaxUInt64(desc1.BandwidthAvg, desc2.BandwidthAvg) -
-		MinUInt64(desc1.BandwidthAvg, desc2.BandwidthAvg)
-	similarity.ORPortDiff = MaxUInt16(desc1.ORPort, desc2.ORPort) -
-		MinUInt16(desc1.ORPort, desc2.ORPort)
-
-	// We compare hex-encoded fingerprints, so we have a granularity of four
-	// bits.  For example, the following two fingerprints have a shared prefix
-	// of five:
-	//   2C23B 21BEA DFB95 6247F  6DA97 36A61 EDCE9 48413
-	//   2C23B 41049 6F573 A616B  FF37B C12A2 B39F2 DBE5E
-	//   ^^^^^
-	similarity.SharedFprPrefix = 0
-	for i := 0; i < 40; i++ {
-		if desc1.Fingerprint[i] != desc2.Fingerprint[i] {
-			break
+		if pair.SimilarityScore > maxScore {
+			maxScore = pair.SimilarityScore
 		}
-		similarity.SharedFprPrefix++
 	}
 
-	// The Levenshtein distance gives us an approximation of how similar two
-	// nicknames are.
-	similarity.LevenshteinDist = levenshtein.Distance(desc1.Nickname, desc2.Nickname)
-
-	similarity.SameFamily = desc1.HasFamily(desc2.Fingerprint) && desc2.HasFamily(desc1.Fingerprint)
-	similarity.SameAddress = desc1.Address.Equal(desc2.Address)
-	similarity.SameContact = (desc1.Contact == desc2.Contact) && desc1.Contact != ""
-	similarity.SameVersion = (desc1.TorVersion == desc2.TorVersion)
-	similarity.HaveDirPort = (desc1.DirPort != 0) && (desc2.DirPort != 0)
-	similarity.SamePlatform = desc1.OperatingSystem == desc2.OperatingSystem
+	alertSimilarRelays(ctx, len(pairs), fingerprints, published, maxScore, params)
+}
 
-	// We don't care about the default or the universal reject policy.
-	if !hasDefaultExitPolicy(desc1) && strings.TrimSpace(desc1.RawReject) != "*:*" {
-		similarity.SamePolicy = desc1.RawReject == desc2.RawReject
-	}
+// alertSimilarRelays sends an alert about the given number of similar relay
+// pairs, which involve the given relays.
+func alertSimilarRelays(ctx context.Context, pairs int, fingerprints []tor.Fingerprint, published time.Time, maxScore float64, params *CmdLineParams) {
 
-	similarity.genStringSimilarity()
+	record := NewRecord("matrix", "similarity_alert", published, fingerprints...)
+	record.Data["pairs"] = pairs
+	record.Data["max_score"] = maxScore
+	record.Data["threshold"] = params.Threshold
 
-	return similarity
+	summary := fmt.Sprintf("%d relay pairs are similar, involving %d relays (maximum score %.2f >= %.2f).",
+		pairs, len(fingerprints), maxScore, params.Threshold)
+	params.Alerter.Alert(ctx, NewAlert(record, "matrix/similar_pairs", summary))
 }
 
 // genSimilarityMatrix computes pairwise similarities for all given relay
 // descriptors.  If "visualise" is set to false, all (n^2)/2 similarities are
-// written to stdout in human-readable output.  If "visualise" is true, the
-// output is Dot code, that can be turned into a diagram for visual inspection.
-func genSimilarityMatrix(descs *tor.RouterDescriptors, params *CmdLineParams) {
-
-	// Turn the map keys (i.e., the relays' fingerprints) into a list.
-	size := len(descs.RouterDescriptors)
-	fprs := make([]tor.Fingerprint, size)
-
-	i := 0
-	for fpr, _ := range descs.RouterDescriptors {
-		fprs[i] = fpr
-		i++
-	}
+// written to the given sink in human-readable output.  If "visualise" is true,
+// the output is Dot code, that can be turned into a diagram for visual
+// inspection.  If the given context is cancelled, the similarities computed so
+// far are written, and the context's error is returned.
+func genSimilarityMatrix(ctx context.Context, descs *tor.RouterDescriptors, params *CmdLineParams, sink Sink) error {
 
-	log.Printf("Now processing %d router descriptors.\n", size)
+	log.Printf("Now processing %d router descriptors.\n", len(descs.RouterDescriptors))
 
-	cluster := SybilCluster{}
+	cluster, count, err := similarity.Matrix(ctx, descs, params.Threshold, params.NoFamily)
 
-	// Compute similarity matrix.
-	count := 0
-	for i := 0; i < size; i++ {
+	log.Printf("Computed %d pairwise similarities, %d are part of output.\n",
+		count, len(cluster.SybilPairs))
+	alertSimilarPairs(ctx, cluster.SybilPairs, params)
 
-		fpr1 := fprs[i]
-		for j := i + 1; j < size; j++ {
+	if params.Visualise {
+		GenerateDOTGraph(cluster, sink)
+		return err
+	}
 
-			count++
-			fpr2 := fprs[j]
-			desc1, _ := descs.Get(fpr1)
-			desc2, _ := descs.Get(fpr2)
+	// Write similarities between two descriptors as human-readable,
+	// easy-to-grep output, or as JSON record.
+	for _, pair := range cluster.SybilPairs {
+		if params.Format == jsonFormat {
+			sink.Emit(similarityRecord(pair))
+			continue
+		}
 
-			similarity := CalcDescSimilarity(desc1, desc2)
-			if similarity.SimilarityScore < params.Threshold {
-				continue
-			}
+		fmt.Fprintf(sink, "<https://atlas.torproject.org/#details/%s> (%s)\n",
+			pair.Desc1.Fingerprint, pair.Desc1.Nickname)
+		fmt.Fprintf(sink, "<https://atlas.torproject.org/#details/%s> (%s)\n",
+			pair.Desc2.Fingerprint, pair.Desc2.Nickname)
+		fmt.Fprintln(sink, pair)
+	}
 
-			if similarity.SameFamily && params.NoFamily {
-				continue
-			}
+	return err
+}
 
-			cluster.SybilPairs = append(cluster.SybilPairs, similarity)
+// consensusDescriptors returns the router descriptors that the router statuses
+// in the given consensus refer to.  Descriptors that are missing in the given
+// descriptor store are skipped.
+func consensusDescriptors(ctx context.Context, consensus *tor.Consensus, descriptors *DescriptorStore) (*tor.RouterDescriptors, error) {
 
-			// Write similarities between two descriptors as human-readable,
-			// easy-to-grep output to stdout.
-			if !params.Visualise {
-				fmt.Printf("<https://atlas.torproject.org/#details/%s> (%s)\n",
-					similarity.desc1.Fingerprint, similarity.desc1.Nickname)
-				fmt.Printf("<https://atlas.torproject.org/#details/%s> (%s)\n",
-					similarity.desc2.Fingerprint, similarity.desc2.Nickname)
-				fmt.Println(similarity)
-			}
+	descs := tor.NewRouterDescriptors()
+	missing := 0
+	for fingerprint, getStatus := range consensus.RouterStatuses {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-	}
 
-	log.Printf("Computed %d pairwise similarities, %d are part of output.\n",
-		count, len(cluster.SybilPairs))
+		status := getStatus()
+		desc, err := descriptors.LoadDescriptor(status.Digest, status.Publication)
+		if err != nil {
+			missing++
+			continue
+		}
+		descs.Set(fingerprint, desc)
+	}
 
-	if params.Visualise {
-		GenerateDOTGraph(&cluster)
+	if missing > 0 {
+		log.Printf("Couldn't find router descriptors of %d of %d relays in consensus valid after %s.\n",
+			missing, len(consensus.RouterStatuses), consensus.ValidAfter.Format(time.RFC3339))
 	}
+
+	return descs, nil
 }
 
 // SimilarityMatrix walks the given file or directory and computes pairwise
 // relay similarities.  If the cumulative argument is set to true, the content
-// of all files is accumulated rather than analysed independently.
-func SimilarityMatrix(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
+// of all files is accumulated rather than analysed independently.  For
+// consensuses, the similarities are computed for the router descriptors of
+// exactly the relays in the consensus, so the matrix reflects one network
+// snapshot.  For microdescriptor consensuses, the similarities are computed
+// from the microdescriptors that were part of the input.
+func SimilarityMatrix(ctx context.Context, channel chan tor.ObjectSet, params *CmdLineParams, sink Sink) error {
 
-	defer group.Done()
+	// Microdescriptor consensuses refer to microdescriptors that were
+	// published earlier, so we keep all microdescriptors we have seen.
+	microdescs := microdesc.NewMicrodescriptors()
 
 	for objects := range channel {
 		switch v := objects.(type) {
+		case *microdesc.Microdescriptors:
+			microdescs.Merge(v)
+		case *microdesc.Consensus:
+			if err := genMicrodescSimilarityMatrix(ctx, v, microdescs, params, sink); err != nil {
+				return err
+			}
 		case *tor.RouterDescriptors:
-			genSimilarityMatrix(v, params)
-		case *tor.Consensus:
-			log.Fatalf("Couldn't analyse \"%s\" because consensus file format not yet supported.\n", params.InputData)
+			if err := genSimilarityMatrix(ctx, v, params, sink); err != nil {
+				return err
+			}
+		case *tor.Consensus, *microdesc.WeightedConsensus:
+			if params.Descriptors == nil {
+				return errors.New("Computing the similarity matrix of a consensus requires router descriptors.  Please use the -descdir switch.")
+			}
+			consensus, _ := microdesc.ConsensusOf(v)
+			descs, err := consensusDescriptors(ctx, consensus, params.Descriptors)
+			if err != nil {
+				return err
+			}
+			if err := genSimilarityMatrix(ctx, descs, params, sink); err != nil {
+				return err
+			}
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,195 @@
+// Computes the similarity between relays that are described by
+// microdescriptors.
+
+package similarity
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NullHypothesis/sybilhunter/microdesc"
+	tor "github.com/NullHypothesis/zoossh"
+	levenshtein "github.com/arbovm/levenshtein"
+)
+
+// MicrodescSimilarity is a heterogeneous vector representing the similarity
+// between two relays in a microdescriptor consensus.  Microdescriptors lack
+// most of the fields of router descriptors, so the router statuses contribute
+// nickname, address, version, and bandwidth.
+type MicrodescSimilarity struct {
+	Status1 *tor.RouterStatus
+	Status2 *tor.RouterStatus
+	Desc1   *microdesc.Microdescriptor
+	Desc2   *microdesc.Microdescriptor
+
+	BandwidthDiff   uint64
+	ORPortDiff      uint16
+	SharedFprPrefix uint32
+	LevenshteinDist int
+	SimilarityScore float64
+
+	SameFamily  bool
+	SameAddress bool
+	SameVersion bool
+	SamePolicy  bool
+	SameNTorKey bool
+
+	StringSummary string
+}
+
+// genStringSimilarity generates and stores a human-readable string
+// representation of the similarity between two relays.
+func (s *MicrodescSimilarity) genStringSimilarity() {
+
+	var version, bandwidth, sharedFpr, family, policy, orport, ntorKey string
+	var similarities int
+
+	if s.SameFamily {
+		family = ", but same family"
+	}
+
+	if s.SameVersion {
+		similarities++
+		version = fmt.Sprintf("Same version: %s\n", s.Status1.TorVersion)
+	}
+
+	if s.BandwidthDiff == 0 {
+		similarities++
+		bandwidth = fmt.Sprintf("Same consensus weight: %d\n", s.Status1.Bandwidth)
+	}
+
+	if s.SharedFprPrefix >= 2 {
+		similarities++
+		sharedFpr = fmt.Sprintf("First %d hex digits of fingerprint: %s\n",
+			s.SharedFprPrefix, s.Status1.Fingerprint[:s.SharedFprPrefix])
+	}
+
+	if s.SamePolicy {
+		similarities++
+		policy = fmt.Sprintf("Same exit policy summary: %s\n", s.Desc1.IPv4Policy)
+	}
+
+	if (s.ORPortDiff < 10) && (s.Status1.Address.IPv4ORPort != 9001) {
+		similarities++
+		orport = fmt.Sprintf("ORPort similar: relay1=%d, relay2=%d\n",
+			s.Status1.Address.IPv4ORPort, s.Status2.Address.IPv4ORPort)
+	}
+
+	// Relays should never share their ntor onion key.
+	if s.SameNTorKey {
+		similarities++
+		ntorKey = fmt.Sprintf("Same ntor onion key: %s\n", s.Desc1.NTorOnionKey)
+	}
+
+	s.SimilarityScore = float64(similarities)
+	s.StringSummary = fmt.Sprintf("%d similarities%s:\n"+
+		"%s%s%s%s%s%s",
+		similarities, family,
+		sharedFpr,
+		version,
+		policy,
+		orport,
+		bandwidth,
+		ntorKey)
+}
+
+// String implements the Stringer interface for pretty printing.  The output is
+// meant to be human-readable and easy to grep(1).
+func (s *MicrodescSimilarity) String() string {
+
+	return s.StringSummary
+}
+
+// CalcMicrodescSimilarity determines the similarity between the two given
+// relays, which are described by their router status in a microdescriptor
+// consensus and their microdescriptor.
+func CalcMicrodescSimilarity(status1, status2 *tor.RouterStatus, desc1, desc2 *microdesc.Microdescriptor) *MicrodescSimilarity {
+
+	similarity := new(MicrodescSimilarity)
+
+	similarity.Status1 = status1
+	similarity.Status2 = status2
+	similarity.Desc1 = desc1
+	similarity.Desc2 = desc2
+
+	similarity.BandwidthDiff = maxUInt64(status1.Bandwidth, status2.Bandwidth) -
+		minUInt64(status1.Bandwidth, status2.Bandwidth)
+	similarity.ORPortDiff = maxUInt16(status1.Address.IPv4ORPort, status2.Address.IPv4ORPort) -
+		minUInt16(status1.Address.IPv4ORPort, status2.Address.IPv4ORPort)
+
+	similarity.SharedFprPrefix = 0
+	for i := 0; i < 40 && i < len(status1.Fingerprint) && i < len(status2.Fingerprint); i++ {
+		if status1.Fingerprint[i] != status2.Fingerprint[i] {
+			break
+		}
+		similarity.SharedFprPrefix++
+	}
+
+	similarity.LevenshteinDist = levenshtein.Distance(status1.Nickname, status2.Nickname)
+
+	similarity.SameFamily = desc1.HasFamily(status2.Fingerprint) && desc2.HasFamily(status1.Fingerprint)
+	similarity.SameAddress = status1.Address.IPv4Address.Equal(status2.Address.IPv4Address)
+	similarity.SameVersion = status1.TorVersion == status2.TorVersion
+	similarity.SameNTorKey = desc1.NTorOnionKey != "" && desc1.NTorOnionKey == desc2.NTorOnionKey
+
+	// We don't care about the policy summary of relays that aren't exits.
+	if desc1.IPv4Policy != "" && desc1.IPv4Policy != "reject 1-65535" {
+		similarity.SamePolicy = desc1.IPv4Policy == desc2.IPv4Policy &&
+			desc1.IPv6Policy == desc2.IPv6Policy
+	}
+
+	similarity.genStringSimilarity()
+
+	return similarity
+}
+
+// MicrodescMatrix computes pairwise similarities for all relays in the given
+// microdescriptor consensus whose microdescriptor is in the given set.  It
+// returns the relay pairs whose similarity score reaches the given threshold,
+// the number of pairs that were compared, and the number of relays whose
+// microdescriptor is missing.  If noFamily is true, relays that are in the same
+// family are left out.  If the given context is cancelled, MicrodescMatrix
+// stops early and returns the pairs it found so far, together with the
+// context's error.
+func MicrodescMatrix(ctx context.Context, consensus *microdesc.Consensus, descs *microdesc.Microdescriptors, threshold float64, noFamily bool) ([]*MicrodescSimilarity, int, int, error) {
+
+	var statuses []*tor.RouterStatus
+	var mds []*microdesc.Microdescriptor
+	missing := 0
+	for _, getStatus := range consensus.RouterStatuses {
+		status := getStatus()
+		desc, ok := descs.ByDigest[status.Digest]
+		if !ok {
+			missing++
+			continue
+		}
+		statuses = append(statuses, status)
+		mds = append(mds, desc)
+	}
+
+	var pairs []*MicrodescSimilarity
+	count := 0
+	for i := 0; i < len(statuses); i++ {
+
+		if err := ctx.Err(); err != nil {
+			return pairs, count, missing, err
+		}
+
+		for j := i + 1; j < len(statuses); j++ {
+
+			count++
+			similarity := CalcMicrodescSimilarity(statuses[i], statuses[j], mds[i], mds[j])
+			if similarity.SimilarityScore < threshold {
+				continue
+			}
+
+			if similarity.SameFamily && noFamily {
+				continue
+			}
+
+			pairs = append(pairs, similarity)
+		}
+	}
+
+	return pairs, count, missing, nil
+}
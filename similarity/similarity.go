@@ -0,0 +1,271 @@
+// Package similarity computes the similarity between router descriptors.
+package similarity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tor "github.com/NullHypothesis/zoossh"
+	levenshtein "github.com/arbovm/levenshtein"
+)
+
+// hasDefaultExitPolicy returns true if the given descriptor's reject policy is
+// the default reject policy.
+func hasDefaultExitPolicy(desc *tor.RouterDescriptor) bool {
+
+	defaultReject1 := "0.0.0.0/8:* 169.254.0.0/16:* 127.0.0.0/8:* " +
+		"192.168.0.0/16:* 10.0.0.0/8:* 172.16.0.0/12:* "
+	defaultReject2 := ":* *:25 *:119 *:135-139 *:445 *:563 *:1214 " +
+		"*:4661-4666 *:6346-6429 *:6699 *:6881-6999"
+	defaultReject := defaultReject1 + desc.Address.String() + defaultReject2
+
+	return strings.TrimSpace(desc.RawReject) == defaultReject
+}
+
+// SybilCluster represents a cluster of potential Sybils.
+type SybilCluster struct {
+	SybilPairs []*DescriptorSimilarity
+}
+
+// DescriptorSimilarity is a heterogeneous vector representing the similarity
+// between two router descriptors.
+type DescriptorSimilarity struct {
+	Desc1 *tor.RouterDescriptor
+	Desc2 *tor.RouterDescriptor
+
+	UptimeDiff      uint64
+	BandwidthDiff   uint64
+	ORPortDiff      uint16
+	SharedFprPrefix uint32
+	LevenshteinDist int
+	SimilarityScore float64
+
+	SameFamily   bool
+	SameAddress  bool
+	SameContact  bool
+	SameVersion  bool
+	HaveDirPort  bool
+	SamePolicy   bool
+	SamePlatform bool
+
+	StringSummary string
+}
+
+// genStringSimilarity generates and stores a human-readable string
+// representation of the similarity between two relay descriptors.
+func (s *DescriptorSimilarity) genStringSimilarity() {
+
+	var contact, version, bandwidth, sharedFpr, family, policy, uptime, orport, platform string
+	var similarities int
+
+	if s.SameFamily {
+		family = ", but same family"
+	}
+
+	if s.SamePlatform {
+		similarities++
+		platform = fmt.Sprintf("Same platform: %s\n", s.Desc1.OperatingSystem)
+	}
+
+	if s.SameContact {
+		similarities++
+		contact = fmt.Sprintf("Same contact: %s\n", s.Desc1.Contact)
+	}
+
+	if s.SameVersion {
+		similarities++
+		version = fmt.Sprintf("Same version: %s\n", s.Desc1.TorVersion)
+	}
+
+	if s.BandwidthDiff == 0 {
+		similarities++
+		// The default bandwidth rate is 1 GiB/s, i.e., 1024^3 Bps.
+		if s.Desc1.BandwidthAvg == 1073741824 {
+			bandwidth = fmt.Sprintln("Default 1 GiB/s bandwidth")
+		} else {
+			bandwidth = fmt.Sprintf("Same bandwidth: %d\n", s.Desc1.BandwidthAvg)
+		}
+	}
+
+	if s.SharedFprPrefix >= 2 {
+		similarities++
+		sharedFpr = fmt.Sprintf("First %d hex digits of fingerprint: %s\n",
+			s.SharedFprPrefix, s.Desc1.Fingerprint[:s.SharedFprPrefix])
+	}
+
+	if s.SamePolicy {
+		similarities++
+		policy = fmt.Sprintf("Same exit policy: %s\n", s.Desc1.RawReject)
+	}
+
+	if s.UptimeDiff < (60 * 60 * 3) {
+		similarities++
+		uptime = fmt.Sprintf("Uptime diff: %d sec\n", s.UptimeDiff)
+	}
+
+	if (s.ORPortDiff < 10) && (s.Desc1.ORPort != 9001) {
+		similarities++
+		orport = fmt.Sprintf("ORPort similar: desc1=%d, desc2=%d\n",
+			s.Desc1.ORPort, s.Desc2.ORPort)
+	}
+
+	s.SimilarityScore = float64(similarities)
+	s.StringSummary = fmt.Sprintf("%d similarities%s:\n"+
+		"%s%s%s%s%s%s%s%s",
+		similarities, family,
+		sharedFpr,
+		contact,
+		version,
+		policy,
+		uptime,
+		orport,
+		bandwidth,
+		platform)
+}
+
+// String implements the Stringer interface for pretty printing.  The output is
+// meant to be human-readable and easy to grep(1).
+func (s *DescriptorSimilarity) String() string {
+
+	return s.StringSummary
+}
+
+// CalcDescSimilarity determines the similarity between the two given relay
+// descriptors.  The similarity is a vector of numbers, which is returned.
+func CalcDescSimilarity(desc1, desc2 *tor.RouterDescriptor) *DescriptorSimilarity {
+
+	similarity := new(DescriptorSimilarity)
+
+	similarity.Desc1 = desc1
+	similarity.Desc2 = desc2
+
+	similarity.UptimeDiff = maxUInt64(desc1.Uptime, desc2.Uptime) -
+		minUInt64(desc1.Uptime, desc2.Uptime)
+	similarity.BandwidthDiff = maxUInt64(desc1.BandwidthAvg, desc2.BandwidthAvg) -
+		minUInt64(desc1.BandwidthAvg, desc2.BandwidthAvg)
+	similarity.ORPortDiff = maxUInt16(desc1.ORPort, desc2.ORPort) -
+		minUInt16(desc1.ORPort, desc2.ORPort)
+
+	// We compare hex-encoded fingerprints, so we have a granularity of four
+	// bits.  For example, the following two fingerprints have a shared prefix
+	// of five:
+	//   2C23B 21BEA DFB95 6247F  6DA97 36A61 EDCE9 48413
+	//   2C23B 41049 6F573 A616B  FF37B C12A2 B39F2 DBE5E
+	//   ^^^^^
+	similarity.SharedFprPrefix = 0
+	for i := 0; i < 40; i++ {
+		if desc1.Fingerprint[i] != desc2.Fingerprint[i] {
+			break
+		}
+		similarity.SharedFprPrefix++
+	}
+
+	// The Levenshtein distance gives us an approximation of how similar two
+	// nicknames are.
+	similarity.LevenshteinDist = levenshtein.Distance(desc1.Nickname, desc2.Nickname)
+
+	similarity.SameFamily = desc1.HasFamily(desc2.Fingerprint) && desc2.HasFamily(desc1.Fingerprint)
+	similarity.SameAddress = desc1.Address.Equal(desc2.Address)
+	similarity.SameContact = (desc1.Contact == desc2.Contact) && desc1.Contact != ""
+	similarity.SameVersion = (desc1.TorVersion == desc2.TorVersion)
+	similarity.HaveDirPort = (desc1.DirPort != 0) && (desc2.DirPort != 0)
+	similarity.SamePlatform = desc1.OperatingSystem == desc2.OperatingSystem
+
+	// We don't care about the default or the universal reject policy.
+	if !hasDefaultExitPolicy(desc1) && strings.TrimSpace(desc1.RawReject) != "*:*" {
+		similarity.SamePolicy = desc1.RawReject == desc2.RawReject
+	}
+
+	similarity.genStringSimilarity()
+
+	return similarity
+}
+
+// Matrix computes pairwise similarities for all given relay descriptors.  It
+// returns the cluster of all relay pairs whose similarity score reaches the
+// given threshold, and the number of pairs that were compared.  If noFamily is
+// true, relays that are in the same family are left out.  If the given
+// context is cancelled, Matrix stops early and returns the pairs it found so
+// far, together with the context's error.
+func Matrix(ctx context.Context, descs *tor.RouterDescriptors, threshold float64, noFamily bool) (*SybilCluster, int, error) {
+
+	// Turn the map keys (i.e., the relays' fingerprints) into a list.
+	size := len(descs.RouterDescriptors)
+	fprs := make([]tor.Fingerprint, size)
+
+	i := 0
+	for fpr, _ := range descs.RouterDescriptors {
+		fprs[i] = fpr
+		i++
+	}
+
+	cluster := &SybilCluster{}
+
+	// Compute similarity matrix.
+	count := 0
+	for i := 0; i < size; i++ {
+
+		if err := ctx.Err(); err != nil {
+			return cluster, count, err
+		}
+
+		fpr1 := fprs[i]
+		for j := i + 1; j < size; j++ {
+
+			count++
+			fpr2 := fprs[j]
+			desc1, _ := descs.Get(fpr1)
+			desc2, _ := descs.Get(fpr2)
+
+			similarity := CalcDescSimilarity(desc1, desc2)
+			if similarity.SimilarityScore < threshold {
+				continue
+			}
+
+			if similarity.SameFamily && noFamily {
+				continue
+			}
+
+			cluster.SybilPairs = append(cluster.SybilPairs, similarity)
+		}
+	}
+
+	return cluster, count, nil
+}
+
+// maxUInt64 returns the larger of the two given integers.
+func maxUInt64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// minUInt64 returns the smaller of the two given integers.
+func minUInt64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// maxUInt16 returns the larger of the two given integers.
+func maxUInt16(a, b uint16) uint16 {
+	if a > b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// minUInt16 returns the smaller of the two given integers.
+func minUInt16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
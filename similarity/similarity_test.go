@@ -0,0 +1,164 @@
+// Test the similarity between router descriptors.
+
+package similarity
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// newDescriptor returns a router descriptor with the given fingerprint, and
+// settings that a Sybil operator might use for all its relays.
+func newDescriptor(fingerprint string) *tor.RouterDescriptor {
+
+	return &tor.RouterDescriptor{
+		Nickname:        "sybil",
+		Fingerprint:     tor.Fingerprint(fingerprint),
+		Address:         net.ParseIP("192.0.2.1"),
+		ORPort:          443,
+		Uptime:          3600,
+		OperatingSystem: "Linux",
+		TorVersion:      "0.2.7.6",
+		Contact:         "sybil@example.com",
+		BandwidthAvg:    1048576,
+		RawReject:       "*:25 *:119",
+		Family:          make(map[tor.Fingerprint]bool),
+	}
+}
+
+func TestCalcDescSimilarity(t *testing.T) {
+
+	const fpr1 = "2C23B21BEADFB956247F6DA9736A61EDCE948413"
+	const fpr2 = "2C23B410496F573A616BFF37BC12A2B39F2DBE5E"
+	const fpr3 = "F000000000000000000000000000000000000000"
+
+	tests := []struct {
+		name         string
+		modify       func(desc1, desc2 *tor.RouterDescriptor)
+		fingerprint2 string
+		score        float64
+		prefix       uint32
+		samePolicy   bool
+		sameFamily   bool
+	}{
+		{
+			name:         "twins",
+			modify:       func(desc1, desc2 *tor.RouterDescriptor) { desc2.ORPort = 444 },
+			fingerprint2: fpr2,
+			score:        8,
+			prefix:       5,
+			samePolicy:   true,
+		},
+		{
+			name: "strangers",
+			modify: func(desc1, desc2 *tor.RouterDescriptor) {
+				desc1.ORPort, desc2.ORPort = 9001, 9001
+				desc2.Uptime = 86400
+				desc2.OperatingSystem = "FreeBSD"
+				desc2.TorVersion = "0.2.8.1"
+				desc1.Contact, desc2.Contact = "", ""
+				desc2.BandwidthAvg = 2097152
+				desc2.RawReject = "*:*"
+			},
+			fingerprint2: fpr3,
+			score:        0,
+		},
+		{
+			// Relays that reject everything share no meaningful policy.
+			name: "universal reject policy",
+			modify: func(desc1, desc2 *tor.RouterDescriptor) {
+				desc1.RawReject, desc2.RawReject = "*:*", "*:*"
+			},
+			fingerprint2: fpr2,
+			score:        7,
+			prefix:       5,
+		},
+		{
+			name: "default reject policy",
+			modify: func(desc1, desc2 *tor.RouterDescriptor) {
+				desc1.RawReject = "0.0.0.0/8:* 169.254.0.0/16:* 127.0.0.0/8:* " +
+					"192.168.0.0/16:* 10.0.0.0/8:* 172.16.0.0/12:* 192.0.2.1:* " +
+					"*:25 *:119 *:135-139 *:445 *:563 *:1214 *:4661-4666 " +
+					"*:6346-6429 *:6699 *:6881-6999"
+				desc2.RawReject = desc1.RawReject
+			},
+			fingerprint2: fpr2,
+			score:        7,
+			prefix:       5,
+		},
+		{
+			name: "family",
+			modify: func(desc1, desc2 *tor.RouterDescriptor) {
+				desc1.Family[desc2.Fingerprint] = true
+				desc2.Family[desc1.Fingerprint] = true
+			},
+			fingerprint2: fpr2,
+			score:        8,
+			prefix:       5,
+			samePolicy:   true,
+			sameFamily:   true,
+		},
+	}
+
+	for _, test := range tests {
+		desc1, desc2 := newDescriptor(fpr1), newDescriptor(test.fingerprint2)
+		test.modify(desc1, desc2)
+
+		similarity := CalcDescSimilarity(desc1, desc2)
+		if similarity.SimilarityScore != test.score {
+			t.Errorf("%s: score is %f, but expected %f.", test.name, similarity.SimilarityScore, test.score)
+		}
+		if similarity.SharedFprPrefix != test.prefix {
+			t.Errorf("%s: shared prefix is %d, but expected %d.", test.name, similarity.SharedFprPrefix, test.prefix)
+		}
+		if similarity.SamePolicy != test.samePolicy {
+			t.Errorf("%s: same policy is %t, but expected %t.", test.name, similarity.SamePolicy, test.samePolicy)
+		}
+		if similarity.SameFamily != test.sameFamily {
+			t.Errorf("%s: same family is %t, but expected %t.", test.name, similarity.SameFamily, test.sameFamily)
+		}
+		if hasFamily := strings.Contains(similarity.String(), "same family"); hasFamily != test.sameFamily {
+			t.Errorf("%s: summary %q mentions family: %t, but expected %t.", test.name, similarity.String(), hasFamily, test.sameFamily)
+		}
+	}
+}
+
+func TestCalcDescSimilarityNickname(t *testing.T) {
+
+	desc1 := newDescriptor("2C23B21BEADFB956247F6DA9736A61EDCE948413")
+	desc2 := newDescriptor("2C23B410496F573A616BFF37BC12A2B39F2DBE5E")
+	desc2.Nickname = "sybil2"
+
+	if dist := CalcDescSimilarity(desc1, desc2).LevenshteinDist; dist != 1 {
+		t.Errorf("Levenshtein distance is %d, but expected 1.", dist)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+
+	descs := tor.NewRouterDescriptors()
+	for _, fingerprint := range []string{
+		"2C23B21BEADFB956247F6DA9736A61EDCE948413",
+		"2C23B410496F573A616BFF37BC12A2B39F2DBE5E",
+		"F000000000000000000000000000000000000000",
+	} {
+		descs.Set(tor.Fingerprint(fingerprint), newDescriptor(fingerprint))
+	}
+
+	// The relays share everything but their fingerprint, and the first two
+	// also share their fingerprint's prefix.
+	cluster, count, err := Matrix(context.Background(), descs, 8, false)
+	if err != nil {
+		t.Fatalf("Matrix failed: %s", err)
+	}
+	if count != 3 {
+		t.Errorf("Compared %d pairs, but expected 3.", count)
+	}
+	if len(cluster.SybilPairs) != 1 {
+		t.Errorf("Found %d Sybil pairs, but expected 1.", len(cluster.SybilPairs))
+	}
+}
@@ -0,0 +1,142 @@
+// Output sinks that analyses write their results to.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Sink is where an analysis writes its results to.  Every analysis has its own
+// sink, so concurrently running analyses don't interleave their output.
+type Sink interface {
+	io.Writer
+
+	// Emit writes the given record as a single line of JSON.
+	Emit(*Record)
+
+	// Close flushes the sink's output and releases its resources.
+	Close() error
+}
+
+// writerSink is a Sink that writes to an io.Writer.  It is safe for
+// concurrent use.  If autoFlush is set, every write is flushed right away.
+type writerSink struct {
+	sync.Mutex
+	name      string
+	w         *bufio.Writer
+	closer    io.Closer
+	autoFlush bool
+}
+
+// NewStdoutSink returns a sink that writes to stdout.  If autoFlush is set,
+// the output is written right away rather than buffered.
+func NewStdoutSink(autoFlush bool) Sink {
+
+	return &writerSink{name: "stdout", w: bufio.NewWriter(os.Stdout), autoFlush: autoFlush}
+}
+
+// NewFileSink returns a sink that writes to a file with the given name in the
+// output directory.  If autoFlush is set, the output is written right away
+// rather than buffered.
+func NewFileSink(fileName string, autoFlush bool) (Sink, error) {
+
+	directory, err := getOutputDir()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(directory, fileName)
+	fd, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Writing results to \"%s\".\n", path)
+
+	return &writerSink{name: path, w: bufio.NewWriter(fd), closer: fd, autoFlush: autoFlush}, nil
+}
+
+// Write implements the io.Writer interface.
+func (s *writerSink) Write(p []byte) (int, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	n, err := s.w.Write(p)
+	if err == nil && s.autoFlush {
+		err = s.w.Flush()
+	}
+
+	return n, err
+}
+
+// Emit implements the Sink interface.
+func (s *writerSink) Emit(record *Record) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := json.NewEncoder(s.w).Encode(record); err != nil {
+		log.Printf("Couldn't encode %s record: %s\n", record.Type, err)
+		return
+	}
+
+	if s.autoFlush {
+		if err := s.w.Flush(); err != nil {
+			log.Printf("Couldn't flush %s: %s\n", s.name, err)
+		}
+	}
+}
+
+// Close implements the Sink interface.
+func (s *writerSink) Close() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("%s: %s", s.name, err)
+	}
+
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+
+	return nil
+}
+
+// newSinks returns one sink for every given analysis.  If there's only a
+// single analysis, it writes to stdout.  Otherwise, every analysis writes to
+// its own file in the output directory, named after the analysis.  If
+// autoFlush is set, the sinks don't buffer their output.
+func newSinks(analyses []Analysis, format string, autoFlush bool) ([]Sink, error) {
+
+	if len(analyses) == 1 {
+		return []Sink{NewStdoutSink(autoFlush)}, nil
+	}
+
+	var sinks []Sink
+	for _, analysis := range analyses {
+		extension := analysis.Extension
+		if format == jsonFormat {
+			extension = "jsonl"
+		}
+
+		sink, err := NewFileSink(fmt.Sprintf("%s.%s", analysis.Name, extension), autoFlush)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
@@ -0,0 +1,126 @@
+// Keep track of parsed, skipped, and failed files.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	skipPolicy  = "skip"
+	warnPolicy  = "warn"
+	abortPolicy = "abort"
+)
+
+// ParseSummary counts the files that were parsed, skipped, and failed during a
+// run.  It also applies the error policy, i.e., it decides if a failed file
+// aborts the run.  ParseSummary is safe for concurrent use.
+type ParseSummary struct {
+	sync.Mutex
+
+	Policy  string
+	Parsed  int
+	Skipped int
+	Failed  int
+
+	// SkipReasons maps a reason to the number of files skipped for it.
+	SkipReasons map[string]int
+	// Failures holds one "file: error" string for every failed file.
+	Failures []string
+
+	// err is set once a failure made us abort.
+	err error
+}
+
+// NewParseSummary allocates and returns a new parse summary that uses the
+// given error policy.
+func NewParseSummary(policy string) *ParseSummary {
+
+	return &ParseSummary{Policy: policy, SkipReasons: make(map[string]int)}
+}
+
+// AddParsed counts a successfully parsed file.
+func (s *ParseSummary) AddParsed() {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.Parsed++
+}
+
+// AddSkipped counts a file that was skipped for the given reason.
+func (s *ParseSummary) AddSkipped(path, reason string) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.Skipped++
+	s.SkipReasons[reason]++
+}
+
+// AddFailed counts a file that could not be read or parsed, and applies the
+// error policy.  It returns an error if the run should be aborted, and nil
+// otherwise.
+func (s *ParseSummary) AddFailed(path string, err error) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	// We are already aborting, so there's nothing left to count.
+	if s.err != nil {
+		return s.err
+	}
+
+	s.Failed++
+	s.Failures = append(s.Failures, fmt.Sprintf("%s: %s", path, err))
+
+	switch s.Policy {
+	case abortPolicy:
+		s.err = fmt.Errorf("Aborting because of %s: %s", path, err)
+		return s.err
+	case warnPolicy:
+		log.Printf("Failed to process %s: %s\n", path, err)
+	}
+
+	return nil
+}
+
+// Err returns the error that aborted the run, or nil if the run was not
+// aborted.
+func (s *ParseSummary) Err() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.err
+}
+
+// String implements the Stringer interface.  It returns a human-readable
+// summary of the run.
+func (s *ParseSummary) String() string {
+
+	s.Lock()
+	defer s.Unlock()
+
+	summary := fmt.Sprintf("%d files parsed, %d skipped, %d failed.", s.Parsed, s.Skipped, s.Failed)
+
+	reasons := make([]string, 0, len(s.SkipReasons))
+	for reason, _ := range s.SkipReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	for _, reason := range reasons {
+		summary += fmt.Sprintf("\n  Skipped %d files: %s", s.SkipReasons[reason], reason)
+	}
+
+	if len(s.Failures) > 0 {
+		summary += "\n  Failed: " + strings.Join(s.Failures, "\n  Failed: ")
+	}
+
+	return summary
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,14 +11,16 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	tor "github.com/NullHypothesis/zoossh"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -38,6 +41,10 @@ type CmdLineParams struct {
 	BwFraction     float64
 	Neighbours     int
 	WindowSize     int
+	Workers        int
+	ReorderBuffer  int
+	MinFprs        int
+	DescCacheSize  int
 	Uptime         bool
 	Contrib        bool
 	Churn          bool
@@ -48,49 +55,189 @@ type CmdLineParams struct {
 	ShowVersion    bool
 	Visualise      bool
 	Cumulative     bool
+	Resume         bool
+	Watch          bool
 	NoFamily       bool
 	DescriptorDir  string
-	ArchiveData    string
+	DescIndexDir   string
+	ArchiveData    []string
 	InputData      string
 	OutputDir      string
 	StartDate      time.Time
 	EndDate        time.Time
+	WatchInterval  time.Duration
+	AlertDedup     time.Duration
+	ChurnInterval  time.Duration
 	StartDateStr   string
 	EndDateStr     string
 	ReferenceRelay string
 	LogFile        string
 	SearchAlg      string
 	CSVFormat      string
+	GapPolicy      string
+	Detector       string
+	ChurnConfig    string
+	OnError        string
+	Format         string
+	AlertCommand   string
+	AlertWebhook   string
+	AlertMbox      string
+	AlertMaildir   string
+
+	// Descriptors loads router descriptors from DescriptorDir.  It's nil if
+	// no analysis needs descriptors, or no descriptor directory was given.
+	Descriptors *DescriptorStore
+
+	// Alerter sends alerts to the destinations given by the Alert* fields.
+	// It's nil if there are none.
+	Alerter *Alerter
 
 	Filter         *tor.ObjectFilter
 	FilterFpr      string
 	FilterAddr     string
 	FilterNickname string
 
-	// Callbacks holds a slice of analysis functions that are called for parsed
-	// data objects.
-	Callbacks []AnalysisCallback
+	// Callbacks holds a slice of analyses whose functions are called for
+	// parsed data objects.
+	Callbacks []Analysis
 }
 
-// AnalysisCallback is a callback function that analyses the given object set.
-type AnalysisCallback func(chan tor.ObjectSet, *CmdLineParams, *sync.WaitGroup)
+// pathListFlag implements the flag.Value interface for a list of paths.  The
+// flag can be given several times and each value may be a glob pattern.  The
+// first value given replaces the list's previous content, so that command
+// line arguments overwrite the configuration file.
+type pathListFlag struct {
+	paths    *[]string
+	replaced bool
+}
+
+// String implements the flag.Value interface.
+func (f *pathListFlag) String() string {
+
+	if f.paths == nil {
+		return ""
+	}
+
+	return strings.Join(*f.paths, ",")
+}
+
+// Set implements the flag.Value interface.  It expands the given glob pattern
+// and adds the resulting paths to the list.
+func (f *pathListFlag) Set(value string) error {
+
+	if !f.replaced {
+		*f.paths = nil
+		f.replaced = true
+	}
+
+	matches, err := filepath.Glob(value)
+	if err != nil {
+		return err
+	}
+
+	// Keep the value if nothing matches, so we later complain about the
+	// missing file.
+	if len(matches) == 0 {
+		matches = []string{value}
+	}
+	*f.paths = append(*f.paths, matches...)
+
+	return nil
+}
+
+// AnalysisCallback is a callback function that analyses the object sets it
+// receives over the given channel until the channel is closed.  The results
+// are written to the given sink.  If the analysis fails, it returns an error
+// right away, without waiting for the channel to be closed.  Once the given
+// context is cancelled, lengthy analyses stop, write the results they have so
+// far, and return the context's error.
+type AnalysisCallback func(context.Context, chan tor.ObjectSet, *CmdLineParams, Sink) error
+
+// Analysis is an analysis callback together with the name and file extension
+// that are used for the file its results are written to.  Resumable analyses
+// write a checkpoint when they are done, and continue from it if -resume is
+// given.
+type Analysis struct {
+	Name      string
+	Extension string
+	Callback  AnalysisCallback
+	Resumable bool
+}
+
+// NewCmdLineParams allocates and returns a CmdLineParams struct that holds
+// the default arguments.
+func NewCmdLineParams() *CmdLineParams {
+
+	params := new(CmdLineParams)
+	params.BwFraction = -1
+	params.Neighbours = -1
+	params.WindowSize = 1
+	params.Workers = 1
+	params.ReorderBuffer = 256
+	params.MinFprs = 2
+	params.DescCacheSize = 10000
+	params.WatchInterval = time.Minute
+	params.AlertDedup = 24 * time.Hour
+	params.SearchAlg = "linear"
+	params.CSVFormat = longCSVFormat
+	params.GapPolicy = gapNormalise
+	params.Detector = thresholdDetector
+	params.OnError = warnPolicy
+	params.Format = textFormat
+	params.Filter = tor.NewObjectFilter()
+
+	return params
+}
+
+// addCommonFlags adds the flags that are shared by all analyses to the given
+// flag set.
+func addCommonFlags(flags *flag.FlagSet, params *CmdLineParams) {
+
+	flags.IntVar(&params.Workers, "workers", params.Workers, "Number of files to parse in parallel (default is 1).  Parsed files are still analysed in chronological order.")
+	flags.IntVar(&params.ReorderBuffer, "reorderbuffer", params.ReorderBuffer, "Size in MiB of the buffer that puts files parsed by -workers back into chronological order (default is 256).")
+	flags.BoolVar(&params.ShowVersion, "version", params.ShowVersion, "Show version and exit.")
+	flags.BoolVar(&params.Cumulative, "cumulative", params.Cumulative, "Accumulate all files in a directory rather than process them independently.")
+	flags.StringVar(&params.DescriptorDir, "descdir", params.DescriptorDir, "Path to directory containing router descriptors.  It may contain unpacked monthly archives, archives such as server-descriptors-2015-08.tar.xz, and files with many descriptors, such as CollecTor's recent files.")
+	flags.StringVar(&params.DescIndexDir, "descindex", params.DescIndexDir, "Directory for the index of the descriptors in -descdir.  The index is built once and updated when files are added.  Default is the directory .sybilhunter-index in -descdir.")
+	flags.IntVar(&params.DescCacheSize, "desccache", params.DescCacheSize, "Number of router descriptors to keep in memory (default is 10000).")
+	flags.Var(&pathListFlag{paths: &params.ArchiveData}, "data", "File, directory, or archive (tar, zip, optionally compressed with xz, gzip, bzip2, or zstd) to analyse.  It must contain network statuses or relay descriptors.  Can be given several times and may be a glob pattern, e.g., 'consensuses-2015-*.tar.xz'.  All sources are merged into one de-duplicated, chronologically ordered input.")
+	flags.StringVar(&params.OutputDir, "output", params.OutputDir, "Directory where analysis results are written to.")
+	flags.BoolVar(&params.Resume, "resume", params.Resume, "Resume the churn and uptime analyses from their checkpoints in the -output directory, and only process data that is newer than the checkpoints.  The churn and uptime analyses write a checkpoint whenever -output is given.")
+	flags.BoolVar(&params.Watch, "watch", params.Watch, "Keep running after all input was processed, and process files that newly appear in the -data directories.  Findings are written as soon as they are made.")
+	flags.DurationVar(&params.WatchInterval, "watchinterval", params.WatchInterval, "How often -watch looks for new files (default is 1m).  A new file is processed once its size didn't change for one interval.")
+	flags.StringVar(&params.StartDateStr, "startdate", params.StartDateStr, "Start date for analyzed data in format YYYY-MM-DD or YYYY-MM-DDTHH.  The date is inclusive.")
+	flags.StringVar(&params.EndDateStr, "enddate", params.EndDateStr, "End date for analyzed data in format YYYY-MM-DD or YYYY-MM-DDTHH.  The date is inclusive, i.e., YYYY-MM-DD covers the entire day.")
+	flags.StringVar(&params.FilterFpr, "filter-fpr", params.FilterFpr, "Filter router statuses and descriptors by fingerprint.  Use ',' as delimiter when multiple fingerprints are given.")
+	flags.StringVar(&params.FilterAddr, "filter-addr", params.FilterAddr, "Filter router statuses and descriptors by IP address.  Use ',' as delimiter when multiple addresses are given.")
+	flags.StringVar(&params.FilterNickname, "filter-nickname", params.FilterNickname, "Filter router statuses and descriptors by nickname.  Use ',' as delimiter when multiple nicknames are given.")
+	flags.StringVar(&params.LogFile, "logfile", params.LogFile, "Log file to write log messages to.")
+	flags.StringVar(&params.Format, "format", params.Format, "Output format.  Must be 'text' or 'json'.  In JSON format, every finding is written as a single line containing a JSON object.  Default is 'text'.")
+	flags.StringVar(&params.AlertCommand, "alert-command", params.AlertCommand, "Shell command to run when a finding crosses a threshold, e.g., churn above -threshold.  The alert is written to the command's stdin as JSON.")
+	flags.StringVar(&params.AlertWebhook, "alert-webhook", params.AlertWebhook, "URL to POST alerts to as JSON.")
+	flags.StringVar(&params.AlertMbox, "alert-mbox", params.AlertMbox, "mbox file to append alerts to as email messages.")
+	flags.StringVar(&params.AlertMaildir, "alert-maildir", params.AlertMaildir, "Maildir to deliver alerts to as email messages.")
+	flags.DurationVar(&params.AlertDedup, "alert-dedup", params.AlertDedup, "Don't alert about the same relays again within this duration (default is 24h).  The duration refers to the time of the analysed data.")
+	flags.StringVar(&params.OnError, "on-error", params.OnError, "What to do with files that cannot be read or parsed.  Must be 'skip', 'warn', or 'abort'.  Default is 'warn'.  Only 'abort' results in a non-zero exit status.")
+}
 
 // ParseFlagSet parses the given arguments and returns a CmdLineParams struct.
 // If the given CmdLineParams struct is not nil, its content is overwritten
 // with the given arguments.
+//
+// ParseFlagSet understands the top-level analysis switches, e.g., -churn,
+// which predate subcommands.  It's used for the configuration file and to keep
+// existing scripts working.
 func ParseFlagSet(arguments []string, params *CmdLineParams) *CmdLineParams {
 
 	if params == nil {
-		params = new(CmdLineParams)
-		params.BwFraction = -1
-		params.Neighbours = -1
-		params.WindowSize = 1
-		params.SearchAlg = "linear"
-		params.CSVFormat = longCSVFormat
-		params.Filter = tor.NewObjectFilter()
+		params = NewCmdLineParams()
 	}
 
 	flags := flag.NewFlagSet(toolName, flag.ExitOnError)
+	flags.Usage = func() {
+		printUsage(flags)
+	}
+	addCommonFlags(flags, params)
 	flags.Float64Var(&params.Threshold, "threshold", params.Threshold, "Analysis-specific threshold.")
 	flags.Float64Var(&params.BwFraction, "bwfraction", params.BwFraction, "Print which relays amount to the given total bandwidth fraction.")
 	flags.IntVar(&params.Neighbours, "neighbours", params.Neighbours, "Find n nearest neighbours.")
@@ -102,23 +249,17 @@ func ParseFlagSet(arguments []string, params *CmdLineParams) *CmdLineParams {
 	flags.BoolVar(&params.PrintSome, "printsome", params.PrintSome, "Print the content of all files in the given file or directory that contain the given fingerprints.  Requires -input parameter.")
 	flags.BoolVar(&params.Fingerprints, "fingerprints", params.Fingerprints, "Analyse relay fingerprints in the given file or directory.")
 	flags.BoolVar(&params.Matrix, "matrix", params.Matrix, "Calculate O(n^2) similarity matrix for all objects in the given file or directory.")
-	flags.BoolVar(&params.ShowVersion, "version", params.ShowVersion, "Show version and exit.")
 	flags.BoolVar(&params.Visualise, "visualise", params.Visualise, "Write DOT code to stdout, that can then be turned into a diagram using Graphviz.")
-	flags.BoolVar(&params.Cumulative, "cumulative", params.Cumulative, "Accumulate all files in a directory rather than process them independently.")
 	flags.BoolVar(&params.NoFamily, "nofamily", params.NoFamily, "Don't interpret MyFamily relationships as Sybils.")
-	flags.StringVar(&params.DescriptorDir, "descdir", params.DescriptorDir, "Path to directory containing router descriptors.")
-	flags.StringVar(&params.ArchiveData, "data", params.ArchiveData, "File or directory to analyse.  It must contain network statuses or relay descriptors.")
 	flags.StringVar(&params.InputData, "input", params.InputData, "File or directory to analyse.  It must contain network statuses or relay descriptors.")
-	flags.StringVar(&params.OutputDir, "output", params.OutputDir, "Directory where analysis results are written to.")
 	flags.StringVar(&params.ReferenceRelay, "referencerelay", params.ReferenceRelay, "Relay that's used as reference for nearest neighbour search.")
-	flags.StringVar(&params.StartDateStr, "startdate", params.StartDateStr, "Start date for analyzed data in format YYYY-MM-DD.")
-	flags.StringVar(&params.EndDateStr, "enddate", params.EndDateStr, "End date for analyzed data in format YYYY-MM-DD.")
-	flags.StringVar(&params.FilterFpr, "filter-fpr", params.FilterFpr, "Filter router statuses and descriptors by fingerprint.  Use ',' as delimiter when multiple fingerprints are given.")
-	flags.StringVar(&params.FilterAddr, "filter-addr", params.FilterAddr, "Filter router statuses and descriptors by IP address.  Use ',' as delimiter when multiple addresses are given.")
-	flags.StringVar(&params.FilterNickname, "filter-nickname", params.FilterNickname, "Filter router statuses and descriptors by nickname.  Use ',' as delimiter when multiple nicknames are given.")
-	flags.StringVar(&params.LogFile, "logfile", params.LogFile, "Log file to write log messages to.")
 	flags.StringVar(&params.SearchAlg, "search", params.SearchAlg, "Search algorithm to use.  Must be 'vptree' or 'linear'.  Default is 'linear'.")
 	flags.StringVar(&params.CSVFormat, "csvformat", params.CSVFormat, "Must be either 'long' or 'wide'.  Default is 'long'.")
+	flags.StringVar(&params.GapPolicy, "gappolicy", params.GapPolicy, gapPolicyUsage)
+	flags.DurationVar(&params.ChurnInterval, "interval", params.ChurnInterval, intervalUsage)
+	flags.StringVar(&params.Detector, "detector", params.Detector, detectorUsage)
+	flags.StringVar(&params.ChurnConfig, "churnconfig", params.ChurnConfig, churnConfigUsage)
+	flags.IntVar(&params.MinFprs, "minfingerprints", params.MinFprs, "In -watch mode, or if alerts are configured, report an IP address as soon as its relays used this many unique fingerprints (default is 2).")
 
 	err := flags.Parse(arguments)
 	if err != nil {
@@ -128,17 +269,6 @@ func ParseFlagSet(arguments []string, params *CmdLineParams) *CmdLineParams {
 	return params
 }
 
-// parseDate extracts and returns the date that is in the given date string.
-func parseDate(dateString string) time.Time {
-
-	date, err := time.Parse("2006-01-02", dateString)
-	if err != nil {
-		log.Fatalf("Given date \"%s\" invalid.  We expect the format YYYY-MM-DD.\n", dateString)
-	}
-
-	return date
-}
-
 // ParseConfig parses the configuration file ~/.sybilhunterrc.  Every line in
 // the file is interpreted as command line argument.
 func ParseConfig() *CmdLineParams {
@@ -180,12 +310,27 @@ func ParseConfig() *CmdLineParams {
 // module's limitations.
 func setNonPrimitiveParams(params *CmdLineParams) {
 
+	outputDir = params.OutputDir
+
 	if params.StartDateStr != "" {
-		params.StartDate = parseDate(params.StartDateStr)
+		date, _, err := parseDate(params.StartDateStr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		params.StartDate = date
 	}
 
+	// The end date is inclusive, so it extends to the last instant of the
+	// day or hour that was given.
 	if params.EndDateStr != "" {
-		params.EndDate = parseDate(params.EndDateStr)
+		date, span, err := parseDate(params.EndDateStr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		params.EndDate = date.Add(span - time.Nanosecond)
+	} else if params.Watch {
+		// We keep processing new files, so there's no end in sight.
+		params.EndDate = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
 	} else {
 		params.EndDate = time.Now()
 	}
@@ -214,17 +359,51 @@ func setNonPrimitiveParams(params *CmdLineParams) {
 	log.Printf("Object filter is empty: %t", params.Filter.IsEmpty())
 }
 
-func main() {
+// interruptContext returns a context that is cancelled by the first SIGINT or
+// SIGTERM.  Parsing then stops, and the analyses write what they have.  A
+// second signal terminates us right away.  If we are watching for new files,
+// a signal is how we are told to stop, so the results aren't partial.
+func interruptContext(watch bool) context.Context {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		if watch {
+			log.Println("Interrupted.  Stopping to watch and writing checkpoints.  Interrupt again to quit immediately.")
+		} else {
+			log.Println("Interrupted.  Stopping and writing partial results.  Interrupt again to quit immediately.")
+		}
+		stop()
+	}()
 
-	var threshold float64
+	return ctx
+}
+
+func main() {
 
 	log.Printf("Command line arguments: %s\n", os.Args[1:])
 
 	// Read config file first.
 	params := ParseConfig()
 
-	// Let command line arguments overwrite arguments in config file.
-	params = ParseFlagSet(os.Args[1:], params)
+	// Let command line arguments overwrite arguments in config file.  The
+	// first argument is either a subcommand or, for backwards compatibility,
+	// a top-level flag.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command := findCommand(os.Args[1])
+		if command == nil {
+			log.Fatalf("Unknown command %q.  Run \"%s -help\" for a list of commands.", os.Args[1], toolName)
+		}
+		if command.Run != nil {
+			if err := command.Run(interruptContext(false), os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		params = ParseCommand(command, os.Args[2:], params)
+	} else {
+		params = ParseFlagSet(os.Args[1:], params)
+	}
 	setNonPrimitiveParams(params)
 
 	if params.ShowVersion {
@@ -244,30 +423,34 @@ func main() {
 		log.Printf("Using log file %q.\n", params.LogFile)
 	}
 
-	if params.ArchiveData == "" {
+	if len(params.ArchiveData) == 0 {
 		log.Fatalln("No file or directory given.  Please use the -data switch.")
 	}
 
 	if params.Matrix {
-		if threshold == 0 {
+		if params.Threshold == 0 {
 			log.Println("You might want to use -threshold to only consider similarities above or equal to the given threshold.")
 		}
-		params.Callbacks = append(params.Callbacks, SimilarityMatrix)
+		extension := "txt"
+		if params.Visualise {
+			extension = "dot"
+		}
+		params.Callbacks = append(params.Callbacks, Analysis{"matrix", extension, SimilarityMatrix, false})
 	}
 
 	if params.Fingerprints {
-		params.Callbacks = append(params.Callbacks, AnalyseFingerprints)
+		params.Callbacks = append(params.Callbacks, Analysis{"fingerprints", "txt", AnalyseFingerprints, false})
 	}
 
 	if params.PrintFiles {
-		params.Callbacks = append(params.Callbacks, PrettyPrint)
+		params.Callbacks = append(params.Callbacks, Analysis{"print", "csv", PrettyPrint, false})
 	}
 
 	if params.PrintSome {
 		if params.InputData == "" {
 			log.Fatalln("Need a file containing newline-separated relay fingerprints.  Use -input switch.")
 		}
-		params.Callbacks = append(params.Callbacks, PrintSome)
+		params.Callbacks = append(params.Callbacks, Analysis{"printsome", "csv", PrintSome, false})
 	}
 
 	if params.Neighbours != -1 {
@@ -277,207 +460,349 @@ func main() {
 		if params.ReferenceRelay == "" {
 			log.Fatalln("No reference relay given.  Please use the -referencerelay switch.")
 		}
-		params.Callbacks = append(params.Callbacks, FindNearestNeighbours)
+		params.Callbacks = append(params.Callbacks, Analysis{"neighbours", "txt", FindNearestNeighbours, false})
 	}
 
 	if params.Churn {
 		log.Printf("Using '%s' CSV format.  Use -csvformat if you don't like that.", params.CSVFormat)
-		params.Callbacks = append(params.Callbacks, AnalyseChurn)
+		params.Callbacks = append(params.Callbacks, Analysis{"churn", "csv", AnalyseChurn, true})
 	}
 
 	if params.Contrib {
 		if params.InputData == "" {
 			log.Fatalln("Need a file containing IP address blocks, one per line.  Use -input switch.")
 		}
-		params.Callbacks = append(params.Callbacks, BandwidthContribution)
+		params.Callbacks = append(params.Callbacks, Analysis{"contrib", "csv", BandwidthContribution, false})
 	}
 
 	if params.Uptime {
 		if params.InputData == "" {
 			log.Println("You didn't use -input to specify the file name to write to.  Using default.")
-			params.InputData = "/tmp/uptime-visualisation.jpg"
+			params.InputData = defaultUptimeImage
 		}
-		params.Callbacks = append(params.Callbacks, AnalyseUptimes)
+		params.Callbacks = append(params.Callbacks, Analysis{"uptime", "txt", AnalyseUptimes, true})
 	}
 
 	if params.BwFraction != -1 {
 		if params.BwFraction < 0 || params.BwFraction > 1 {
 			log.Fatalf("Bandwidth fraction must be in [0,1], but %.3f was given.\n", params.BwFraction)
 		}
-		params.Callbacks = append(params.Callbacks, FindFastRelays)
+		params.Callbacks = append(params.Callbacks, Analysis{"bwfraction", "csv", FindFastRelays, false})
+	}
+
+	if params.Workers < 1 {
+		log.Fatalf("Number of workers must be > 0, but %d given.\n", params.Workers)
+	}
+
+	if params.ReorderBuffer < 0 {
+		log.Fatalf("Reorder buffer size must not be negative, but %d given.\n", params.ReorderBuffer)
 	}
 
 	if params.CSVFormat != longCSVFormat && params.CSVFormat != wideCSVFormat {
 		log.Fatalf("Parameter 'csvformat' must be either '%s' or '%s', but is '%s'.", longCSVFormat, wideCSVFormat, params.CSVFormat)
 	}
 
+	if params.GapPolicy != gapNormalise && params.GapPolicy != gapReset && params.GapPolicy != gapSkip {
+		log.Fatalf("Parameter 'gappolicy' must be '%s', '%s', or '%s', but is '%s'.", gapNormalise, gapReset, gapSkip, params.GapPolicy)
+	}
+
+	if params.Detector != thresholdDetector && params.Detector != robustDetector {
+		log.Fatalf("Parameter 'detector' must be either '%s' or '%s', but is '%s'.", thresholdDetector, robustDetector, params.Detector)
+	}
+
+	if params.ChurnInterval < 0 {
+		log.Fatalf("Consensus interval must not be negative, but %s given.\n", params.ChurnInterval)
+	}
+
+	if params.OnError != skipPolicy && params.OnError != warnPolicy && params.OnError != abortPolicy {
+		log.Fatalf("Parameter 'on-error' must be '%s', '%s', or '%s', but is '%s'.", skipPolicy, warnPolicy, abortPolicy, params.OnError)
+	}
+
+	if params.Format != textFormat && params.Format != jsonFormat {
+		log.Fatalf("Parameter 'format' must be either '%s' or '%s', but is '%s'.", textFormat, jsonFormat, params.Format)
+	}
+
+	if params.Format == jsonFormat && params.Visualise {
+		log.Fatalln("DOT code cannot be written in JSON format.  Please don't use -visualise together with -format json.")
+	}
+
 	if len(params.Callbacks) == 0 {
-		log.Fatalln("No command given.  Please use -print, -printsome, -fingerprint, -matrix, -neighbours, -bwfraction, or -churn.")
+		log.Fatalf("No command given.  Run \"%s -help\" for a list of commands.", toolName)
 	}
 
-	if err := ParseFiles(params); err != nil {
-		log.Fatal(err)
+	if params.Resume {
+		if params.OutputDir == "" {
+			log.Fatalln("Checkpoints are kept in the output directory.  Please use -resume together with -output.")
+		}
+		if params.Cumulative {
+			log.Fatalln("Analyses cannot be resumed in cumulative mode.")
+		}
+		if err := resumeStartDate(params); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if params.Watch {
+		if params.Cumulative {
+			log.Fatalln("New files cannot be accumulated.  Please don't use -watch together with -cumulative.")
+		}
+		if params.Uptime {
+			log.Fatalln("The uptime image is only written at the end.  Please don't use -watch together with -uptime.")
+		}
+		if params.WatchInterval <= 0 {
+			log.Fatalf("Watch interval must be > 0, but %s given.\n", params.WatchInterval)
+		}
 	}
-}
 
-// fileInRange tries to extract the time that's part of consensus file names,
-// e.g., 2015-07-31-15-00-00-consensus.  If the time is in the given date
-// range, it returns true, otherwise false.  By trusting that the file name
-// contains a time stamp (and all consensus files from CollecTor do), we can
-// discard irrelevant files significantly faster than by parsing their content.
-func fileInRange(fileName string, startDate, endDate time.Time) bool {
+	// Only some analyses need router descriptors.  Indexing them can take a
+	// while, so we don't do it unless necessary.
+	if params.DescriptorDir != "" && (params.Neighbours != -1 || params.PrintFiles || params.PrintSome || params.Matrix) {
+		if params.DescIndexDir == "" {
+			params.DescIndexDir = filepath.Join(params.DescriptorDir, ".sybilhunter-index")
+		}
+		store, err := OpenDescriptorStore(params.DescriptorDir, params.DescIndexDir, params.DescCacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		params.Descriptors = store
+	}
 
-	date, err := time.Parse("2006-01-02-15-04-05-consensus", path.Base(fileName))
-	if err != nil {
-		// Parse the file if we are unable to extract the timestamp.
-		return true
+	if params.AlertDedup < 0 {
+		log.Fatalf("Alert deduplication window must not be negative, but %s given.\n", params.AlertDedup)
 	}
+	params.Alerter = NewAlerter(params)
 
-	return date.After(startDate) && date.Before(endDate)
+	ctx := interruptContext(params.Watch)
+	err := ParseFiles(ctx, params)
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		// Watching only ends once we are interrupted, so that's a clean
+		// shutdown.  The analyses wrote their checkpoints, and the sinks
+		// are flushed.
+		if params.Watch {
+			log.Println("Stopped watching.")
+			return
+		}
+		log.Println("Exiting after interruption.  Results are incomplete.")
+		os.Exit(130)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 // GatherObjects returns a callback function that gathers data objects from a
 // file, directory, or tarball.  If the given object set pointer is not nil, it
 // is used to accumulate objects.  If the given channels are not nil,
 // GatherObjects sends the gathered data objects over the channels instead of
-// accumulating them.
-func GatherObjects(objs *tor.ObjectSet, channels []chan tor.ObjectSet, params *CmdLineParams) func(string, os.FileInfo, io.Reader) error {
+// accumulating them.  Parsed, skipped, and failed files are counted in the
+// given parse summary.  Once the given context is cancelled, no more objects
+// are delivered.
+func GatherObjects(ctx context.Context, objs *tor.ObjectSet, channels []chan tor.ObjectSet, params *CmdLineParams, summary *ParseSummary) WalkFunc {
 
 	return func(path string, info os.FileInfo, r io.Reader) error {
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		if info.IsDir() {
 			return nil
 		}
 
-		if !fileInRange(path, params.StartDate, params.EndDate) {
+		br := bufio.NewReaderSize(r, timestampPeekSize)
+		header, _ := br.Peek(timestampPeekSize)
+		if !fileInRange(path, header, params.StartDate, params.EndDate) {
 			log.Printf("File %s not in desired date range.\n", path)
+			summary.AddSkipped(path, "not in date range")
 			return nil
 		}
 
-		objects, err := tor.ParseUnknown(r)
+		objects, err := parseObjects(br)
 		if err != nil {
-			log.Println(err)
-			return nil
+			return summary.AddFailed(path, err)
 		}
 
-		if channels != nil {
-			// Processing independently.
-			for _, channel := range channels {
-				if objects != nil {
-					channel <- objects
-				}
-			}
-		} else {
-			// Processing cumulatively.
-			if *objs == nil {
-				*objs = objects
-			} else {
-				(*objs).Merge(objects)
-			}
+		if objects == nil {
+			summary.AddSkipped(path, "no data objects found")
+			return nil
 		}
+		summary.AddParsed()
 
-		return nil
+		return deliverObjects(ctx, objects, objs, channels)
 	}
 }
 
-// Walk over the entries of path, open each one, and pass it to callback.
-func walkPath(path string, callback func(string, os.FileInfo, io.Reader) error) error {
+// deliverObjects sends the given object set over the given channels.  If the
+// channels are nil, the object set is accumulated in objs instead.  An error
+// is returned if the given context is cancelled before all channels received
+// the object set.
+func deliverObjects(ctx context.Context, objects tor.ObjectSet, objs *tor.ObjectSet, channels []chan tor.ObjectSet) error {
 
-	// callback expects an already opened file.
-	walkFn := func(path string, info os.FileInfo, err error) error {
-		fd, err := os.Open(path)
-		if err != nil {
-			return err
+	if channels != nil {
+		// Processing independently.
+		for _, channel := range channels {
+			select {
+			case channel <- objects:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	} else {
+		// Processing cumulatively.
+		if *objs == nil {
+			*objs = objects
+		} else {
+			(*objs).Merge(objects)
 		}
-		defer fd.Close()
-
-		return callback(path, info, fd)
 	}
 
-	return filepath.Walk(path, walkFn)
+	return nil
 }
 
-// Walk over the entries of the named tar.xz file and pass them to callback.
-//
-// Unlike filepath.Walk, this function does not visit directory entries in
-// lexicographic order, rather the order they appear in the tar file.
-func walkTarXZFile(path string, callback func(string, os.FileInfo, io.Reader) error) error {
+// collectObjects parses the given archive data, either sequentially or, if
+// more than one worker is requested, in parallel.  The parsed object sets are
+// delivered as explained in deliverObjects.  Once the given context is
+// cancelled, parsing stops.
+func collectObjects(ctx context.Context, objs *tor.ObjectSet, channels []chan tor.ObjectSet, params *CmdLineParams, summary *ParseSummary) error {
 
-	fd, t, err := openTarXZFile(path)
-	if err != nil {
-		return err
+	if params.Workers > 1 {
+		return ParseFilesParallel(ctx, params, summary, func(objects tor.ObjectSet) error {
+			return deliverObjects(ctx, objects, objs, channels)
+		})
 	}
-	defer fd.Close()
-
-	for {
-		header, err := t.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
 
-		err = callback(header.Name, header.FileInfo(), t)
-		if err != nil {
-			return err
+	// Once we are cancelled, there's no point in walking any further, and
+	// the files we didn't get to didn't fail.
+	onError := func(path string, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		return summary.AddFailed(path, err)
 	}
 
-	return nil
+	return walkInput(ctx, params, GatherObjects(ctx, objs, channels, params, summary), onError)
 }
 
-// Walk over the entries of the given path. The treatment depends on the given
-// path: if it ends in ".tar.xz" it is passed to walkTarXZFile; otherwise it is
-// passed to walkPath.
-func walkArchiveData(path string, callback func(string, os.FileInfo, io.Reader) error) error {
+// walkInput walks over all given archive data sources.  The sources are
+// merged: documents are passed to callback in chronological order, regardless
+// of their order in the file system or in archives, and duplicate documents
+// are passed only once.  That's also the case if we process the data
+// cumulatively, so documents that are in several sources aren't counted
+// twice.  Documents outside the date range are skipped before they are
+// spilled.  The walk stops once the given context is cancelled.
+func walkInput(ctx context.Context, params *CmdLineParams, callback WalkFunc, onError ErrorFunc) error {
 
-	if strings.HasSuffix(path, ".tar.xz") {
-		return walkTarXZFile(path, callback)
-	} else {
-		return walkPath(path, callback)
+	return walkChronologically(ctx, params.ArchiveData, dateRange(params), callback, onError)
+}
+
+// dateRange returns a function that decides if a document is in the date range
+// of the given parameters.
+func dateRange(params *CmdLineParams) InRangeFunc {
+
+	return func(name string, header []byte) bool {
+		return fileInRange(name, header, params.StartDate, params.EndDate)
 	}
 }
 
 // ParseFiles parses the given directory or files and passes the parsed data to
 // the given analysis functions.  ParseFiles then waits for all these functions
-// to finish processing.
-func ParseFiles(params *CmdLineParams) error {
+// to finish processing.  An error is returned if a file could not be read or
+// parsed and the error policy is to abort.  If an analysis fails, parsing
+// stops, the remaining analyses finish with the data they already got, and the
+// analysis's error is returned.  Likewise, once the given context is
+// cancelled, parsing stops, the analyses write what they have, and the
+// context's error is returned.
+func ParseFiles(parent context.Context, params *CmdLineParams) error {
 
 	var objs tor.ObjectSet
 	var channels []chan tor.ObjectSet
-	var group sync.WaitGroup
-	group.Add(len(params.Callbacks))
+
+	group, ctx := errgroup.WithContext(parent)
+
+	summary := NewParseSummary(params.OnError)
+
+	// In watch mode, findings must show up right away, and not only once
+	// we're done.
+	sinks, err := newSinks(params.Callbacks, params.Format, params.Watch)
+	if err != nil {
+		return fmt.Errorf("Couldn't create output sinks: %s", err)
+	}
 
 	// Create a channel for and invoke all callback functions.
-	for _, analysisFunc := range params.Callbacks {
+	for i, analysis := range params.Callbacks {
 		channel := make(chan tor.ObjectSet)
 		channels = append(channels, channel)
 
-		go analysisFunc(channel, params, &group)
+		analysis, sink := analysis, sinks[i]
+		group.Go(func() error {
+			if err := analysis.Callback(ctx, channel, params, sink); err != nil {
+				if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+					log.Printf("Analysis \"%s\" stopped early.  Its results are partial.\n", analysis.Name)
+				} else {
+					log.Printf("Analysis \"%s\" failed: %s\n", analysis.Name, err)
+				}
+				return fmt.Errorf("%s: %s", analysis.Name, err)
+			}
+			return nil
+		})
 	}
 
 	if params.Cumulative {
-		log.Printf("Processing \"%s\" cumulatively.\n", params.ArchiveData)
-		walkArchiveData(params.ArchiveData, GatherObjects(&objs, nil, params))
+		log.Printf("Processing \"%s\" cumulatively.\n", strings.Join(params.ArchiveData, "\", \""))
+		err = collectObjects(ctx, &objs, nil, params, summary)
 
-		if objs == nil {
-			return errors.New("Gathered object set empty.  Are we parsing the right files?")
+		if err == nil && objs == nil {
+			err = errors.New("Gathered object set empty.  Are we parsing the right files?")
 		}
 
 		// Send accumulated object set to all callback functions.
-		for _, channel := range channels {
-			channel <- objs
+		if err == nil {
+			err = deliverObjects(ctx, objs, nil, channels)
 		}
 	} else {
-		log.Printf("Processing \"%s\" independently.\n", params.ArchiveData)
-		walkArchiveData(params.ArchiveData, GatherObjects(nil, channels, params))
+		log.Printf("Processing \"%s\" independently.\n", strings.Join(params.ArchiveData, "\", \""))
+
+		// Take note of the existing files before we process them, so we
+		// don't miss files that appear in the meanwhile.  Files that can't
+		// be listed are reported by collectObjects.
+		var watcher *inputWatcher
+		if params.Watch {
+			watcher, err = newInputWatcher(params.ArchiveData, func(string, error) error { return nil })
+		}
+
+		if err == nil {
+			err = collectObjects(ctx, nil, channels, params, summary)
+		}
+		if err == nil && params.Watch {
+			err = watchObjects(ctx, watcher, channels, params, summary)
+		}
 	}
 
 	// Close processing channels and wait for goroutines to finish.
 	for _, channel := range channels {
 		close(channel)
 	}
-	group.Wait()
+	analysisErr := group.Wait()
 
-	return nil
+	for _, sink := range sinks {
+		if closeErr := sink.Close(); closeErr != nil {
+			log.Printf("Couldn't close output sink: %s\n", closeErr)
+		}
+	}
+
+	log.Printf("Parse summary: %s\n", summary)
+
+	// If we were interrupted, the analyses' and parser's errors are just a
+	// consequence of that.
+	if err := parent.Err(); err != nil {
+		return err
+	}
+
+	// A failed analysis cancels parsing, so its error is the one that
+	// matters.
+	if analysisErr != nil {
+		return analysisErr
+	}
+
+	return err
 }
@@ -0,0 +1,103 @@
+// Test the uptime sequences of relays.
+
+package uptime
+
+import (
+	"reflect"
+	"testing"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// addConsensuses adds the given number of hourly consensuses to the given
+// uptimes.  The given map determines in which consensuses a relay is online.
+func addConsensuses(uptimes *Uptimes, count int, online map[tor.Fingerprint]func(int) bool) {
+
+	for i := 0; i < count; i++ {
+		consensus := tor.NewConsensus()
+		for fingerprint, isOnline := range online {
+			if isOnline(i) {
+				consensus.Set(fingerprint, &tor.RouterStatus{Fingerprint: fingerprint})
+			}
+		}
+		uptimes.AddConsensus(consensus, nil)
+	}
+}
+
+// uptimeTests holds relays that are online in some of 26 hourly consensuses,
+// i.e., a day and two hours, and their expected uptime sequences.
+var uptimeTests = []struct {
+	fingerprint tor.Fingerprint
+	isOnline    func(int) bool
+	sequence    OnlineSequence
+	total       int
+}{
+	{"A", func(int) bool { return true }, OnlineSequence{0xffffff, 0x3}, 26},
+	{"B", func(i int) bool { return i%24 == 1 }, OnlineSequence{0x2, 0x2}, 2},
+	// C joins on the second day, so its first day is empty.
+	{"C", func(i int) bool { return i == 24 }, OnlineSequence{0x0, 0x1}, 1},
+	// D leaves on the first day, but still gets a second day.
+	{"D", func(i int) bool { return i < 2 }, OnlineSequence{0x3, 0x0}, 2},
+}
+
+func TestAddConsensus(t *testing.T) {
+
+	online := make(map[tor.Fingerprint]func(int) bool)
+	for _, test := range uptimeTests {
+		online[test.fingerprint] = test.isOnline
+	}
+
+	uptimes := NewUptimes()
+	addConsensuses(uptimes, 26, online)
+
+	if uptimes.Consensuses != 26 || uptimes.Hour != 1 || uptimes.DaysPassed != 1 {
+		t.Errorf("Added %d consensuses, up to hour %d of day %d, but expected 26, 1, and 1.",
+			uptimes.Consensuses, uptimes.Hour, uptimes.DaysPassed)
+	}
+
+	for _, test := range uptimeTests {
+		sequence := uptimes.ForFingerprint[test.fingerprint]
+		if !reflect.DeepEqual(sequence, test.sequence) {
+			t.Errorf("%s: uptime sequence is %x, but expected %x.", test.fingerprint, sequence, test.sequence)
+		}
+		if total := sequence.TotalUptime(); total != test.total {
+			t.Errorf("%s: total uptime is %d, but expected %d.", test.fingerprint, total, test.total)
+		}
+	}
+}
+
+func TestPruneUptimes(t *testing.T) {
+
+	online := make(map[tor.Fingerprint]func(int) bool)
+	for _, test := range uptimeTests {
+		online[test.fingerprint] = test.isOnline
+	}
+
+	uptimes := NewUptimes()
+	addConsensuses(uptimes, 26, online)
+
+	// Only A was always online.
+	if pruned := PruneUptimes(uptimes, 26); pruned != 1 {
+		t.Errorf("Pruned %d relays, but expected 1.", pruned)
+	}
+	if _, exists := uptimes.ForFingerprint["A"]; exists {
+		t.Errorf("Relay A has 100%% uptime, but wasn't pruned.")
+	}
+	if len(uptimes.ForFingerprint) != len(uptimeTests)-1 {
+		t.Errorf("%d relays remain, but expected %d.", len(uptimes.ForFingerprint), len(uptimeTests)-1)
+	}
+}
+
+func TestIsOnline(t *testing.T) {
+
+	var day Day
+	day.MarkOnline(0)
+	day.MarkOnline(23)
+
+	for hour := uint32(0); hour < 24; hour++ {
+		expected := hour == 0 || hour == 23
+		if online := day.IsOnline(hour); online != expected {
+			t.Errorf("Hour %d: online is %t, but expected %t.", hour, online, expected)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"sort"
 	"time"
 
@@ -48,23 +49,26 @@ func (rss *RouterStatusSorter) Less(i int, j int) bool {
 }
 
 // getOutputDir returns the directory to which files can be written to.  If it
-// is not set by the user, we randomly generate a new one in /tmp/.
+// is not set by the user, we randomly generate a new one in /tmp/.  If it is
+// set but does not exist yet, we create it.
 func getOutputDir() (string, error) {
 
 	var err error
 
+	if outputDir != "" {
+		return outputDir, os.MkdirAll(outputDir, 0755)
+	}
+
 	// The user did not point us to a directory, so we have to create a new
 	// one.
-	if outputDir == "" {
-		fileName := fmt.Sprintf("sybilhunter_%s_", time.Now().Format(timeLayout))
-		outputDir, err = ioutil.TempDir("/tmp/", fileName)
-		if err != nil {
-			return "", err
-		}
-
-		log.Printf("Created output directory \"%s\".\n", outputDir)
+	fileName := fmt.Sprintf("sybilhunter_%s_", time.Now().Format(timeLayout))
+	outputDir, err = ioutil.TempDir("/tmp/", fileName)
+	if err != nil {
+		return "", err
 	}
 
+	log.Printf("Created output directory \"%s\".\n", outputDir)
+
 	return outputDir, nil
 }
 
@@ -88,68 +92,3 @@ func writeStringToFile(fileName string, content string) error {
 
 	return nil
 }
-
-// MaxUInt64 returns the larger of the two given integers.
-func MaxUInt64(a, b uint64) uint64 {
-	if a > b {
-		return a
-	} else {
-		return b
-	}
-}
-
-// MinUInt64 returns the smaller of the two given integers.
-func MinUInt64(a, b uint64) uint64 {
-	if a < b {
-		return a
-	} else {
-		return b
-	}
-}
-
-// MaxUInt16 returns the larger of the two given integers.
-func MaxUInt16(a, b uint16) uint16 {
-	if a > b {
-		return a
-	} else {
-		return b
-	}
-}
-
-// MinUInt16 returns the smaller of the two given integers.
-func MinUInt16(a, b uint16) uint16 {
-	if a < b {
-		return a
-	} else {
-		return b
-	}
-}
-
-// RouterFlagsToString converts a RouterFlags struct to a constant-size string
-// containing a series of bits.
-func RouterFlagsToString(flags *tor.RouterFlags) string {
-
-	// Convert a boolean value to 1 or 0.
-	b2i := func(flag bool) int {
-		if flag == true {
-			return 1
-		} else {
-			return 0
-		}
-	}
-
-	return fmt.Sprintf("%d%d%d%d%d%d%d%d%d%d%d%d%d",
-		b2i(flags.Authority),
-		b2i(flags.BadExit),
-		b2i(flags.Exit),
-		b2i(flags.Fast),
-		b2i(flags.Guard),
-		b2i(flags.HSDir),
-		b2i(flags.Named),
-		b2i(flags.Stable),
-		b2i(flags.Running),
-		b2i(flags.Unnamed),
-		b2i(flags.Valid),
-		b2i(flags.V2Dir),
-		b2i(flags.Authority))
-}
@@ -6,37 +6,70 @@ import (
 	"fmt"
 	"log"
 	"strings"
-)
 
-// GenerateDOTGraph generates DOT graph code out of the given Sybil cluster.
-// This code can then be compiled using dot(1).
-func GenerateDOTGraph(cluster *SybilCluster) {
+	"github.com/NullHypothesis/sybilhunter/similarity"
+	tor "github.com/NullHypothesis/zoossh"
+)
 
-	fmt.Println("graph sybils {")
-	fmt.Println("node [fillcolor=\"#dddddd\", style=\"filled,solid\"]")
-	fmt.Println("edge [fontsize=8]")
+// GenerateDOTGraph generates DOT graph code out of the given Sybil cluster and
+// writes it to the given sink.  This code can then be compiled using dot(1).
+func GenerateDOTGraph(cluster *similarity.SybilCluster, sink Sink) {
 
+	writeDOTHeader(sink)
 	for _, pair := range cluster.SybilPairs {
-		fmt.Printf("\t\"%s\\n%s\" -- \"%s\\n%s\" [label=\" %s\"];\n",
-			pair.desc1.Nickname,
-			pair.desc1.Fingerprint[:8],
-			pair.desc2.Nickname,
-			pair.desc2.Fingerprint[:8],
-			strings.Replace(pair.String(), "\n", "\\l", -1))
-
-		// Add Atlas URLs to relay nodes.
-		fmt.Printf("\"%s\\n%s\" [URL=\"https://atlas.torproject.org/#details/%s\"]\n",
-			pair.desc1.Nickname,
-			pair.desc1.Fingerprint[:8],
-			pair.desc1.Fingerprint)
-
-		fmt.Printf("\"%s\\n%s\" [URL=\"https://atlas.torproject.org/#details/%s\"]\n",
-			pair.desc2.Nickname,
-			pair.desc2.Fingerprint[:8],
-			pair.desc2.Fingerprint)
+		writeDOTPair(pair.Desc1.Nickname, pair.Desc1.Fingerprint,
+			pair.Desc2.Nickname, pair.Desc2.Fingerprint, pair.String(), sink)
+	}
+	writeDOTFooter(sink)
+}
+
+// GenerateMicrodescDOTGraph generates DOT graph code out of the given similar
+// relay pairs of a microdescriptor consensus, and writes it to the given sink.
+func GenerateMicrodescDOTGraph(pairs []*similarity.MicrodescSimilarity, sink Sink) {
+
+	writeDOTHeader(sink)
+	for _, pair := range pairs {
+		writeDOTPair(pair.Status1.Nickname, pair.Status1.Fingerprint,
+			pair.Status2.Nickname, pair.Status2.Fingerprint, pair.String(), sink)
 	}
+	writeDOTFooter(sink)
+}
+
+// writeDOTHeader writes the beginning of a DOT graph to the given sink.
+func writeDOTHeader(sink Sink) {
 
-	fmt.Println("}")
+	fmt.Fprintln(sink, "graph sybils {")
+	fmt.Fprintln(sink, "node [fillcolor=\"#dddddd\", style=\"filled,solid\"]")
+	fmt.Fprintln(sink, "edge [fontsize=8]")
+}
+
+// writeDOTFooter writes the end of a DOT graph to the given sink.
+func writeDOTFooter(sink Sink) {
+
+	fmt.Fprintln(sink, "}")
 
 	log.Println("Compile DOT output by running: dot -o sybils.svg -Tsvg graph.dot")
 }
+
+// writeDOTPair writes an edge between the two given relays, labelled with the
+// given similarity summary, to the given sink.
+func writeDOTPair(nick1 string, fpr1 tor.Fingerprint, nick2 string, fpr2 tor.Fingerprint, summary string, sink Sink) {
+
+	fmt.Fprintf(sink, "\t\"%s\\n%s\" -- \"%s\\n%s\" [label=\" %s\"];\n",
+		nick1,
+		fpr1[:8],
+		nick2,
+		fpr2[:8],
+		strings.Replace(summary, "\n", "\\l", -1))
+
+	// Add Atlas URLs to relay nodes.
+	fmt.Fprintf(sink, "\"%s\\n%s\" [URL=\"https://atlas.torproject.org/#details/%s\"]\n",
+		nick1,
+		fpr1[:8],
+		fpr1)
+
+	fmt.Fprintf(sink, "\"%s\\n%s\" [URL=\"https://atlas.torproject.org/#details/%s\"]\n",
+		nick2,
+		fpr2[:8],
+		fpr2)
+}
@@ -0,0 +1,126 @@
+// Watches the input for new files and feeds them to running analyses.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	tor "github.com/NullHypothesis/zoossh"
+)
+
+// fileState is what we know about a file when we poll the input.  A file
+// whose state doesn't change between two polls is done being written.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// inputWatcher keeps track of the files in the input, and which of them we
+// already processed.
+type inputWatcher struct {
+	sources   []string
+	processed map[string]bool
+	pending   map[string]fileState
+}
+
+// newInputWatcher returns an input watcher for the given sources.  All files
+// that currently exist in the sources count as processed.
+func newInputWatcher(sources []string, onError ErrorFunc) (*inputWatcher, error) {
+
+	w := &inputWatcher{
+		sources:   sources,
+		processed: make(map[string]bool),
+		pending:   make(map[string]fileState),
+	}
+
+	files, _, err := listFiles(sources, onError)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		w.processed[file] = true
+	}
+
+	return w, nil
+}
+
+// poll returns the files that appeared since the last poll, and whose size and
+// modification time didn't change since then.  Files that are still being
+// written are returned by a later poll.  The returned files count as
+// processed.
+func (w *inputWatcher) poll(onError ErrorFunc) ([]string, error) {
+
+	files, infos, err := listFiles(w.sources, onError)
+	if err != nil {
+		return nil, err
+	}
+
+	var settled []string
+	for i, file := range files {
+		if w.processed[file] {
+			continue
+		}
+
+		state := fileState{infos[i].Size(), infos[i].ModTime()}
+		if previous, ok := w.pending[file]; ok && previous == state {
+			delete(w.pending, file)
+			w.processed[file] = true
+			settled = append(settled, file)
+			continue
+		}
+		w.pending[file] = state
+	}
+
+	return settled, nil
+}
+
+// watchObjects polls the given archive data for new files every
+// params.WatchInterval, and sends the object sets of new files over the given
+// channels, in chronological order.  Files that already existed when
+// watchObjects was called are not processed again.  watchObjects only returns
+// once the given context is cancelled, or if a file could not be read or
+// parsed and the error policy is to abort.
+func watchObjects(ctx context.Context, watcher *inputWatcher, channels []chan tor.ObjectSet, params *CmdLineParams, summary *ParseSummary) error {
+
+	onError := func(path string, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Files may disappear while we poll, e.g., if a mirror cleans up.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return summary.AddFailed(path, err)
+	}
+
+	log.Printf("Watching \"%s\" for new files every %s.\n", strings.Join(params.ArchiveData, "\", \""), params.WatchInterval)
+
+	ticker := time.NewTicker(params.WatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		files, err := watcher.poll(onError)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		log.Printf("Processing new files \"%s\".\n", strings.Join(files, "\", \""))
+		err = walkChronologically(ctx, files, dateRange(params), GatherObjects(ctx, nil, channels, params, summary), onError)
+		if err != nil {
+			return err
+		}
+	}
+}